@@ -0,0 +1,177 @@
+package mqrr
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/koho/mqrr/trace"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Fields of the access log.
+const (
+	LogLatency       = "latency"
+	LogTopic         = "topic"
+	LogRoute         = "route"
+	LogParams        = "params"
+	LogStatus        = "status"
+	LogPayloadSize   = "payload_size"
+	LogReplySize     = "reply_size"
+	LogCorrelationID = "correlation_id"
+	LogTraceID       = "trace_id"
+)
+
+// AccessLogConfig defines the config of the AccessLogWithConfig middleware.
+type AccessLogConfig struct {
+	// Fields are written in order, default is the latency and topic.
+	Fields []string
+	// JSON writes a JSON object for each request instead of text.
+	JSON bool
+	// Output is the writer of the access log. Default is the engine logger at Info level.
+	Output io.Writer
+	// SkipRoutes are the route patterns not logged, e.g. `device/:id/report`.
+	SkipRoutes []string
+	// ErrorsOnly logs only the requests with an error status.
+	ErrorsOnly bool
+	// SlowThreshold logs only the requests slower than it, when positive.
+	// Along with ErrorsOnly, a request is logged if it is either failed or slow.
+	SlowThreshold time.Duration
+}
+
+// AccessLog returns the default access log middleware, which logs the
+// latency and topic of every request.
+func AccessLog() HandlerFunc {
+	return AccessLogWithConfig(AccessLogConfig{})
+}
+
+// AccessLogWithConfig returns an access log middleware with the config.
+func AccessLogWithConfig(conf AccessLogConfig) HandlerFunc {
+	fields := conf.Fields
+	if len(fields) == 0 {
+		fields = []string{LogLatency, LogTopic}
+	}
+	skip := make(map[string]bool)
+	for _, route := range conf.SkipRoutes {
+		skip[route] = true
+	}
+	return func(c *Context) {
+		if skip[c.FullTopic()] {
+			c.Next()
+			return
+		}
+		start := time.Now()
+		c.Next()
+		latency := time.Since(start)
+
+		failed := c.GetStatus() >= StatusBadRequest
+		slow := conf.SlowThreshold > 0 && latency >= conf.SlowThreshold
+		if (conf.ErrorsOnly || conf.SlowThreshold > 0) && !(conf.ErrorsOnly && failed) && !slow {
+			return
+		}
+		var line string
+		if conf.JSON {
+			line = formatJSONLog(c, fields, latency)
+		} else {
+			line = formatTextLog(c, fields, latency)
+		}
+		if conf.Output != nil {
+			fmt.Fprintln(conf.Output, line)
+		} else {
+			c.Logger().Infof("%s", line)
+		}
+	}
+}
+
+func logField(c *Context, field string, latency time.Duration) interface{} {
+	switch field {
+	case LogLatency:
+		return latency
+	case LogTopic:
+		return c.Request.Topic
+	case LogRoute:
+		return c.FullTopic()
+	case LogParams:
+		params := make(map[string]string)
+		for k := range c.Params {
+			params[k] = c.Param(k)
+		}
+		return params
+	case LogStatus:
+		return c.GetStatus()
+	case LogPayloadSize:
+		return len(c.Request.Payload)
+	case LogReplySize:
+		return len(c.GetResponse())
+	case LogCorrelationID:
+		if c.Request.Properties == nil {
+			return ""
+		}
+		return string(c.Request.Properties.CorrelationData)
+	case LogTraceID:
+		if sc, ok := trace.SpanContextFromContext(c.Context()); ok {
+			return sc.TraceID.String()
+		}
+		return ""
+	}
+	return nil
+}
+
+func formatTextLog(c *Context, fields []string, latency time.Duration) string {
+	parts := make([]string, 0, len(fields))
+	for _, field := range fields {
+		switch v := logField(c, field, latency).(type) {
+		case time.Duration:
+			parts = append(parts, fmt.Sprintf("%13v", v))
+		case map[string]string:
+			keys := make([]string, 0, len(v))
+			for k := range v {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			params := make([]string, 0, len(keys))
+			for _, k := range keys {
+				params = append(params, k+"="+v[k])
+			}
+			parts = append(parts, fmt.Sprintf("%s=%q", field, strings.Join(params, ",")))
+		default:
+			if field == LogTopic {
+				parts = append(parts, fmt.Sprintf("%#v", v))
+			} else if field == LogStatus {
+				parts = append(parts, fmt.Sprintf("%3d", v))
+			} else if s, ok := v.(string); ok {
+				parts = append(parts, fmt.Sprintf("%s=%q", field, s))
+			} else {
+				parts = append(parts, fmt.Sprintf("%s=%v", field, v))
+			}
+		}
+	}
+	return strings.Join(parts, " | ")
+}
+
+func formatJSONLog(c *Context, fields []string, latency time.Duration) string {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, field := range fields {
+		v := logField(c, field, latency)
+		if d, ok := v.(time.Duration); ok {
+			v = d.Seconds()
+			field += "_seconds"
+		}
+		value, err := json.Marshal(v)
+		if err != nil {
+			continue
+		}
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, _ := json.Marshal(field)
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(value)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
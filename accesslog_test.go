@@ -0,0 +1,65 @@
+package mqrr
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+func runAccessLog(conf AccessLogConfig, handler HandlerFunc, payload string) string {
+	var b bytes.Buffer
+	conf.Output = &b
+	r := New()
+	r.AccessLogger = AccessLogWithConfig(conf)
+	r.Route("user/:name", handler)
+	rt := r.routes["user/:name"]
+	r.handleRequest(nil, buildContext(&paho.Publish{
+		Topic:   "user/john",
+		Payload: []byte(payload),
+		Properties: &paho.PublishProperties{
+			CorrelationData: []byte("c1"),
+		},
+	}, rt.params), rt)
+	return b.String()
+}
+
+func TestAccessLogText(t *testing.T) {
+	out := runAccessLog(AccessLogConfig{}, func(c *Context) {}, "")
+	assert.True(t, strings.HasSuffix(out, ` | "user/john"`+"\n"), out)
+
+	out = runAccessLog(AccessLogConfig{
+		Fields: []string{LogStatus, LogRoute, LogParams, LogPayloadSize, LogReplySize, LogCorrelationID},
+	}, func(c *Context) { c.String("hello") }, "john")
+	assert.Equal(t, `200 | route="user/:name" | params="name=john" | payload_size=4 | reply_size=5 | correlation_id="c1"`+"\n", out)
+}
+
+func TestAccessLogJSON(t *testing.T) {
+	out := runAccessLog(AccessLogConfig{
+		Fields: []string{LogLatency, LogRoute, LogParams, LogStatus},
+		JSON:   true,
+	}, func(c *Context) { c.Status(StatusForbidden) }, "")
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(out), &entry))
+	assert.Equal(t, "user/:name", entry["route"])
+	assert.Equal(t, map[string]interface{}{"name": "john"}, entry["params"])
+	assert.Equal(t, float64(StatusForbidden), entry["status"])
+	assert.Contains(t, entry, "latency_seconds")
+}
+
+func TestAccessLogFilters(t *testing.T) {
+	ok := func(c *Context) {}
+	failed := func(c *Context) { c.Status(StatusBadRequest) }
+	slow := func(c *Context) { time.Sleep(20 * time.Millisecond) }
+
+	assert.Empty(t, runAccessLog(AccessLogConfig{SkipRoutes: []string{"user/:name"}}, ok, ""))
+	assert.Empty(t, runAccessLog(AccessLogConfig{ErrorsOnly: true}, ok, ""))
+	assert.NotEmpty(t, runAccessLog(AccessLogConfig{ErrorsOnly: true}, failed, ""))
+	assert.Empty(t, runAccessLog(AccessLogConfig{SlowThreshold: 10 * time.Millisecond}, ok, ""))
+	assert.NotEmpty(t, runAccessLog(AccessLogConfig{SlowThreshold: 10 * time.Millisecond}, slow, ""))
+	assert.NotEmpty(t, runAccessLog(AccessLogConfig{ErrorsOnly: true, SlowThreshold: 10 * time.Millisecond}, slow, ""))
+}
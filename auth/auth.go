@@ -0,0 +1,54 @@
+// Package auth provides an authentication middleware verifying the JWT bearer
+// token carried in a user property of the request.
+package auth
+
+import (
+	"github.com/koho/mqrr"
+	"strings"
+)
+
+// TokenProperty is the user property key of the bearer token.
+// It matches the one attached by client.WithToken.
+const TokenProperty = "authorization"
+
+// ClaimsKey is the Context key of the verified Claims.
+const ClaimsKey = "mqrr/auth/claims"
+
+// Handler returns a middleware verifying the bearer token of the request.
+// The claims are stored in the Context, see GetClaims. If the token is missing
+// or invalid, it replies with the StatusUnauthorized status.
+func (v *Verifier) Handler() mqrr.HandlerFunc {
+	return func(c *mqrr.Context) {
+		token := c.Property(TokenProperty)
+		if len(token) > 7 && strings.EqualFold(token[:7], "bearer ") {
+			token = token[7:]
+		}
+		if token == "" {
+			unauthorized(c, "missing token")
+			return
+		}
+		claims, err := v.Verify(token)
+		if err != nil {
+			unauthorized(c, err.Error())
+			return
+		}
+		c.Set(ClaimsKey, claims)
+		c.Next()
+	}
+}
+
+// GetClaims returns the claims of the authenticated request.
+func GetClaims(c *mqrr.Context) (Claims, bool) {
+	v, ok := c.Get(ClaimsKey)
+	if !ok {
+		return nil, false
+	}
+	claims, ok := v.(Claims)
+	return claims, ok
+}
+
+func unauthorized(c *mqrr.Context, reason string) {
+	c.Status(mqrr.StatusUnauthorized)
+	c.String(reason)
+	c.Abort()
+}
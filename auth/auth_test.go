@@ -0,0 +1,55 @@
+package auth
+
+import (
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/koho/mqrr"
+	"github.com/koho/mqrr/client"
+	"github.com/koho/mqrr/mqrrtest"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestHandler(t *testing.T) {
+	secret := []byte("secret")
+	v := NewHMAC(secret)
+	r := mqrr.New()
+	r.AccessLogger = nil
+	calls := 0
+	r.Route("user/profile", func(c *mqrr.Context) {
+		calls++
+		claims, ok := GetClaims(c)
+		assert.True(t, ok)
+		c.String(claims.String("sub"))
+	}, mqrr.With(v.Handler()))
+	do := func(token string) *mqrrtest.ResponseRecorder {
+		var props []paho.UserProperty
+		if token != "" {
+			props = append(props, paho.UserProperty{Key: TokenProperty, Value: token})
+		}
+		return mqrrtest.Do(r, "user/profile", nil, props...)
+	}
+
+	rec := do("")
+	assert.Equal(t, mqrr.StatusUnauthorized, rec.Status())
+	assert.Equal(t, "missing token", string(rec.Payload()))
+
+	rec = do("Bearer " + signToken(t, "HS256", "", map[string]interface{}{"sub": "john"}, hs256([]byte("other"))))
+	assert.Equal(t, mqrr.StatusUnauthorized, rec.Status())
+	assert.Equal(t, ErrInvalidSignature.Error(), string(rec.Payload()))
+
+	expired := time.Now().Add(-time.Hour).Unix()
+	rec = do("Bearer " + signToken(t, "HS256", "", map[string]interface{}{"sub": "john", "exp": expired}, hs256(secret)))
+	assert.Equal(t, mqrr.StatusUnauthorized, rec.Status())
+	assert.Equal(t, ErrExpired.Error(), string(rec.Payload()))
+	assert.Equal(t, 0, calls)
+
+	rec = do("bearer " + signToken(t, "HS256", "", map[string]interface{}{"sub": "john"}, hs256(secret)))
+	assert.Equal(t, mqrr.StatusOK, rec.Status())
+	assert.Equal(t, "john", string(rec.Payload()))
+	assert.Equal(t, 1, calls)
+}
+
+func TestTokenProperty(t *testing.T) {
+	assert.Equal(t, client.TokenProperty, TokenProperty)
+}
@@ -0,0 +1,257 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Errors returned by Verifier.Verify.
+var (
+	ErrMalformed        = errors.New("malformed token")
+	ErrUnsupportedAlg   = errors.New("unsupported signing algorithm")
+	ErrInvalidSignature = errors.New("invalid token signature")
+	ErrExpired          = errors.New("token is expired")
+	ErrNotValidYet      = errors.New("token is not valid yet")
+	ErrInvalidIssuer    = errors.New("invalid token issuer")
+	ErrInvalidAudience  = errors.New("invalid token audience")
+)
+
+// Claims is the payload of a verified token.
+type Claims map[string]interface{}
+
+// String returns the claim value as a string. Numbers are formatted in decimal.
+func (c Claims) String(name string) string {
+	switch v := c[name].(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// time returns a NumericDate claim, the second value reports whether it exists.
+func (c Claims) time(name string) (time.Time, bool, error) {
+	v, ok := c[name]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	n, ok := v.(json.Number)
+	if !ok {
+		return time.Time{}, false, ErrMalformed
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false, ErrMalformed
+	}
+	return time.Unix(0, int64(f*float64(time.Second))), true, nil
+}
+
+func (c Claims) hasAudience(aud string) bool {
+	switch v := c["aud"].(type) {
+	case string:
+		return v == aud
+	case []interface{}:
+		for _, a := range v {
+			if s, ok := a.(string); ok && s == aud {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type key struct {
+	id  string
+	key interface{}
+}
+
+// Verifier verifies JWT tokens signed by HMAC, RSA or ECDSA with static keys.
+type Verifier struct {
+	keys []key
+	// Leeway is the allowed clock skew when checking the exp and nbf claims.
+	Leeway time.Duration
+	// Issuer is checked against the iss claim if not empty.
+	Issuer string
+	// Audience is checked against the aud claim if not empty.
+	Audience string
+	now      func() time.Time
+}
+
+func newVerifier() *Verifier {
+	return &Verifier{now: time.Now}
+}
+
+// NewHMAC creates a Verifier of tokens signed by HS256, HS384 or HS512 with the secret.
+func NewHMAC(secret []byte) *Verifier {
+	v := newVerifier()
+	v.keys = append(v.keys, key{key: secret})
+	return v
+}
+
+// NewPublicKey creates a Verifier of tokens signed by RSA or ECDSA.
+// The key must be a *rsa.PublicKey or *ecdsa.PublicKey.
+func NewPublicKey(pub crypto.PublicKey) (*Verifier, error) {
+	switch pub.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", pub)
+	}
+	v := newVerifier()
+	v.keys = append(v.keys, key{key: pub})
+	return v, nil
+}
+
+// Verify checks the signature and the time claims of a compact serialized token,
+// and returns its claims.
+func (v *Verifier) Verify(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	if err = v.verifySignature(h, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+	var claims Claims
+	if err = decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	return claims, v.validate(claims)
+}
+
+func (v *Verifier) verifySignature(h header, signed, sig []byte) error {
+	if len(h.Alg) != 5 {
+		return ErrUnsupportedAlg
+	}
+	var hash crypto.Hash
+	switch h.Alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return ErrUnsupportedAlg
+	}
+	family := h.Alg[:2]
+	if family != "HS" && family != "RS" && family != "PS" && family != "ES" {
+		return ErrUnsupportedAlg
+	}
+	for _, k := range v.keys {
+		if h.Kid != "" && k.id != "" && h.Kid != k.id {
+			continue
+		}
+		if verifyWithKey(family, hash, k.key, signed, sig) {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
+
+// verifyWithKey verifies the signature only if the key type matches the
+// algorithm family, so that a public key can never be used as a HMAC secret.
+func verifyWithKey(family string, hash crypto.Hash, k interface{}, signed, sig []byte) bool {
+	switch k := k.(type) {
+	case []byte:
+		if family != "HS" {
+			return false
+		}
+		mac := hmac.New(hash.New, k)
+		mac.Write(signed)
+		return hmac.Equal(sig, mac.Sum(nil))
+	case *rsa.PublicKey:
+		h := hash.New()
+		h.Write(signed)
+		switch family {
+		case "RS":
+			return rsa.VerifyPKCS1v15(k, hash, h.Sum(nil), sig) == nil
+		case "PS":
+			return rsa.VerifyPSS(k, hash, h.Sum(nil), sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if family != "ES" || len(sig) != 2*size || k.Curve.Params().BitSize != curveBits(hash) {
+			return false
+		}
+		h := hash.New()
+		h.Write(signed)
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(k, h.Sum(nil), r, s)
+	}
+	return false
+}
+
+// curveBits returns the curve size of the ES algorithm using the hash.
+func curveBits(hash crypto.Hash) int {
+	switch hash {
+	case crypto.SHA256:
+		return 256
+	case crypto.SHA384:
+		return 384
+	default:
+		return 521
+	}
+}
+
+func (v *Verifier) validate(claims Claims) error {
+	now := v.now()
+	if exp, ok, err := claims.time("exp"); err != nil {
+		return err
+	} else if ok && !now.Before(exp.Add(v.Leeway)) {
+		return ErrExpired
+	}
+	if nbf, ok, err := claims.time("nbf"); err != nil {
+		return err
+	} else if ok && now.Add(v.Leeway).Before(nbf) {
+		return ErrNotValidYet
+	}
+	if v.Issuer != "" && claims.String("iss") != v.Issuer {
+		return ErrInvalidIssuer
+	}
+	if v.Audience != "" && !claims.hasAudience(v.Audience) {
+		return ErrInvalidAudience
+	}
+	return nil
+}
+
+func decodeSegment(seg string, obj interface{}) error {
+	raw, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return ErrMalformed
+	}
+	decoder := json.NewDecoder(strings.NewReader(string(raw)))
+	decoder.UseNumber()
+	if err = decoder.Decode(obj); err != nil {
+		return ErrMalformed
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func encodeSegment(t *testing.T, obj interface{}) string {
+	data, err := json.Marshal(obj)
+	require.NoError(t, err)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func signToken(t *testing.T, alg, kid string, claims map[string]interface{}, sign func([]byte) []byte) string {
+	signed := encodeSegment(t, map[string]string{"alg": alg, "typ": "JWT", "kid": kid}) + "." + encodeSegment(t, claims)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed)))
+}
+
+func hs256(secret []byte) func([]byte) []byte {
+	return func(b []byte) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(b)
+		return mac.Sum(nil)
+	}
+}
+
+func TestVerifyHMAC(t *testing.T) {
+	secret := []byte("secret")
+	v := NewHMAC(secret)
+	token := signToken(t, "HS256", "", map[string]interface{}{"sub": "john", "device": 7}, hs256(secret))
+	claims, err := v.Verify(token)
+	require.NoError(t, err)
+	assert.Equal(t, "john", claims.String("sub"))
+	assert.Equal(t, "7", claims.String("device"))
+
+	_, err = v.Verify(signToken(t, "HS256", "", map[string]interface{}{}, hs256([]byte("other"))))
+	assert.ErrorIs(t, err, ErrInvalidSignature)
+	_, err = v.Verify("a.b")
+	assert.ErrorIs(t, err, ErrMalformed)
+	_, err = v.Verify(signToken(t, "none", "", map[string]interface{}{}, hs256(secret)))
+	assert.ErrorIs(t, err, ErrUnsupportedAlg)
+}
+
+func TestVerifyClaims(t *testing.T) {
+	secret := []byte("secret")
+	v := NewHMAC(secret)
+	v.Issuer = "mqrr"
+	v.Audience = "devices"
+	now := time.Now().Unix()
+
+	_, err := v.Verify(signToken(t, "HS256", "", map[string]interface{}{"iss": "mqrr", "aud": []string{"devices"}, "exp": now + 60}, hs256(secret)))
+	assert.NoError(t, err)
+	_, err = v.Verify(signToken(t, "HS256", "", map[string]interface{}{"iss": "mqrr", "aud": "devices", "exp": now - 60}, hs256(secret)))
+	assert.ErrorIs(t, err, ErrExpired)
+	_, err = v.Verify(signToken(t, "HS256", "", map[string]interface{}{"iss": "mqrr", "aud": "devices", "nbf": now + 60}, hs256(secret)))
+	assert.ErrorIs(t, err, ErrNotValidYet)
+	_, err = v.Verify(signToken(t, "HS256", "", map[string]interface{}{"iss": "other", "aud": "devices"}, hs256(secret)))
+	assert.ErrorIs(t, err, ErrInvalidIssuer)
+	_, err = v.Verify(signToken(t, "HS256", "", map[string]interface{}{"iss": "mqrr", "aud": "users"}, hs256(secret)))
+	assert.ErrorIs(t, err, ErrInvalidAudience)
+
+	v.Leeway = 2 * time.Minute
+	_, err = v.Verify(signToken(t, "HS256", "", map[string]interface{}{"iss": "mqrr", "aud": "devices", "exp": now - 60}, hs256(secret)))
+	assert.NoError(t, err)
+}
+
+func TestVerifyPublicKey(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	v, err := NewPublicKey(&rsaKey.PublicKey)
+	require.NoError(t, err)
+	token := signToken(t, "RS256", "", map[string]interface{}{"sub": "john"}, func(b []byte) []byte {
+		h := sha256.Sum256(b)
+		sig, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, h[:])
+		require.NoError(t, err)
+		return sig
+	})
+	_, err = v.Verify(token)
+	assert.NoError(t, err)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	v, err = NewPublicKey(&ecKey.PublicKey)
+	require.NoError(t, err)
+	token = signToken(t, "ES256", "", map[string]interface{}{"sub": "john"}, func(b []byte) []byte {
+		h := sha256.Sum256(b)
+		r, s, err := ecdsa.Sign(rand.Reader, ecKey, h[:])
+		require.NoError(t, err)
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		return sig
+	})
+	_, err = v.Verify(token)
+	assert.NoError(t, err)
+
+	_, err = NewPublicKey("key")
+	assert.Error(t, err)
+}
+
+func TestNewJWKS(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	b64 := base64.RawURLEncoding.EncodeToString
+	jwks := map[string]interface{}{"keys": []map[string]string{
+		{"kty": "EC", "kid": "ec1", "crv": "P-256", "x": b64(ecKey.X.Bytes()), "y": b64(ecKey.Y.Bytes())},
+		{"kty": "oct", "kid": "hmac1", "k": b64([]byte("secret"))},
+	}}
+	data, err := json.Marshal(jwks)
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, os.WriteFile(path, data, 0600))
+
+	v, err := NewJWKS(path)
+	require.NoError(t, err)
+	_, err = v.Verify(signToken(t, "HS256", "hmac1", map[string]interface{}{}, hs256([]byte("secret"))))
+	assert.NoError(t, err)
+	_, err = v.Verify(signToken(t, "HS256", "ec1", map[string]interface{}{}, hs256([]byte("secret"))))
+	assert.ErrorIs(t, err, ErrInvalidSignature)
+}
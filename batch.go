@@ -0,0 +1,92 @@
+package mqrr
+
+import (
+	"github.com/eclipse/paho.golang/paho"
+	"path"
+	"strings"
+)
+
+// DefaultBatchTopic is the topic of the batch route used by the client.
+const DefaultBatchTopic = "batch"
+
+// BatchCall is a call of a batch envelope. The topic is relative to the BaseTopic.
+// The properties are added to the ones of the envelope, which take precedence.
+type BatchCall struct {
+	Topic      string            `json:"topic"`
+	Payload    []byte            `json:"payload,omitempty"`
+	Properties map[string]string `json:"properties,omitempty"`
+}
+
+// BatchRequest is the envelope of a batch. The calls run concurrently, up to
+// the BatchWorkers of the engine, or one after another if Sequential is set.
+type BatchRequest struct {
+	Calls      []BatchCall `json:"calls"`
+	Sequential bool        `json:"sequential,omitempty"`
+}
+
+// BatchResult is the response of a call of a batch.
+type BatchResult struct {
+	Status     int               `json:"status"`
+	Payload    []byte            `json:"payload,omitempty"`
+	Properties map[string]string `json:"properties,omitempty"`
+}
+
+// BatchResponse is the reply of a batch, with the results in the order of the calls.
+type BatchResponse struct {
+	Results []BatchResult `json:"results"`
+}
+
+// Batch registers a route on the topic carrying batch envelopes. Each call
+// of the envelope runs the route matching its topic, and the results are
+// replied at once. A call without a matching route gets status 404.
+func (engine *Engine) Batch(topic string, opts ...RouteOption) {
+	engine.Route(topic, engine.serveBatch, append(opts, envelope)...)
+}
+
+func (engine *Engine) serveBatch(c *Context) {
+	var req BatchRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.Status(StatusBadRequest)
+		c.String("%v", err)
+		return
+	}
+	if len(req.Calls) > engine.maxBatchSize() {
+		c.Status(StatusBadRequest)
+		c.String("too many calls, the limit is %d", engine.maxBatchSize())
+		return
+	}
+	results := make([]BatchResult, len(req.Calls))
+	if req.Sequential {
+		for i, call := range req.Calls {
+			results[i] = engine.callBatch(c, call)
+		}
+	} else {
+		engine.runBatch(len(req.Calls), func(i int) {
+			results[i] = engine.callBatch(c, req.Calls[i])
+		})
+	}
+	c.JSON(BatchResponse{Results: results})
+}
+
+// callBatch runs a call of the envelope.
+func (engine *Engine) callBatch(c *Context, call BatchCall) BatchResult {
+	var props paho.UserProperties
+	for k, v := range call.Properties {
+		props = props.Add(k, v)
+	}
+	var ic *Context
+	if call.Topic != "" && !strings.ContainsAny(call.Topic, "+#") {
+		ic = engine.dispatch(c, path.Join(engine.BaseTopic, call.Topic), call.Payload, props)
+	}
+	if ic == nil {
+		return BatchResult{Status: StatusNotFound}
+	}
+	result := BatchResult{Status: ic.status, Payload: ic.response}
+	if len(ic.properties) > 0 {
+		result.Properties = make(map[string]string, len(ic.properties))
+		for _, p := range ic.properties {
+			result.Properties[p.Key] = p.Value
+		}
+	}
+	return result
+}
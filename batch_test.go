@@ -0,0 +1,113 @@
+package mqrr
+
+import (
+	"encoding/json"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+)
+
+func TestBatch(t *testing.T) {
+	r := New()
+	r.AccessLogger = nil
+	r.BaseTopic = "app"
+	r.Batch(DefaultBatchTopic)
+	var mu sync.Mutex
+	var order []string
+	r.Route("sensor/:name", func(c *Context) {
+		mu.Lock()
+		order = append(order, c.Param("name"))
+		mu.Unlock()
+		c.SetProperty("unit", "C")
+		c.String("%s=%s %s", c.Param("name"), c.GetRawString(), c.Property("authorization"))
+	})
+	r.Route("fail", func(c *Context) { panic("boom") })
+
+	request := func(req BatchRequest) BatchResponse {
+		payload, err := json.Marshal(req)
+		require.NoError(t, err)
+		w := &testPublisher{}
+		require.True(t, r.ServeMQTT(w, &paho.Publish{Topic: "app/batch", Payload: payload, Properties: &paho.PublishProperties{
+			ResponseTopic:   "client/responses",
+			CorrelationData: []byte("1"),
+			User:            paho.UserProperties{}.Add("authorization", "token"),
+		}}))
+		require.Len(t, w.replies, 1)
+		assert.Equal(t, "200", w.replies[0].Properties.User.Get(StatusProperty))
+		var resp BatchResponse
+		require.NoError(t, json.Unmarshal(w.replies[0].Payload, &resp))
+		return resp
+	}
+
+	resp := request(BatchRequest{Calls: []BatchCall{
+		{Topic: "sensor/temp", Payload: []byte("1")},
+		{Topic: "none"},
+		{Topic: "fail"},
+		{Topic: "sensor/+"},
+		{Topic: "batch"},
+	}})
+	require.Len(t, resp.Results, 5)
+	assert.Equal(t, BatchResult{Status: StatusOK, Payload: []byte("temp=1 token"), Properties: map[string]string{"unit": "C"}}, resp.Results[0])
+	assert.Equal(t, StatusNotFound, resp.Results[1].Status)
+	assert.Equal(t, StatusInternalServerError, resp.Results[2].Status)
+	assert.Equal(t, StatusNotFound, resp.Results[3].Status)
+	assert.Equal(t, StatusNotFound, resp.Results[4].Status)
+
+	order = nil
+	calls := make([]BatchCall, 10)
+	for i := range calls {
+		calls[i] = BatchCall{Topic: "sensor/" + string(rune('a'+i)), Properties: map[string]string{"authorization": "own"}}
+	}
+	resp = request(BatchRequest{Calls: calls, Sequential: true})
+	require.Len(t, resp.Results, 10)
+	assert.Equal(t, []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"}, order)
+	// A call can not override the authorization of the envelope
+	assert.Equal(t, "a= token", string(resp.Results[0].Payload))
+
+	w := &testPublisher{}
+	r.ServeMQTT(w, &paho.Publish{Topic: "app/batch", Payload: []byte("{"), Properties: &paho.PublishProperties{ResponseTopic: "client/responses"}})
+	require.Len(t, w.replies, 1)
+	assert.Equal(t, "400", w.replies[0].Properties.User.Get(StatusProperty))
+}
+
+func TestBatchEnvelopes(t *testing.T) {
+	r := New()
+	r.AccessLogger = nil
+	r.MaxBatchSize = 2
+	r.Batch("batch/+")
+	r.JSONRPC("rpc")
+	r.Route("echo", func(c *Context) { c.Data(c.GetRawData()) })
+
+	request := func(topic string, payload []byte) *paho.Publish {
+		w := &testPublisher{}
+		require.True(t, r.ServeMQTT(w, &paho.Publish{Topic: topic, Payload: payload, Properties: &paho.PublishProperties{
+			ResponseTopic:   "client/responses",
+			CorrelationData: []byte("1"),
+		}}))
+		require.Len(t, w.replies, 1)
+		return w.replies[0]
+	}
+	batch := func(calls ...BatchCall) []BatchResult {
+		payload, err := json.Marshal(BatchRequest{Calls: calls})
+		require.NoError(t, err)
+		var resp BatchResponse
+		require.NoError(t, json.Unmarshal(request("batch/1", payload).Payload, &resp))
+		return resp.Results
+	}
+
+	// Envelopes can not nest, through any envelope route
+	inner, err := json.Marshal(BatchRequest{Calls: []BatchCall{{Topic: "echo"}}})
+	require.NoError(t, err)
+	results := batch(BatchCall{Topic: "batch/2", Payload: inner}, BatchCall{Topic: "rpc", Payload: []byte(`{"jsonrpc":"2.0","method":"echo","id":1}`)})
+	require.Len(t, results, 2)
+	assert.Equal(t, StatusNotFound, results[0].Status)
+	assert.Equal(t, StatusNotFound, results[1].Status)
+	resp := request("rpc", []byte(`{"jsonrpc":"2.0","method":"batch/2","params":{"calls":[]},"id":1}`))
+	assert.JSONEq(t, `{"jsonrpc":"2.0","error":{"code":-32601,"message":"Method not found"},"id":1}`, string(resp.Payload))
+
+	payload, err := json.Marshal(BatchRequest{Calls: make([]BatchCall, 3)})
+	require.NoError(t, err)
+	assert.Equal(t, "400", request("batch/1", payload).Properties.User.Get(StatusProperty))
+}
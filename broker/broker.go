@@ -0,0 +1,335 @@
+// Package broker implements a minimal MQTT v5 broker, meant for local
+// development and integration tests. It supports QoS 0, 1 and 2, response
+// topics, correlation data, user properties, retained messages, shared
+// subscriptions and wills. Sessions are never persisted, so a client always
+// starts with a clean session.
+package broker
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultMaxPacketSize is the default size limit of the packets received by the broker.
+const DefaultMaxPacketSize = 16 * 1024 * 1024
+
+// ErrClosed is returned by Serve after the broker is closed.
+var ErrClosed = errors.New("broker: closed")
+
+// Broker is an MQTT v5 broker. Create an instance by using New or Listen.
+type Broker struct {
+	// Auth authenticates the connecting clients when set.
+	Auth func(clientID, username string, password []byte) bool
+	// ResponseInfo returns the response information sent to the clients
+	// requesting it. No response information is sent when it is nil.
+	ResponseInfo func(clientID string) string
+	// MaxPacketSize limits the size of the packets received.
+	MaxPacketSize int
+
+	mu        sync.Mutex
+	listeners []net.Listener
+	conns     map[*conn]struct{}
+	clients   map[string]*conn
+	retained  map[string]*message
+	shared    map[string]int
+	nextID    int
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// New returns a new broker, which is started by Serve.
+func New() *Broker {
+	return &Broker{
+		MaxPacketSize: DefaultMaxPacketSize,
+		conns:         make(map[*conn]struct{}),
+		clients:       make(map[string]*conn),
+		retained:      make(map[string]*message),
+		shared:        make(map[string]int),
+	}
+}
+
+// Listen starts a new broker listening on the TCP address, e.g. `127.0.0.1:0`.
+func Listen(addr string) (*Broker, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	b := New()
+	go b.Serve(l)
+	return b, nil
+}
+
+// Serve accepts connections on the listener until the broker is closed.
+func (b *Broker) Serve(l net.Listener) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		l.Close()
+		return ErrClosed
+	}
+	b.listeners = append(b.listeners, l)
+	b.mu.Unlock()
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			if b.closed {
+				return ErrClosed
+			}
+			return err
+		}
+		c := newConn(b, nc)
+		b.mu.Lock()
+		if b.closed {
+			b.mu.Unlock()
+			nc.Close()
+			return ErrClosed
+		}
+		b.conns[c] = struct{}{}
+		b.wg.Add(1)
+		b.mu.Unlock()
+		go func() {
+			defer b.wg.Done()
+			c.serve()
+		}()
+	}
+}
+
+// Addr returns the address of the first listener, or nil if the broker is not serving.
+func (b *Broker) Addr() net.Addr {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.listeners) == 0 {
+		return nil
+	}
+	return b.listeners[0].Addr()
+}
+
+// URL returns the broker url of the first listener, e.g. `mqtt://127.0.0.1:1883`.
+func (b *Broker) URL() string {
+	if addr := b.Addr(); addr != nil {
+		return "mqtt://" + addr.String()
+	}
+	return ""
+}
+
+// DropClients closes the network connections of all the clients without
+// a DISCONNECT packet, as a network failure does. It is used to test reconnection.
+func (b *Broker) DropClients() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.conns {
+		c.nc.Close()
+	}
+}
+
+// Close stops the listeners and disconnects all the clients.
+func (b *Broker) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	var err error
+	for _, l := range b.listeners {
+		if e := l.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	for c := range b.conns {
+		c.disconnect(codeServerShuttingDown)
+	}
+	b.mu.Unlock()
+	b.wg.Wait()
+	return err
+}
+
+// register makes the connection the owner of its client id. A previous
+// connection with the same client id is taken over.
+func (b *Broker) register(c *conn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c.id == "" {
+		b.nextID++
+		c.id = "auto-" + strconv.Itoa(b.nextID)
+		c.assignedID = true
+	}
+	if old, ok := b.clients[c.id]; ok {
+		old.disconnect(codeSessionTakenOver)
+	}
+	b.clients[c.id] = c
+}
+
+// unregister removes the connection and its subscriptions.
+func (b *Broker) unregister(c *conn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.conns, c)
+	if b.clients[c.id] == c {
+		delete(b.clients, c.id)
+	}
+}
+
+// subscribe adds the subscription of the connection, and returns the
+// retained messages to be sent.
+func (b *Broker) subscribe(c *conn, sub subscription) []*message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, exists := c.subs[sub.filter]
+	c.subs[sub.filter] = sub
+	group, filter := splitShared(sub.filter)
+	if group != "" || sub.retainHandling == 2 || (sub.retainHandling == 1 && exists) {
+		return nil
+	}
+	var msgs []*message
+	for topic, m := range b.retained {
+		if match(filter, topic) {
+			msgs = append(msgs, m)
+		}
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].topic < msgs[j].topic })
+	return msgs
+}
+
+// unsubscribe removes the subscription of the connection, and reports
+// whether it existed.
+func (b *Broker) unsubscribe(c *conn, filter string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := c.subs[filter]
+	delete(c.subs, filter)
+	return ok
+}
+
+// delivery is a message to be sent to a connection.
+type delivery struct {
+	conn   *conn
+	qos    byte
+	retain bool
+	ids    []uint32
+}
+
+func (d *delivery) add(sub subscription, retain bool) {
+	if sub.qos > d.qos {
+		d.qos = sub.qos
+	}
+	d.retain = d.retain || (retain && sub.retainAsPublished)
+	if sub.id > 0 {
+		d.ids = append(d.ids, sub.id)
+	}
+}
+
+// publish routes the message to the matching subscriptions. A shared
+// subscription group receives the message once, by one of its members in turn.
+func (b *Broker) publish(from *conn, m *message) {
+	b.mu.Lock()
+	if m.retain {
+		if len(m.payload) == 0 {
+			delete(b.retained, m.topic)
+		} else {
+			b.retained[m.topic] = m
+		}
+	}
+	deliveries := make(map[*conn]*delivery)
+	deliver := func(c *conn, sub subscription) {
+		d, ok := deliveries[c]
+		if !ok {
+			d = &delivery{conn: c}
+			deliveries[c] = d
+		}
+		d.add(sub, m.retain)
+	}
+	type member struct {
+		conn *conn
+		sub  subscription
+	}
+	groups := make(map[string][]member)
+	for _, c := range b.clients {
+		for _, sub := range c.subs {
+			group, filter := splitShared(sub.filter)
+			if !match(filter, m.topic) {
+				continue
+			}
+			if group != "" {
+				key := group + "/" + filter
+				groups[key] = append(groups[key], member{c, sub})
+			} else if !sub.noLocal || c != from {
+				deliver(c, sub)
+			}
+		}
+	}
+	for key, members := range groups {
+		sort.Slice(members, func(i, j int) bool { return members[i].conn.id < members[j].conn.id })
+		next := b.shared[key]
+		b.shared[key] = next + 1
+		deliver(members[next%len(members)].conn, members[next%len(members)].sub)
+	}
+	b.mu.Unlock()
+	for _, d := range deliveries {
+		d.conn.send(m, d.qos, d.retain, d.ids)
+	}
+}
+
+// splitShared splits a shared subscription filter `$share/group/filter`
+// into the group and filter. The group is empty for other filters.
+func splitShared(filter string) (string, string) {
+	if !strings.HasPrefix(filter, "$share/") {
+		return "", filter
+	}
+	parts := strings.SplitN(filter, "/", 3)
+	if len(parts) != 3 {
+		return "", ""
+	}
+	return parts[1], parts[2]
+}
+
+// validFilter reports whether the topic filter is valid.
+func validFilter(filter string) bool {
+	group, filter := splitShared(filter)
+	if strings.HasPrefix(filter, "$share") || strings.ContainsAny(group, "+#") {
+		return false
+	}
+	if filter == "" {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if len(level) > 1 && strings.ContainsAny(level, "+#") {
+			return false
+		}
+		if level == "#" && i != len(levels)-1 {
+			return false
+		}
+	}
+	return true
+}
+
+// validTopic reports whether the topic name is valid to publish.
+func validTopic(topic string) bool {
+	return topic != "" && !strings.ContainsAny(topic, "+#")
+}
+
+// match reports whether the topic matches the filter. Wildcards at
+// the first level never match topics starting with `$`.
+func match(filter, topic string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+		if i >= len(t) || (level != "+" && level != t[i]) {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
@@ -0,0 +1,344 @@
+package broker
+
+import (
+	"bufio"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+	"time"
+)
+
+type testClient struct {
+	t  *testing.T
+	nc net.Conn
+	r  *bufio.Reader
+}
+
+func startBroker(t *testing.T) *Broker {
+	b, err := Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return b.Addr() != nil }, time.Second, time.Millisecond)
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+func dial(t *testing.T, b *Broker, pkt *connect) (*testClient, byte, properties) {
+	nc, err := net.Dial("tcp", b.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { nc.Close() })
+	c := &testClient{t: t, nc: nc, r: bufio.NewReader(nc)}
+	c.send(pkt.encode())
+	header, body := c.read()
+	require.Equal(t, byte(typeConnack), header>>4)
+	d := decoder{b: body}
+	d.byte()
+	code := d.byte()
+	props := d.properties()
+	require.NoError(t, d.err)
+	return c, code, props
+}
+
+func connectClient(t *testing.T, b *Broker, id string) *testClient {
+	c, code, _ := dial(t, b, &connect{clientID: id, cleanStart: true})
+	require.Equal(t, byte(codeSuccess), code)
+	return c
+}
+
+func (c *testClient) send(data []byte) {
+	_, err := c.nc.Write(data)
+	require.NoError(c.t, err)
+}
+
+func (c *testClient) read() (byte, []byte) {
+	c.nc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	header, body, err := readPacket(c.r, 0)
+	require.NoError(c.t, err)
+	return header, body
+}
+
+func (c *testClient) expectPublish() *publish {
+	header, body := c.read()
+	require.Equal(c.t, byte(typePublish), header>>4)
+	p, err := decodePublish(header&0x0f, body)
+	require.NoError(c.t, err)
+	return p
+}
+
+func (c *testClient) expectAck(typ byte, id uint16) {
+	header, body := c.read()
+	require.Equal(c.t, typ, header>>4)
+	ackID, code, err := decodeAck(body)
+	require.NoError(c.t, err)
+	assert.Equal(c.t, id, ackID)
+	assert.Equal(c.t, byte(codeSuccess), code)
+}
+
+func (c *testClient) expectNone() {
+	c.nc.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, _, err := readPacket(c.r, 0)
+	e, ok := err.(net.Error)
+	require.True(c.t, ok && e.Timeout(), "unexpected packet: %v", err)
+}
+
+func (c *testClient) subscribe(subs ...subscription) []byte {
+	c.send((&subscribe{packetID: 1, subscriptions: subs}).encode())
+	header, body := c.read()
+	require.Equal(c.t, byte(typeSuback), header>>4)
+	_, codes, err := decodeSuback(body)
+	require.NoError(c.t, err)
+	return codes
+}
+
+func (c *testClient) publish(p *publish) {
+	c.send(p.encode())
+}
+
+func TestMatch(t *testing.T) {
+	assert.True(t, match("a/+/c", "a/b/c"))
+	assert.True(t, match("a/#", "a"))
+	assert.True(t, match("#", "a/b"))
+	assert.False(t, match("a/+", "a/b/c"))
+	assert.False(t, match("#", "$SYS/a"))
+	assert.False(t, match("+/a", "$SYS/a"))
+	assert.True(t, match("$SYS/#", "$SYS/a"))
+	assert.True(t, validFilter("$share/g/a/+"))
+	assert.False(t, validFilter("$share/g"))
+	assert.False(t, validFilter("a/#/b"))
+	assert.False(t, validFilter("a+"))
+}
+
+func TestCodecProperties(t *testing.T) {
+	props := properties{}.addString(propResponseTopic, "resp").
+		addVarint(propSubscriptionID, 300).
+		addUint32(propMessageExpiry, 60).
+		addByte(propPayloadFormat, 1)
+	props = append(props, property{propUserProperty, appendString(appendString(nil, "k"), "v")})
+	d := decoder{b: appendProperties(nil, props)}
+	assert.Equal(t, props, d.properties())
+	assert.NoError(t, d.err)
+	id, ok := props.varint(propSubscriptionID)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(300), id)
+	assert.Len(t, props.without(propSubscriptionID, propMessageExpiry), 3)
+
+	d = decoder{b: []byte{2, 0xff, 0}}
+	d.properties()
+	assert.Error(t, d.err)
+}
+
+func TestBrokerRequestResponse(t *testing.T) {
+	b := startBroker(t)
+	server := connectClient(t, b, "server")
+	requester := connectClient(t, b, "requester")
+	assert.Equal(t, []byte{0}, server.subscribe(subscription{filter: "svc/+"}))
+	assert.Equal(t, []byte{1}, requester.subscribe(subscription{filter: "requester/responses", qos: 1}))
+
+	user := appendString(appendString(nil, "lang"), "en")
+	requester.publish(&publish{message: message{
+		topic:   "svc/echo",
+		payload: []byte("hi"),
+		props: append(properties{}.addString(propResponseTopic, "requester/responses"),
+			property{propCorrelationData, appendString(nil, "1")},
+			property{propUserProperty, user}),
+	}})
+	req := server.expectPublish()
+	assert.Equal(t, "svc/echo", req.topic)
+	assert.Equal(t, []byte("hi"), req.payload)
+	respTopic, _ := req.props.get(propResponseTopic)
+	correl, _ := req.props.get(propCorrelationData)
+	userProp, _ := req.props.get(propUserProperty)
+	assert.Equal(t, user, userProp)
+
+	d := decoder{b: respTopic}
+	server.publish(&publish{message: message{
+		topic:   d.string(),
+		payload: []byte("hello"),
+		props:   properties{property{propCorrelationData, correl}},
+	}})
+	resp := requester.expectPublish()
+	assert.Equal(t, []byte("hello"), resp.payload)
+	v, _ := resp.props.get(propCorrelationData)
+	assert.Equal(t, appendString(nil, "1"), v)
+}
+
+func TestBrokerQoS(t *testing.T) {
+	b := startBroker(t)
+	sub := connectClient(t, b, "sub")
+	pub := connectClient(t, b, "pub")
+	assert.Equal(t, []byte{2}, sub.subscribe(subscription{filter: "q/#", qos: 2}))
+
+	pub.publish(&publish{message: message{topic: "q/0", payload: []byte("0")}})
+	assert.Equal(t, byte(0), sub.expectPublish().qos)
+
+	pub.publish(&publish{message: message{topic: "q/1", payload: []byte("1"), qos: 1}, packetID: 7})
+	pub.expectAck(typePuback, 7)
+	p := sub.expectPublish()
+	assert.Equal(t, byte(1), p.qos)
+	assert.NotZero(t, p.packetID)
+	sub.send(encodeAck(typePuback, p.packetID, codeSuccess))
+
+	// A retransmitted QoS 2 message is delivered once
+	q2 := &publish{message: message{topic: "q/2", payload: []byte("2"), qos: 2}, packetID: 8}
+	pub.publish(q2)
+	pub.expectAck(typePubrec, 8)
+	q2.dup = true
+	pub.publish(q2)
+	pub.expectAck(typePubrec, 8)
+	pub.send(encodeAck(typePubrel, 8, codeSuccess))
+	pub.expectAck(typePubcomp, 8)
+
+	p = sub.expectPublish()
+	assert.Equal(t, byte(2), p.qos)
+	sub.send(encodeAck(typePubrec, p.packetID, codeSuccess))
+	sub.expectAck(typePubrel, p.packetID)
+	sub.send(encodeAck(typePubcomp, p.packetID, codeSuccess))
+	sub.expectNone()
+}
+
+func TestBrokerRetained(t *testing.T) {
+	b := startBroker(t)
+	pub := connectClient(t, b, "pub")
+	pub.publish(&publish{message: message{topic: "cfg/a", payload: []byte("a"), retain: true}})
+	pub.publish(&publish{message: message{topic: "cfg/b", payload: []byte("b"), retain: true}})
+	pub.publish(&publish{message: message{topic: "cfg/b", retain: true}})
+
+	sub := connectClient(t, b, "sub")
+	sub.subscribe(subscription{filter: "cfg/+"})
+	p := sub.expectPublish()
+	assert.Equal(t, "cfg/a", p.topic)
+	assert.True(t, p.retain)
+	sub.expectNone()
+
+	// Retain Handling 2 sends no retained messages
+	other := connectClient(t, b, "other")
+	other.subscribe(subscription{filter: "cfg/+", retainHandling: 2})
+	other.expectNone()
+
+	// The retain flag is cleared on forwarding unless Retain As Published is set
+	sub.subscribe(subscription{filter: "cfg/#", retainHandling: 2, retainAsPublished: true})
+	pub.publish(&publish{message: message{topic: "cfg/c", payload: []byte("c"), retain: true}})
+	assert.True(t, sub.expectPublish().retain)
+	assert.False(t, other.expectPublish().retain)
+}
+
+func TestBrokerSharedSubscription(t *testing.T) {
+	b := startBroker(t)
+	w1 := connectClient(t, b, "w1")
+	w2 := connectClient(t, b, "w2")
+	all := connectClient(t, b, "all")
+	w1.subscribe(subscription{filter: "$share/g/jobs/+"})
+	w2.subscribe(subscription{filter: "$share/g/jobs/+"})
+	all.subscribe(subscription{filter: "jobs/+"})
+
+	pub := connectClient(t, b, "pub")
+	for i := 0; i < 4; i++ {
+		pub.publish(&publish{message: message{topic: "jobs/1", payload: []byte{byte(i)}}})
+	}
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, []byte{byte(i)}, all.expectPublish().payload)
+	}
+	assert.Equal(t, []byte{0}, w1.expectPublish().payload)
+	assert.Equal(t, []byte{2}, w1.expectPublish().payload)
+	assert.Equal(t, []byte{1}, w2.expectPublish().payload)
+	assert.Equal(t, []byte{3}, w2.expectPublish().payload)
+	w1.expectNone()
+	w2.expectNone()
+}
+
+func TestBrokerSubscriptionOptions(t *testing.T) {
+	b := startBroker(t)
+	c := connectClient(t, b, "c")
+	assert.Equal(t, []byte{codeTopicFilterInvalid, codeProtocolError}, c.subscribe(
+		subscription{filter: "a/#/b"},
+		subscription{filter: "$share/g/a", noLocal: true},
+	))
+	c.send((&subscribe{packetID: 2, subscriptions: []subscription{{filter: "a/+", noLocal: true}}, props: properties{}.addVarint(propSubscriptionID, 5)}).encode())
+	c.read()
+	c.subscribe(subscription{filter: "a/b"})
+
+	c.publish(&publish{message: message{topic: "a/b", payload: []byte("x")}})
+	p := c.expectPublish()
+	id, _ := p.props.varint(propSubscriptionID)
+	assert.Zero(t, id)
+	c.expectNone()
+
+	other := connectClient(t, b, "other")
+	other.publish(&publish{message: message{topic: "a/b", payload: []byte("y")}})
+	p = c.expectPublish()
+	id, _ = p.props.varint(propSubscriptionID)
+	assert.Equal(t, uint32(5), id)
+
+	c.send((&unsubscribe{packetID: 3, filters: []string{"a/b", "none"}}).encode())
+	header, body := c.read()
+	require.Equal(t, byte(typeUnsuback), header>>4)
+	_, codes, _ := decodeSuback(body)
+	assert.Equal(t, []byte{0, codeNoSubscriptionExisted}, codes)
+}
+
+func TestBrokerWill(t *testing.T) {
+	b := startBroker(t)
+	sub := connectClient(t, b, "sub")
+	sub.subscribe(subscription{filter: "status/+"})
+
+	will := &message{topic: "status/a", payload: []byte("offline")}
+	a, _, _ := dial(t, b, &connect{clientID: "a", will: will})
+	a.nc.Close()
+	assert.Equal(t, []byte("offline"), sub.expectPublish().payload)
+
+	c, _, _ := dial(t, b, &connect{clientID: "c", will: &message{topic: "status/c", payload: []byte("offline")}})
+	c.send(encodeDisconnect(codeSuccess))
+	sub.expectNone()
+}
+
+func TestBrokerConnect(t *testing.T) {
+	b := startBroker(t)
+	b.Auth = func(clientID, username string, password []byte) bool {
+		return username == "user" && string(password) == "pass"
+	}
+	b.ResponseInfo = func(clientID string) string {
+		return "resp/" + clientID + "/"
+	}
+	_, code, _ := dial(t, b, &connect{username: "user", password: []byte("bad")})
+	assert.Equal(t, byte(codeBadUsernameOrPassword), code)
+
+	_, code, props := dial(t, b, &connect{username: "user", password: []byte("pass"),
+		props: properties{}.addByte(propRequestResponseInfo, 1)})
+	assert.Equal(t, byte(codeSuccess), code)
+	v, _ := props.get(propAssignedClientID)
+	id := (&decoder{b: v}).string()
+	assert.NotEmpty(t, id)
+	v, _ = props.get(propResponseInfo)
+	assert.Equal(t, "resp/"+id+"/", (&decoder{b: v}).string())
+
+	// A second connection with the same client id takes over the session
+	first, _, _ := dial(t, b, &connect{clientID: "same", username: "user", password: []byte("pass")})
+	dial(t, b, &connect{clientID: "same", username: "user", password: []byte("pass")})
+	header, body := first.read()
+	assert.Equal(t, byte(typeDisconnect), header>>4)
+	assert.Equal(t, byte(codeSessionTakenOver), decodeDisconnect(body))
+}
+
+func TestBrokerMaxPacketSize(t *testing.T) {
+	b := startBroker(t)
+	small, _, _ := dial(t, b, &connect{clientID: "small", props: properties{}.addUint32(propMaximumPacketSize, 64)})
+	small.subscribe(subscription{filter: "big"})
+	pub := connectClient(t, b, "pub")
+	pub.publish(&publish{message: message{topic: "big", payload: make([]byte, 100)}})
+	pub.publish(&publish{message: message{topic: "big", payload: make([]byte, 10)}})
+	assert.Len(t, small.expectPublish().payload, 10)
+}
+
+func TestBrokerDropClients(t *testing.T) {
+	b := startBroker(t)
+	c := connectClient(t, b, "c")
+	b.DropClients()
+	c.nc.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err := readPacket(c.r, 0)
+	assert.Error(t, err)
+	connectClient(t, b, "c")
+
+	require.NoError(t, b.Close())
+	_, err = net.Dial("tcp", b.Addr().String())
+	assert.Error(t, err)
+}
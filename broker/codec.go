@@ -0,0 +1,627 @@
+package broker
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Control packet types.
+const (
+	typeConnect     = 1
+	typeConnack     = 2
+	typePublish     = 3
+	typePuback      = 4
+	typePubrec      = 5
+	typePubrel      = 6
+	typePubcomp     = 7
+	typeSubscribe   = 8
+	typeSuback      = 9
+	typeUnsubscribe = 10
+	typeUnsuback    = 11
+	typePingreq     = 12
+	typePingresp    = 13
+	typeDisconnect  = 14
+)
+
+// Property identifiers.
+const (
+	propPayloadFormat        = 1
+	propMessageExpiry        = 2
+	propContentType          = 3
+	propResponseTopic        = 8
+	propCorrelationData      = 9
+	propSubscriptionID       = 11
+	propSessionExpiry        = 17
+	propAssignedClientID     = 18
+	propServerKeepAlive      = 19
+	propAuthMethod           = 21
+	propAuthData             = 22
+	propRequestProblemInfo   = 23
+	propWillDelay            = 24
+	propRequestResponseInfo  = 25
+	propResponseInfo         = 26
+	propServerReference      = 28
+	propReasonString         = 31
+	propReceiveMaximum       = 33
+	propTopicAliasMaximum    = 34
+	propTopicAlias           = 35
+	propMaximumQoS           = 36
+	propRetainAvailable      = 37
+	propUserProperty         = 38
+	propMaximumPacketSize    = 39
+	propWildcardSubAvailable = 40
+	propSubIDAvailable       = 41
+	propSharedSubAvailable   = 42
+)
+
+// Reason codes.
+const (
+	codeSuccess                 = 0x00
+	codeNoSubscriptionExisted   = 0x11
+	codeUnspecifiedError        = 0x80
+	codeMalformedPacket         = 0x81
+	codeProtocolError           = 0x82
+	codeUnsupportedVersion      = 0x84
+	codeBadUsernameOrPassword   = 0x86
+	codeSessionTakenOver        = 0x8E
+	codeTopicFilterInvalid      = 0x8F
+	codeTopicNameInvalid        = 0x90
+	codePacketIDNotFound        = 0x92
+	codePacketTooLarge          = 0x95
+	codeKeepAliveTimeout        = 0x8D
+	codeSharedSubNotSupported   = 0x9E
+	codeDisconnectWithWill      = 0x04
+	codeServerShuttingDown      = 0x8B
+	codeAdministrativeAction    = 0x98
+	codeQoSNotSupported         = 0x9B
+	codeSubIDsNotSupported      = 0xA1
+	codeWildcardSubNotSupported = 0xA2
+)
+
+var errMalformed = errors.New("broker: malformed packet")
+
+// property is a property with its value kept in the wire format,
+// so that it is forwarded without decoding.
+type property struct {
+	id    byte
+	value []byte
+}
+
+type properties []property
+
+// get returns the raw value of the first property with the id.
+func (p properties) get(id byte) ([]byte, bool) {
+	for _, prop := range p {
+		if prop.id == id {
+			return prop.value, true
+		}
+	}
+	return nil, false
+}
+
+// without returns the properties except the ones with the given ids.
+func (p properties) without(ids ...byte) properties {
+	out := make(properties, 0, len(p))
+	for _, prop := range p {
+		if bytes.IndexByte(ids, prop.id) < 0 {
+			out = append(out, prop)
+		}
+	}
+	return out
+}
+
+func (p properties) byte(id byte) (byte, bool) {
+	if v, ok := p.get(id); ok {
+		return v[0], true
+	}
+	return 0, false
+}
+
+func (p properties) uint16(id byte) (uint16, bool) {
+	if v, ok := p.get(id); ok {
+		return binary.BigEndian.Uint16(v), true
+	}
+	return 0, false
+}
+
+func (p properties) uint32(id byte) (uint32, bool) {
+	if v, ok := p.get(id); ok {
+		return binary.BigEndian.Uint32(v), true
+	}
+	return 0, false
+}
+
+func (p properties) varint(id byte) (uint32, bool) {
+	if v, ok := p.get(id); ok {
+		r := decoder{b: v}
+		return r.varint(), r.err == nil
+	}
+	return 0, false
+}
+
+// addByte, addUint16, addUint32, addVarint and addString append a property.
+func (p properties) addByte(id, v byte) properties {
+	return append(p, property{id, []byte{v}})
+}
+
+func (p properties) addUint16(id byte, v uint16) properties {
+	return append(p, property{id, appendUint16(nil, v)})
+}
+
+func (p properties) addUint32(id byte, v uint32) properties {
+	return append(p, property{id, appendUint32(nil, v)})
+}
+
+func (p properties) addVarint(id byte, v uint32) properties {
+	return append(p, property{id, appendVarint(nil, v)})
+}
+
+func (p properties) addString(id byte, v string) properties {
+	return append(p, property{id, appendString(nil, v)})
+}
+
+// propertySize returns the size of the value of the property,
+// or -1 for a variable byte integer, or -2 for length prefixed values.
+func propertySize(id byte) int {
+	switch id {
+	case propPayloadFormat, propRequestProblemInfo, propRequestResponseInfo, propMaximumQoS,
+		propRetainAvailable, propWildcardSubAvailable, propSubIDAvailable, propSharedSubAvailable:
+		return 1
+	case propServerKeepAlive, propReceiveMaximum, propTopicAliasMaximum, propTopicAlias:
+		return 2
+	case propMessageExpiry, propSessionExpiry, propWillDelay, propMaximumPacketSize:
+		return 4
+	case propSubscriptionID:
+		return -1
+	case propContentType, propResponseTopic, propAssignedClientID, propAuthMethod,
+		propResponseInfo, propServerReference, propReasonString, propCorrelationData, propAuthData:
+		return -2
+	case propUserProperty:
+		return -3
+	}
+	return 0
+}
+
+// decoder reads the fields of a packet body. The first error is kept,
+// and every following read returns a zero value.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil || n < 0 || len(d.b) < n {
+		d.err = errMalformed
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) byte() byte {
+	if v := d.next(1); v != nil {
+		return v[0]
+	}
+	return 0
+}
+
+func (d *decoder) uint16() uint16 {
+	if v := d.next(2); v != nil {
+		return binary.BigEndian.Uint16(v)
+	}
+	return 0
+}
+
+func (d *decoder) varint() uint32 {
+	var v uint32
+	for i := 0; i < 4; i++ {
+		b := d.byte()
+		if d.err != nil {
+			return 0
+		}
+		v |= uint32(b&0x7f) << (7 * i)
+		if b&0x80 == 0 {
+			return v
+		}
+	}
+	d.err = errMalformed
+	return 0
+}
+
+func (d *decoder) binary() []byte {
+	n := d.uint16()
+	return append([]byte{}, d.next(int(n))...)
+}
+
+func (d *decoder) string() string {
+	return string(d.binary())
+}
+
+func (d *decoder) properties() properties {
+	n := d.varint()
+	r := decoder{b: d.next(int(n))}
+	if d.err != nil {
+		return nil
+	}
+	var props properties
+	for len(r.b) > 0 && r.err == nil {
+		id := r.byte()
+		start := r.b
+		switch size := propertySize(id); size {
+		case 0:
+			r.err = errMalformed
+		case -1:
+			r.varint()
+		case -2:
+			r.binary()
+		case -3:
+			r.binary()
+			r.binary()
+		default:
+			r.next(size)
+		}
+		if r.err == nil {
+			props = append(props, property{id, append([]byte{}, start[:len(start)-len(r.b)]...)})
+		}
+	}
+	d.err = r.err
+	return props
+}
+
+func appendVarint(b []byte, v uint32) []byte {
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+		if v > 0 {
+			c |= 0x80
+		}
+		b = append(b, c)
+		if v == 0 {
+			return b
+		}
+	}
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendBinary(b []byte, v []byte) []byte {
+	b = appendUint16(b, uint16(len(v)))
+	return append(b, v...)
+}
+
+func appendString(b []byte, v string) []byte {
+	return appendBinary(b, []byte(v))
+}
+
+func appendProperties(b []byte, props properties) []byte {
+	var body []byte
+	for _, prop := range props {
+		body = append(body, prop.id)
+		body = append(body, prop.value...)
+	}
+	b = appendVarint(b, uint32(len(body)))
+	return append(b, body...)
+}
+
+// maxRemainingLength is the largest remaining length of the wire format.
+const maxRemainingLength = 268435455
+
+// readPacket reads a packet, returning the first byte of the fixed header and the body.
+func readPacket(r *bufio.Reader, maxSize int) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	var length uint32
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, nil, errMalformed
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length |= uint32(b&0x7f) << (7 * i)
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	if maxSize > 0 && int(length) > maxSize {
+		return 0, nil, errPacketTooLarge
+	}
+	body := make([]byte, length)
+	if _, err = io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+var errPacketTooLarge = errors.New("broker: packet too large")
+
+// encodePacket returns the packet with its fixed header.
+func encodePacket(header byte, body []byte) []byte {
+	b := appendVarint([]byte{header}, uint32(len(body)))
+	return append(b, body...)
+}
+
+// message is an application message.
+type message struct {
+	topic   string
+	payload []byte
+	qos     byte
+	retain  bool
+	props   properties
+}
+
+// publish is a PUBLISH packet.
+type publish struct {
+	message
+	dup      bool
+	packetID uint16
+}
+
+func decodePublish(flags byte, body []byte) (*publish, error) {
+	d := decoder{b: body}
+	p := &publish{dup: flags&0x08 != 0}
+	p.qos = (flags >> 1) & 0x03
+	p.retain = flags&0x01 != 0
+	p.topic = d.string()
+	if p.qos > 0 {
+		p.packetID = d.uint16()
+	}
+	p.props = d.properties()
+	if d.err != nil || p.qos > 2 {
+		return nil, errMalformed
+	}
+	p.payload = append([]byte{}, d.b...)
+	return p, nil
+}
+
+func (p *publish) encode() []byte {
+	header := byte(typePublish<<4) | p.qos<<1
+	if p.dup {
+		header |= 0x08
+	}
+	if p.retain {
+		header |= 0x01
+	}
+	b := appendString(nil, p.topic)
+	if p.qos > 0 {
+		b = appendUint16(b, p.packetID)
+	}
+	b = appendProperties(b, p.props)
+	return encodePacket(header, append(b, p.payload...))
+}
+
+// connect is a CONNECT packet.
+type connect struct {
+	protocol   string
+	version    byte
+	cleanStart bool
+	keepAlive  uint16
+	props      properties
+	clientID   string
+	will       *message
+	username   string
+	password   []byte
+}
+
+func decodeConnect(body []byte) (*connect, error) {
+	d := decoder{b: body}
+	c := &connect{}
+	c.protocol = d.string()
+	c.version = d.byte()
+	if d.err != nil || c.protocol != "MQTT" || c.version != 5 {
+		return c, errUnsupportedVersion
+	}
+	flags := d.byte()
+	c.cleanStart = flags&0x02 != 0
+	c.keepAlive = d.uint16()
+	c.props = d.properties()
+	c.clientID = d.string()
+	if flags&0x04 != 0 {
+		c.will = &message{qos: (flags >> 3) & 0x03, retain: flags&0x20 != 0}
+		c.will.props = d.properties()
+		c.will.topic = d.string()
+		c.will.payload = d.binary()
+	}
+	if flags&0x80 != 0 {
+		c.username = d.string()
+	}
+	if flags&0x40 != 0 {
+		c.password = d.binary()
+	}
+	if d.err != nil || flags&0x01 != 0 {
+		return nil, errMalformed
+	}
+	return c, nil
+}
+
+var errUnsupportedVersion = errors.New("broker: unsupported protocol version")
+
+func (c *connect) encode() []byte {
+	b := appendString(nil, "MQTT")
+	b = append(b, 5)
+	var flags byte
+	if c.cleanStart {
+		flags |= 0x02
+	}
+	if c.will != nil {
+		flags |= 0x04 | c.will.qos<<3
+		if c.will.retain {
+			flags |= 0x20
+		}
+	}
+	if c.password != nil {
+		flags |= 0x40
+	}
+	if c.username != "" {
+		flags |= 0x80
+	}
+	b = append(b, flags)
+	b = appendUint16(b, c.keepAlive)
+	b = appendProperties(b, c.props)
+	b = appendString(b, c.clientID)
+	if c.will != nil {
+		b = appendProperties(b, c.will.props)
+		b = appendString(b, c.will.topic)
+		b = appendBinary(b, c.will.payload)
+	}
+	if c.username != "" {
+		b = appendString(b, c.username)
+	}
+	if c.password != nil {
+		b = appendBinary(b, c.password)
+	}
+	return encodePacket(typeConnect<<4, b)
+}
+
+func encodeConnack(sessionPresent bool, code byte, props properties) []byte {
+	var flags byte
+	if sessionPresent {
+		flags = 0x01
+	}
+	return encodePacket(typeConnack<<4, appendProperties([]byte{flags, code}, props))
+}
+
+// encodeAck encodes PUBACK, PUBREC, PUBREL and PUBCOMP packets.
+func encodeAck(typ byte, packetID uint16, code byte) []byte {
+	header := typ << 4
+	if typ == typePubrel {
+		header |= 0x02
+	}
+	b := appendUint16(nil, packetID)
+	if code != codeSuccess {
+		b = append(b, code)
+	}
+	return encodePacket(header, b)
+}
+
+// decodeAck decodes PUBACK, PUBREC, PUBREL and PUBCOMP packets.
+func decodeAck(body []byte) (uint16, byte, error) {
+	d := decoder{b: body}
+	id := d.uint16()
+	code := byte(codeSuccess)
+	if len(d.b) > 0 {
+		code = d.byte()
+	}
+	return id, code, d.err
+}
+
+// subscription is a topic filter with its options.
+type subscription struct {
+	filter            string
+	qos               byte
+	noLocal           bool
+	retainAsPublished bool
+	retainHandling    byte
+	id                uint32
+}
+
+// subscribe is a SUBSCRIBE packet.
+type subscribe struct {
+	packetID      uint16
+	props         properties
+	subscriptions []subscription
+}
+
+func decodeSubscribe(body []byte) (*subscribe, error) {
+	d := decoder{b: body}
+	s := &subscribe{packetID: d.uint16()}
+	s.props = d.properties()
+	id, _ := s.props.varint(propSubscriptionID)
+	for len(d.b) > 0 && d.err == nil {
+		sub := subscription{filter: d.string(), id: id}
+		opts := d.byte()
+		sub.qos = opts & 0x03
+		sub.noLocal = opts&0x04 != 0
+		sub.retainAsPublished = opts&0x08 != 0
+		sub.retainHandling = (opts >> 4) & 0x03
+		s.subscriptions = append(s.subscriptions, sub)
+	}
+	if d.err != nil || len(s.subscriptions) == 0 {
+		return nil, errMalformed
+	}
+	return s, nil
+}
+
+func (s *subscribe) encode() []byte {
+	b := appendUint16(nil, s.packetID)
+	b = appendProperties(b, s.props)
+	for _, sub := range s.subscriptions {
+		b = appendString(b, sub.filter)
+		opts := sub.qos | sub.retainHandling<<4
+		if sub.noLocal {
+			opts |= 0x04
+		}
+		if sub.retainAsPublished {
+			opts |= 0x08
+		}
+		b = append(b, opts)
+	}
+	return encodePacket(typeSubscribe<<4|0x02, b)
+}
+
+// unsubscribe is an UNSUBSCRIBE packet.
+type unsubscribe struct {
+	packetID uint16
+	props    properties
+	filters  []string
+}
+
+func decodeUnsubscribe(body []byte) (*unsubscribe, error) {
+	d := decoder{b: body}
+	u := &unsubscribe{packetID: d.uint16()}
+	u.props = d.properties()
+	for len(d.b) > 0 && d.err == nil {
+		u.filters = append(u.filters, d.string())
+	}
+	if d.err != nil || len(u.filters) == 0 {
+		return nil, errMalformed
+	}
+	return u, nil
+}
+
+func (u *unsubscribe) encode() []byte {
+	b := appendUint16(nil, u.packetID)
+	b = appendProperties(b, u.props)
+	for _, filter := range u.filters {
+		b = appendString(b, filter)
+	}
+	return encodePacket(typeUnsubscribe<<4|0x02, b)
+}
+
+// encodeSuback encodes SUBACK and UNSUBACK packets.
+func encodeSuback(typ byte, packetID uint16, codes []byte) []byte {
+	b := appendUint16(nil, packetID)
+	b = appendProperties(b, nil)
+	return encodePacket(typ<<4, append(b, codes...))
+}
+
+func decodeSuback(body []byte) (uint16, []byte, error) {
+	d := decoder{b: body}
+	id := d.uint16()
+	d.properties()
+	return id, d.b, d.err
+}
+
+func encodeDisconnect(code byte) []byte {
+	return encodePacket(typeDisconnect<<4, []byte{code})
+}
+
+func decodeDisconnect(body []byte) byte {
+	if len(body) == 0 {
+		return codeSuccess
+	}
+	return body[0]
+}
@@ -0,0 +1,329 @@
+package broker
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+)
+
+// connectTimeout is how long the broker waits for the CONNECT packet.
+const connectTimeout = 10 * time.Second
+
+// writeTimeout is how long the broker waits for a packet to be written.
+const writeTimeout = 5 * time.Second
+
+// conn is a client connection.
+type conn struct {
+	b          *Broker
+	nc         net.Conn
+	r          *bufio.Reader
+	id         string
+	assignedID bool
+	keepAlive  time.Duration
+	// maxPacketSize is the size limit of the packets sent to the client.
+	maxPacketSize uint32
+	will          *message
+	// subs is guarded by the mutex of the broker.
+	subs map[string]subscription
+
+	wmu sync.Mutex
+
+	// mu guards the packet ids of the outgoing messages.
+	mu       sync.Mutex
+	nextID   uint16
+	inflight map[uint16]byte
+	// received holds the ids of the incoming QoS 2 messages, until PUBREL.
+	received map[uint16]bool
+}
+
+func newConn(b *Broker, nc net.Conn) *conn {
+	return &conn{
+		b:        b,
+		nc:       nc,
+		r:        bufio.NewReader(nc),
+		subs:     make(map[string]subscription),
+		inflight: make(map[uint16]byte),
+		received: make(map[uint16]bool),
+	}
+}
+
+// serve runs the session of the connection until it is closed.
+func (c *conn) serve() {
+	defer c.nc.Close()
+	if !c.connect() {
+		c.b.unregister(c)
+		return
+	}
+	graceful := c.loop()
+	c.b.unregister(c)
+	if !graceful && c.will != nil {
+		c.b.publish(c, c.will)
+	}
+}
+
+// connect handles the CONNECT packet, and reports whether the client is accepted.
+func (c *conn) connect() bool {
+	c.nc.SetReadDeadline(time.Now().Add(connectTimeout))
+	header, body, err := readPacket(c.r, c.b.MaxPacketSize)
+	if err != nil || header>>4 != typeConnect {
+		return false
+	}
+	pkt, err := decodeConnect(body)
+	if err == errUnsupportedVersion {
+		c.write(encodeConnack(false, codeUnsupportedVersion, nil))
+		return false
+	}
+	if err != nil {
+		c.write(encodeConnack(false, codeMalformedPacket, nil))
+		return false
+	}
+	if pkt.will != nil && (!validTopic(pkt.will.topic) || pkt.will.qos > 2) {
+		c.write(encodeConnack(false, codeMalformedPacket, nil))
+		return false
+	}
+	if c.b.Auth != nil && !c.b.Auth(pkt.clientID, pkt.username, pkt.password) {
+		c.write(encodeConnack(false, codeBadUsernameOrPassword, nil))
+		return false
+	}
+	c.id = pkt.clientID
+	c.will = pkt.will
+	c.keepAlive = time.Duration(pkt.keepAlive) * time.Second
+	c.maxPacketSize, _ = pkt.props.uint32(propMaximumPacketSize)
+	c.b.register(c)
+
+	var props properties
+	if c.assignedID {
+		props = props.addString(propAssignedClientID, c.id)
+	}
+	if requested, _ := pkt.props.byte(propRequestResponseInfo); requested == 1 && c.b.ResponseInfo != nil {
+		props = props.addString(propResponseInfo, c.b.ResponseInfo(c.id))
+	}
+	if c.b.MaxPacketSize > 0 {
+		props = props.addUint32(propMaximumPacketSize, uint32(c.b.MaxPacketSize))
+	}
+	return c.write(encodeConnack(false, codeSuccess, props)) == nil
+}
+
+// loop handles the packets until the connection is closed. It reports
+// whether the client disconnected without requesting its will.
+func (c *conn) loop() bool {
+	for {
+		if c.keepAlive > 0 {
+			c.nc.SetReadDeadline(time.Now().Add(c.keepAlive * 3 / 2))
+		} else {
+			c.nc.SetReadDeadline(time.Time{})
+		}
+		header, body, err := readPacket(c.r, c.b.MaxPacketSize)
+		if err != nil {
+			if err == errPacketTooLarge {
+				c.disconnect(codePacketTooLarge)
+			} else if e, ok := err.(net.Error); ok && e.Timeout() {
+				c.disconnect(codeKeepAliveTimeout)
+			}
+			return false
+		}
+		switch header >> 4 {
+		case typePublish:
+			err = c.handlePublish(header&0x0f, body)
+		case typePuback, typePubcomp:
+			id, _, e := decodeAck(body)
+			c.release(id)
+			err = e
+		case typePubrec:
+			id, code, e := decodeAck(body)
+			if code >= codeUnspecifiedError {
+				c.release(id)
+			} else {
+				err = c.write(encodeAck(typePubrel, id, codeSuccess))
+			}
+			if e != nil {
+				err = e
+			}
+		case typePubrel:
+			id, _, e := decodeAck(body)
+			code := byte(codeSuccess)
+			if !c.received[id] {
+				code = codePacketIDNotFound
+			}
+			delete(c.received, id)
+			err = c.write(encodeAck(typePubcomp, id, code))
+			if e != nil {
+				err = e
+			}
+		case typeSubscribe:
+			err = c.handleSubscribe(body)
+		case typeUnsubscribe:
+			err = c.handleUnsubscribe(body)
+		case typePingreq:
+			err = c.write(encodePacket(typePingresp<<4, nil))
+		case typeDisconnect:
+			return decodeDisconnect(body) != codeDisconnectWithWill
+		default:
+			c.disconnect(codeProtocolError)
+			return false
+		}
+		if err == errMalformed {
+			c.disconnect(codeMalformedPacket)
+			return false
+		}
+		if err != nil {
+			return false
+		}
+	}
+}
+
+func (c *conn) handlePublish(flags byte, body []byte) error {
+	p, err := decodePublish(flags, body)
+	if err != nil {
+		return err
+	}
+	if !validTopic(p.topic) {
+		c.disconnect(codeTopicNameInvalid)
+		return errMalformed
+	}
+	if _, ok := p.props.get(propTopicAlias); ok {
+		// The broker announces no Topic Alias Maximum, so aliases are not allowed.
+		c.disconnect(codeProtocolError)
+		return errMalformed
+	}
+	m := &p.message
+	switch p.qos {
+	case 0:
+		c.b.publish(c, m)
+	case 1:
+		c.b.publish(c, m)
+		return c.write(encodeAck(typePuback, p.packetID, codeSuccess))
+	case 2:
+		if !c.received[p.packetID] {
+			c.received[p.packetID] = true
+			c.b.publish(c, m)
+		}
+		return c.write(encodeAck(typePubrec, p.packetID, codeSuccess))
+	}
+	return nil
+}
+
+func (c *conn) handleSubscribe(body []byte) error {
+	s, err := decodeSubscribe(body)
+	if err != nil {
+		return err
+	}
+	codes := make([]byte, len(s.subscriptions))
+	var retained [][]*message
+	var subs []subscription
+	for i, sub := range s.subscriptions {
+		group, _ := splitShared(sub.filter)
+		switch {
+		case !validFilter(sub.filter):
+			codes[i] = codeTopicFilterInvalid
+		case sub.qos > 2:
+			codes[i] = codeQoSNotSupported
+		case group != "" && sub.noLocal:
+			codes[i] = codeProtocolError
+		default:
+			codes[i] = sub.qos
+			retained = append(retained, c.b.subscribe(c, sub))
+			subs = append(subs, sub)
+		}
+	}
+	if err = c.write(encodeSuback(typeSuback, s.packetID, codes)); err != nil {
+		return err
+	}
+	for i, msgs := range retained {
+		for _, m := range msgs {
+			var ids []uint32
+			if subs[i].id > 0 {
+				ids = []uint32{subs[i].id}
+			}
+			c.send(m, subs[i].qos, true, ids)
+		}
+	}
+	return nil
+}
+
+func (c *conn) handleUnsubscribe(body []byte) error {
+	u, err := decodeUnsubscribe(body)
+	if err != nil {
+		return err
+	}
+	codes := make([]byte, len(u.filters))
+	for i, filter := range u.filters {
+		if !c.b.unsubscribe(c, filter) {
+			codes[i] = codeNoSubscriptionExisted
+		}
+	}
+	return c.write(encodeSuback(typeUnsuback, u.packetID, codes))
+}
+
+// send delivers the message to the client with the granted QoS. The message
+// is discarded if it exceeds the Maximum Packet Size of the client.
+func (c *conn) send(m *message, qos byte, retain bool, ids []uint32) {
+	if m.qos < qos {
+		qos = m.qos
+	}
+	p := &publish{message: message{
+		topic:   m.topic,
+		payload: m.payload,
+		qos:     qos,
+		retain:  retain,
+		props:   m.props.without(propTopicAlias, propSubscriptionID),
+	}}
+	for _, id := range ids {
+		p.props = p.props.addVarint(propSubscriptionID, id)
+	}
+	if qos > 0 {
+		id, ok := c.acquire(qos)
+		if !ok {
+			return
+		}
+		p.packetID = id
+	}
+	data := p.encode()
+	if c.maxPacketSize > 0 && len(data) > int(c.maxPacketSize) {
+		c.release(p.packetID)
+		return
+	}
+	c.write(data)
+}
+
+// acquire returns a free packet id for an outgoing message.
+func (c *conn) acquire(qos byte) (uint16, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := 0; i < 0xffff; i++ {
+		c.nextID++
+		if c.nextID == 0 {
+			c.nextID = 1
+		}
+		if _, used := c.inflight[c.nextID]; !used {
+			c.inflight[c.nextID] = qos
+			return c.nextID, true
+		}
+	}
+	return 0, false
+}
+
+// release frees the packet id of an acknowledged message.
+func (c *conn) release(id uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.inflight, id)
+}
+
+func (c *conn) write(data []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.nc.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := c.nc.Write(data)
+	if err != nil {
+		c.nc.Close()
+	}
+	return err
+}
+
+// disconnect sends a DISCONNECT packet with the reason code, then closes the connection.
+func (c *conn) disconnect(code byte) {
+	c.write(encodeDisconnect(code))
+	c.nc.Close()
+}
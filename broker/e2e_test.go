@@ -0,0 +1,67 @@
+package broker
+
+import (
+	"context"
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/koho/mqrr"
+	"github.com/koho/mqrr/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func clientConfig(t *testing.T, b *Broker) autopaho.ClientConfig {
+	u, err := url.Parse(b.URL())
+	require.NoError(t, err)
+	return autopaho.ClientConfig{
+		BrokerUrls:        []*url.URL{u},
+		KeepAlive:         10,
+		ConnectRetryDelay: 100 * time.Millisecond,
+	}
+}
+
+func request(c *client.Client, topic, payload string) (*paho.Publish, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	return c.Request(ctx, &paho.Publish{Topic: topic, QoS: 1, Payload: []byte(payload)})
+}
+
+func TestEndToEnd(t *testing.T) {
+	b := startBroker(t)
+	b.ResponseInfo = func(clientID string) string {
+		return clientID + "/"
+	}
+	r := mqrr.New()
+	r.UseResponseInfo = true
+	r.ResponseTopics = []string{"+/+/responses"}
+	r.Route("echo/:name", func(c *mqrr.Context) {
+		c.SetProperty("name", c.Param("name"))
+		c.String(c.GetRawString())
+	})
+	go r.RunCfg(clientConfig(t, b))
+	defer r.Close(context.Background())
+
+	c, err := client.NewWithCfg(clientConfig(t, b))
+	require.NoError(t, err)
+	defer c.Close(context.Background())
+
+	var resp *paho.Publish
+	require.Eventually(t, func() bool {
+		resp, err = request(c, "echo/john", "hi")
+		return err == nil
+	}, 5*time.Second, 100*time.Millisecond)
+	assert.Equal(t, "hi", string(resp.Payload))
+	assert.Equal(t, "john", resp.Properties.User.Get("name"))
+	assert.Equal(t, mqrr.StatusOK, client.Status(resp))
+
+	// Both connections come back after a network failure
+	b.DropClients()
+	require.Eventually(t, func() bool {
+		resp, err = request(c, "echo/jane", "again")
+		return err == nil
+	}, 5*time.Second, 100*time.Millisecond)
+	assert.Equal(t, "again", string(resp.Payload))
+}
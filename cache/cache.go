@@ -0,0 +1,180 @@
+// Package cache provides a response caching middleware for routes which are
+// pure functions of the request topic and payload.
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/koho/mqrr"
+	"sync"
+	"time"
+)
+
+// StatusProperty is the user property key showing the cache status of a response.
+const StatusProperty = "cache-status"
+
+// Cache status values.
+const (
+	Hit  = "HIT"
+	Miss = "MISS"
+)
+
+type entry struct {
+	key         string
+	route       string
+	topic       string
+	payload     []byte
+	status      int
+	properties  paho.UserProperties
+	contentType string
+	expires     time.Time
+}
+
+// Cache is a LRU cache of route responses. It is safe for concurrent use,
+// and can be shared by multiple routes with different TTL.
+type Cache struct {
+	sync.Mutex
+	maxEntries int
+	maxBytes   int
+	size       int
+	ll         *list.List
+	items      map[string]*list.Element
+}
+
+// New creates a Cache holding at most maxEntries responses, whose payloads are
+// at most maxBytes in total. Zero means no limit. The least recently used
+// response is evicted when the limits are exceeded.
+func New(maxEntries, maxBytes int) *Cache {
+	return &Cache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		ll:         list.New(),
+		items:      make(map[string]*list.Element),
+	}
+}
+
+// Handler returns a middleware serving cached responses for ttl.
+// A hit is served without calling the pending handlers, with the status,
+// payload, user properties and content type of the cached response. Only
+// responses with the StatusOK status are cached.
+func (cache *Cache) Handler(ttl time.Duration) mqrr.HandlerFunc {
+	return func(c *mqrr.Context) {
+		key := cacheKey(c)
+		if e, ok := cache.get(key); ok {
+			c.Status(e.status)
+			c.Data(e.payload)
+			c.SetContentType(e.contentType)
+			c.SetProperty(StatusProperty, Hit)
+			for _, p := range e.properties {
+				c.SetProperty(p.Key, p.Value)
+			}
+			c.Abort()
+			return
+		}
+		c.SetProperty(StatusProperty, Miss)
+		c.Next()
+		if c.GetStatus() == mqrr.StatusOK && !c.IsAborted() {
+			var props paho.UserProperties
+			for _, p := range c.GetProperties() {
+				if p.Key != StatusProperty {
+					props = append(props, p)
+				}
+			}
+			cache.add(&entry{
+				key:         key,
+				route:       c.FullTopic(),
+				topic:       c.Request.Topic,
+				payload:     c.GetResponse(),
+				status:      c.GetStatus(),
+				properties:  props,
+				contentType: c.GetContentType(),
+				expires:     time.Now().Add(ttl),
+			})
+		}
+	}
+}
+
+// Invalidate removes the cached responses of the given request topic.
+func (cache *Cache) Invalidate(topic string) {
+	cache.removeIf(func(e *entry) bool { return e.topic == topic })
+}
+
+// InvalidateRoute removes the cached responses of the given route pattern, e.g. `device/:id/model`.
+func (cache *Cache) InvalidateRoute(route string) {
+	cache.removeIf(func(e *entry) bool { return e.route == route })
+}
+
+// Purge removes all the cached responses.
+func (cache *Cache) Purge() {
+	cache.Lock()
+	defer cache.Unlock()
+	cache.ll.Init()
+	cache.items = make(map[string]*list.Element)
+	cache.size = 0
+}
+
+// Len returns the number of cached responses.
+func (cache *Cache) Len() int {
+	cache.Lock()
+	defer cache.Unlock()
+	return cache.ll.Len()
+}
+
+func (cache *Cache) get(key string) (*entry, bool) {
+	cache.Lock()
+	defer cache.Unlock()
+	el, ok := cache.items[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*entry)
+	if !time.Now().Before(e.expires) {
+		cache.remove(el)
+		return nil, false
+	}
+	cache.ll.MoveToFront(el)
+	return e, true
+}
+
+func (cache *Cache) add(e *entry) {
+	cache.Lock()
+	defer cache.Unlock()
+	if cache.maxBytes > 0 && len(e.payload) > cache.maxBytes {
+		return
+	}
+	if el, ok := cache.items[e.key]; ok {
+		cache.remove(el)
+	}
+	cache.items[e.key] = cache.ll.PushFront(e)
+	cache.size += len(e.payload)
+	for (cache.maxEntries > 0 && cache.ll.Len() > cache.maxEntries) || (cache.maxBytes > 0 && cache.size > cache.maxBytes) {
+		cache.remove(cache.ll.Back())
+	}
+}
+
+func (cache *Cache) removeIf(f func(e *entry) bool) {
+	cache.Lock()
+	defer cache.Unlock()
+	for el := cache.ll.Front(); el != nil; {
+		next := el.Next()
+		if f(el.Value.(*entry)) {
+			cache.remove(el)
+		}
+		el = next
+	}
+}
+
+func (cache *Cache) remove(el *list.Element) {
+	e := cache.ll.Remove(el).(*entry)
+	delete(cache.items, e.key)
+	cache.size -= len(e.payload)
+}
+
+// cacheKey identifies a request by the route, topic and payload.
+// The topic contains the values of all the topic params.
+func cacheKey(c *mqrr.Context) string {
+	sum := sha256.Sum256(c.GetRawData())
+	return c.FullTopic() + "\n" + c.Request.Topic + "\n" + hex.EncodeToString(sum[:])
+}
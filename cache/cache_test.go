@@ -0,0 +1,109 @@
+package cache
+
+import (
+	"github.com/koho/mqrr"
+	"github.com/koho/mqrr/mqrrtest"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func newEntry(key, topic string, payload string, ttl time.Duration) *entry {
+	return &entry{key: key, route: "device/:id", topic: topic, payload: []byte(payload), expires: time.Now().Add(ttl)}
+}
+
+func TestCacheLRU(t *testing.T) {
+	c := New(2, 0)
+	c.add(newEntry("a", "device/1", "a", time.Minute))
+	c.add(newEntry("b", "device/2", "b", time.Minute))
+	_, ok := c.get("a")
+	assert.True(t, ok)
+	c.add(newEntry("c", "device/3", "c", time.Minute))
+	assert.Equal(t, 2, c.Len())
+	_, ok = c.get("b")
+	assert.False(t, ok)
+	_, ok = c.get("a")
+	assert.True(t, ok)
+}
+
+func TestCacheMaxBytes(t *testing.T) {
+	c := New(0, 4)
+	c.add(newEntry("a", "device/1", "aa", time.Minute))
+	c.add(newEntry("b", "device/2", "bb", time.Minute))
+	c.add(newEntry("c", "device/3", "cc", time.Minute))
+	assert.Equal(t, 2, c.Len())
+	c.add(newEntry("d", "device/4", "ddddd", time.Minute))
+	_, ok := c.get("d")
+	assert.False(t, ok)
+}
+
+func TestCacheExpire(t *testing.T) {
+	c := New(0, 0)
+	c.add(newEntry("a", "device/1", "a", -time.Second))
+	_, ok := c.get("a")
+	assert.False(t, ok)
+	assert.Equal(t, 0, c.Len())
+}
+
+func TestCacheInvalidate(t *testing.T) {
+	c := New(0, 0)
+	c.add(newEntry("a", "device/1", "a", time.Minute))
+	c.add(newEntry("b", "device/1", "b", time.Minute))
+	c.add(newEntry("c", "device/2", "c", time.Minute))
+	c.Invalidate("device/1")
+	assert.Equal(t, 1, c.Len())
+	c.InvalidateRoute("device/:id")
+	assert.Equal(t, 0, c.Len())
+	c.add(newEntry("a", "device/1", "a", time.Minute))
+	c.Purge()
+	assert.Equal(t, 0, c.Len())
+}
+
+func TestCacheHandler(t *testing.T) {
+	cache := New(0, 0)
+	r := mqrr.New()
+	r.AccessLogger = nil
+	calls := 0
+	r.Route("device/:id/model", func(c *mqrr.Context) {
+		calls++
+		if c.Param("id") == "0" {
+			c.Status(mqrr.StatusNotFound)
+			return
+		}
+		c.SetContentType("text/plain")
+		c.SetProperty("vendor", "acme")
+		c.String("model %s %d", c.Param("id"), calls)
+	}, mqrr.With(cache.Handler(time.Minute)))
+
+	rec := mqrrtest.Do(r, "device/1/model", nil)
+	assert.Equal(t, Miss, rec.Property(StatusProperty))
+	assert.Equal(t, "model 1 1", string(rec.Payload()))
+
+	// A hit skips the handler
+	rec = mqrrtest.Do(r, "device/1/model", nil)
+	assert.Equal(t, Hit, rec.Property(StatusProperty))
+	assert.Equal(t, mqrr.StatusOK, rec.Status())
+	assert.Equal(t, "model 1 1", string(rec.Payload()))
+	assert.Equal(t, 1, calls)
+	// A hit carries the properties and content type of the miss
+	assert.Equal(t, "acme", rec.Property("vendor"))
+	assert.Equal(t, "text/plain", rec.Result().Properties.ContentType)
+	assert.Len(t, rec.Result().Properties.User, 3)
+
+	// Another payload is another key
+	rec = mqrrtest.Do(r, "device/1/model", []byte("x"))
+	assert.Equal(t, Miss, rec.Property(StatusProperty))
+	assert.Equal(t, 2, calls)
+
+	// Failures are not cached
+	mqrrtest.Do(r, "device/0/model", nil)
+	rec = mqrrtest.Do(r, "device/0/model", nil)
+	assert.Equal(t, Miss, rec.Property(StatusProperty))
+	assert.Equal(t, mqrr.StatusNotFound, rec.Status())
+	assert.Equal(t, 4, calls)
+
+	cache.Invalidate("device/1/model")
+	rec = mqrrtest.Do(r, "device/1/model", nil)
+	assert.Equal(t, Miss, rec.Property(StatusProperty))
+	assert.Equal(t, "model 1 5", string(rec.Payload()))
+}
@@ -0,0 +1,123 @@
+package mqrr
+
+import (
+	"context"
+	"crypto/subtle"
+	"github.com/eclipse/paho.golang/paho"
+	"time"
+)
+
+// CancelProperty marks a cancel notice. A client publishes the notice to
+// the topic of a request it gave up on, with the same response topic,
+// correlation data and authorization. The engine cancels the context of
+// the running handler on every route matching the topic, and suppresses
+// their responses. The requests are tracked per route, so that the
+// overlapping routes do not replace each other.
+//
+// A notice is accepted only if it carries the same authorization property
+// as its request, so that only the sender of the request can cancel it.
+// Requests without authorization can be canceled by anyone knowing their
+// correlation data.
+const CancelProperty = "cancel"
+
+// cancelTTL is how long a notice arriving before its request is kept.
+const cancelTTL = time.Minute
+
+// maxPendingCancels is the maximum number of notices kept for requests
+// which have not arrived yet. Further notices are ignored.
+const maxPendingCancels = 10000
+
+// runningRequest is the cancellation state of a request in progress,
+// or a pending notice if cancel is nil.
+type runningRequest struct {
+	cancel   context.CancelFunc
+	canceled bool
+	owner    string
+	created  time.Time
+}
+
+func isCancelNotice(request *paho.Publish) bool {
+	return request.Properties != nil && request.Properties.User.Get(CancelProperty) == "true"
+}
+
+// requestOwner returns the authorization of the request, which a cancel notice must match.
+func requestOwner(request *paho.Publish) string {
+	if request.Properties == nil {
+		return ""
+	}
+	return request.Properties.User.Get(authorizationProperty)
+}
+
+func sameOwner(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// track registers a running request under the reply key of its route.
+// It returns nil if the request is already canceled by its owner.
+func (engine *Engine) track(key, owner string, cancel context.CancelFunc) *runningRequest {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+	if r, ok := engine.running[key]; ok && r.cancel == nil {
+		engine.pendingCancels--
+		delete(engine.running, key)
+		if sameOwner(r.owner, owner) {
+			return nil
+		}
+	}
+	r := &runningRequest{cancel: cancel, owner: owner, created: time.Now()}
+	engine.running[key] = r
+	return r
+}
+
+// untrack removes the running request, and reports whether it was canceled.
+func (engine *Engine) untrack(key string, r *runningRequest) bool {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+	if engine.running[key] == r {
+		delete(engine.running, key)
+	}
+	return r.canceled
+}
+
+// cancelRequest cancels the running request of the key if the owner matches.
+// A notice for a request which has not arrived yet is kept for cancelTTL,
+// so that the request is dropped on arrival.
+func (engine *Engine) cancelRequest(key, owner string) {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+	if r, ok := engine.running[key]; ok {
+		if r.cancel != nil && sameOwner(r.owner, owner) {
+			r.canceled = true
+			r.cancel()
+		}
+		return
+	}
+	if engine.pendingCancels >= maxPendingCancels {
+		engine.logger().Warnf("%13s | too many pending cancel notices", "canceled")
+		return
+	}
+	engine.running[key] = &runningRequest{canceled: true, owner: owner, created: time.Now()}
+	engine.pendingCancels++
+	if engine.cancelSweep == nil {
+		engine.cancelSweep = time.AfterFunc(cancelTTL, engine.sweepCancels)
+	}
+}
+
+// sweepCancels removes the expired pending notices. It runs on a timer
+// while there are pending notices.
+func (engine *Engine) sweepCancels() {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+	now := time.Now()
+	for k, r := range engine.running {
+		if r.cancel == nil && now.Sub(r.created) >= cancelTTL {
+			engine.pendingCancels--
+			delete(engine.running, k)
+		}
+	}
+	if engine.pendingCancels > 0 {
+		engine.cancelSweep.Reset(cancelTTL)
+	} else {
+		engine.cancelSweep = nil
+	}
+}
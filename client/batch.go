@@ -0,0 +1,89 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// DefaultBatchTopic is the topic of the batch route of the mqrr engine.
+const DefaultBatchTopic = "batch"
+
+// Call is a call of a batch.
+type Call struct {
+	Topic      string            `json:"topic"`
+	Payload    []byte            `json:"payload,omitempty"`
+	Properties map[string]string `json:"properties,omitempty"`
+}
+
+// Result is the response of a call of a batch.
+type Result struct {
+	Status     int               `json:"status"`
+	Payload    []byte            `json:"payload,omitempty"`
+	Properties map[string]string `json:"properties,omitempty"`
+}
+
+type batchRequest struct {
+	Calls      []Call `json:"calls"`
+	Sequential bool   `json:"sequential,omitempty"`
+}
+
+type batchResponse struct {
+	Results []Result `json:"results"`
+}
+
+// BatchOption configures a batch.
+type BatchOption func(r *batchRequest)
+
+// Sequential runs the calls of the batch one after another, instead of concurrently.
+func Sequential() BatchOption {
+	return func(r *batchRequest) {
+		r.Sequential = true
+	}
+}
+
+// WithBatchTopic sets the topic of the batch route, default is DefaultBatchTopic.
+func WithBatchTopic(topic string) Option {
+	return func(h *Handler) {
+		h.batchTopic = topic
+	}
+}
+
+// RequestBatch sends the calls in one request to the batch route, and
+// returns their results in the same order.
+func (h *Handler) RequestBatch(ctx context.Context, calls []Call, opts ...BatchOption) ([]Result, error) {
+	return requestBatch(ctx, h.Request, h.batchTopic, calls, opts)
+}
+
+// RequestBatch sends the calls in one request to the batch route, and
+// returns their results in the same order.
+func (client *Client) RequestBatch(ctx context.Context, calls []Call, opts ...BatchOption) ([]Result, error) {
+	return requestBatch(ctx, client.Request, client.handler.batchTopic, calls, opts)
+}
+
+func requestBatch(ctx context.Context, request requestFunc, topic string, calls []Call, opts []BatchOption) ([]Result, error) {
+	req := batchRequest{Calls: calls}
+	for _, opt := range opts {
+		opt(&req)
+	}
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := request(ctx, &paho.Publish{Topic: topic, Payload: payload})
+	if err != nil {
+		return nil, err
+	}
+	if status := Status(resp); status < 200 || status > 299 {
+		return nil, fmt.Errorf("client: batch failed with status %d: %s", status, resp.Payload)
+	}
+	var result batchResponse
+	if err = json.Unmarshal(resp.Payload, &result); err != nil {
+		return nil, err
+	}
+	if len(result.Results) != len(calls) {
+		return nil, fmt.Errorf("client: batch returned %d results for %d calls", len(result.Results), len(calls))
+	}
+	return result.Results, nil
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"github.com/eclipse/paho.golang/autopaho"
 	"github.com/eclipse/paho.golang/paho"
+	"github.com/koho/mqrr/transport"
 	"net/url"
 	"sync"
 )
@@ -12,14 +13,13 @@ import (
 // so that you can make continuous requests at the same time.
 type Client struct {
 	sync.Once
-	cm      *autopaho.ConnectionManager
+	t       transport.Transport
 	connUp  chan struct{}
 	handler *Handler
-	router  paho.Router
 }
 
 // New creates a default Client with the given broker url.
-func New(broker string) (*Client, error) {
+func New(broker string, opts ...Option) (*Client, error) {
 	brokerUrl, err := url.Parse(broker)
 	if err != nil {
 		return nil, err
@@ -28,11 +28,11 @@ func New(broker string) (*Client, error) {
 		BrokerUrls: []*url.URL{brokerUrl},
 		KeepAlive:  30,
 	}
-	return NewWithCfg(cc)
+	return NewWithCfg(cc, opts...)
 }
 
 // NewWithUser creates a new Client with auth user and password.
-func NewWithUser(broker, user, password string) (*Client, error) {
+func NewWithUser(broker, user, password string, opts ...Option) (*Client, error) {
 	brokerUrl, err := url.Parse(broker)
 	if err != nil {
 		return nil, err
@@ -42,27 +42,49 @@ func NewWithUser(broker, user, password string) (*Client, error) {
 		KeepAlive:  30,
 	}
 	cc.SetUsernamePassword(user, []byte(password))
-	return NewWithCfg(cc)
+	return NewWithCfg(cc, opts...)
 }
 
 // NewWithCfg creates a new Client with the given client config.
-func NewWithCfg(cc autopaho.ClientConfig) (*Client, error) {
+// The options are applied to the Handler making requests.
+func NewWithCfg(cc autopaho.ClientConfig, opts ...Option) (*Client, error) {
+	return NewWithTransport(transport.NewAutopaho(cc), opts...)
+}
+
+// NewWithTransport creates a new Client over the given transport, which
+// is connected by the Client if it is not connected yet. The transport can
+// be shared with an Engine, see mqrr.Engine.Start. Close disconnects it.
+// The Response Information is requested from the broker if the transport is
+// a transport.ConnectConfigurer, and the response topic is built from it.
+func NewWithTransport(t transport.Transport, opts ...Option) (*Client, error) {
 	client := &Client{
-		router: paho.NewSingleHandlerRouter(nil),
+		t:      t,
 		connUp: make(chan struct{}),
 	}
-	cc.OnConnectionUp = client.onConnectionUp
-	cc.ClientConfig.Router = client.router
-	var err error
-	client.cm, err = autopaho.NewConnection(context.Background(), cc)
-	if err != nil {
+	client.handler = NewHandlerTransport(t, opts...)
+	if c, ok := t.(transport.ConnectConfigurer); ok {
+		c.ConfigureConnect(requestResponseInfo)
+	}
+	t.OnConnectionUp(client.onConnectionUp)
+	if err := t.Connect(context.Background()); err != nil {
 		return nil, err
 	}
-	client.handler = NewHandler(client.cm, client.router)
 	return client, nil
 }
 
-func (client *Client) onConnectionUp(manager *autopaho.ConnectionManager, connack *paho.Connack) {
+// requestResponseInfo requests the Response Information from the broker.
+func requestResponseInfo(connect *paho.Connect) *paho.Connect {
+	if connect.Properties == nil {
+		connect.Properties = &paho.ConnectProperties{}
+	}
+	connect.Properties.RequestResponseInfo = true
+	return connect
+}
+
+func (client *Client) onConnectionUp(connack *paho.Connack) {
+	if connack != nil && connack.Properties != nil && connack.Properties.ResponseInfo != "" {
+		client.handler.useResponseInfo(connack.Properties.ResponseInfo)
+	}
 	if err := client.handler.Subscribe(context.Background()); err != nil {
 		return
 	}
@@ -83,7 +105,17 @@ func (client *Client) Request(ctx context.Context, pb *paho.Publish) (*paho.Publ
 	return client.handler.Request(ctx, pb)
 }
 
+// Notify sends a request which has no response to the MQTT broker.
+func (client *Client) Notify(ctx context.Context, pb *paho.Publish) error {
+	select {
+	case <-client.connUp:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return client.handler.Notify(ctx, pb)
+}
+
 // Close disconnects the Client and waits for the connection manager to exit.
 func (client *Client) Close(ctx context.Context) error {
-	return client.cm.Disconnect(ctx)
+	return client.t.Disconnect(ctx)
 }
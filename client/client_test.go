@@ -6,9 +6,11 @@ import (
 	"github.com/eclipse/paho.golang/autopaho"
 	"github.com/eclipse/paho.golang/paho"
 	"github.com/koho/mqrr"
+	"github.com/koho/mqrr/transport"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"net/url"
+	"reflect"
 	"sync"
 	"testing"
 	"time"
@@ -41,7 +43,7 @@ func defaultClientConfig(urls ...string) autopaho.ClientConfig {
 func TestNew(t *testing.T) {
 	c, err := New(broker)
 	require.NoError(t, err)
-	err = c.cm.AwaitConnection(context.Background())
+	err = c.t.(*transport.Autopaho).ConnectionManager().AwaitConnection(context.Background())
 	require.NoError(t, err)
 	defer c.Close(context.Background())
 }
@@ -49,7 +51,7 @@ func TestNew(t *testing.T) {
 func TestNewWithUser(t *testing.T) {
 	c, err := NewWithUser(broker, "test", "test")
 	require.NoError(t, err)
-	err = c.cm.AwaitConnection(context.Background())
+	err = c.t.(*transport.Autopaho).ConnectionManager().AwaitConnection(context.Background())
 	require.NoError(t, err)
 	defer c.Close(context.Background())
 }
@@ -90,3 +92,29 @@ func TestClientRequest(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+// TestProtocol checks that the wire constants and envelopes match the ones of the engine.
+func TestProtocol(t *testing.T) {
+	assert.Equal(t, mqrr.StatusProperty, StatusProperty)
+	assert.Equal(t, mqrr.CancelProperty, CancelProperty)
+	assert.Equal(t, mqrr.JobIDProperty, JobIDProperty)
+	assert.Equal(t, mqrr.JobStateProperty, JobStateProperty)
+	assert.Equal(t, mqrr.DefaultBatchTopic, DefaultBatchTopic)
+	assert.Equal(t, jsonFields(mqrr.BatchCall{}), jsonFields(Call{}))
+	assert.Equal(t, jsonFields(mqrr.BatchResult{}), jsonFields(Result{}))
+	assert.Equal(t, jsonFields(mqrr.BatchRequest{}), jsonFields(batchRequest{}))
+	assert.Equal(t, jsonFields(mqrr.BatchResponse{}), jsonFields(batchResponse{}))
+	assert.Equal(t, jsonFields(mqrr.Job{}), jsonFields(JobStatus{}))
+}
+
+// jsonFields returns the kinds of the encoded fields of a struct by their json tag.
+func jsonFields(v interface{}) map[string]reflect.Kind {
+	fields := make(map[string]reflect.Kind)
+	typ := reflect.TypeOf(v)
+	for i := 0; i < typ.NumField(); i++ {
+		if tag := typ.Field(i).Tag.Get("json"); tag != "-" {
+			fields[tag] = typ.Field(i).Type.Kind()
+		}
+	}
+	return fields
+}
@@ -2,49 +2,102 @@ package client
 
 import (
 	"context"
-	"fmt"
 	"github.com/eclipse/paho.golang/autopaho"
 	"github.com/eclipse/paho.golang/paho"
 	"github.com/google/uuid"
+	"github.com/koho/mqrr/metrics"
+	"github.com/koho/mqrr/trace"
+	"github.com/koho/mqrr/transport"
+	"path"
 	"sync"
+	"time"
 )
 
+// CancelProperty marks the cancel notice published when the context of a
+// request is done before the response. It matches the one of the mqrr engine.
+const CancelProperty = "cancel"
+
+// cancelTimeout is how long publishing a cancel notice may take.
+const cancelTimeout = 5 * time.Second
+
 // Handler is the struct providing a request/response functionality
 // for the paho MQTT v5 client.
 type Handler struct {
 	sync.Mutex
-	c          *autopaho.ConnectionManager
-	router     paho.Router
+	t          transport.Transport
+	id         string
 	respTopic  string
 	correlData map[string]chan *paho.Publish
+	token      string
+	tracer     *trace.Tracer
+	metrics    metrics.Recorder
+	batchTopic string
+
+	requestHooks  []RequestHook
+	responseHooks []ResponseHook
 }
 
 // NewHandler registers a response topic and listens for responses for all requests.
-func NewHandler(c *autopaho.ConnectionManager, router paho.Router) *Handler {
+//
+// Deprecated: Use NewHandlerTransport, which can share the transport with an engine.
+func NewHandler(c *autopaho.ConnectionManager, router paho.Router, opts ...Option) *Handler {
+	return NewHandlerTransport(&managerTransport{cm: c, router: router}, opts...)
+}
+
+// NewHandlerTransport registers a response topic on the transport and listens
+// for responses for all requests.
+func NewHandlerTransport(t transport.Transport, opts ...Option) *Handler {
+	id := uuid.NewString()
 	h := &Handler{
-		c:          c,
-		router:     router,
-		respTopic:  fmt.Sprintf("%s/responses", uuid.NewString()),
+		t:          t,
+		id:         id,
+		respTopic:  path.Join(id, "responses"),
 		correlData: make(map[string]chan *paho.Publish),
+		metrics:    metrics.Nop{},
+		batchTopic: DefaultBatchTopic,
 	}
-	router.RegisterHandler(h.respTopic, h.responseHandler)
+	for _, opt := range opts {
+		opt(h)
+	}
+	t.HandleExclusive(h.respTopic, h.responseHandler)
 	return h
 }
 
 // Subscribe makes a subscription to the response topic.
 func (h *Handler) Subscribe(ctx context.Context) error {
-	_, err := h.c.Subscribe(ctx, &paho.Subscribe{
+	_, err := h.t.Subscribe(ctx, &paho.Subscribe{
 		Subscriptions: map[string]paho.SubscribeOptions{
-			h.respTopic: {QoS: 1},
+			h.responseTopic(): {QoS: 1},
 		},
 	})
 	return err
 }
 
+func (h *Handler) responseTopic() string {
+	h.Lock()
+	defer h.Unlock()
+	return h.respTopic
+}
+
+// useResponseInfo moves the response topic under the Response Information
+// assigned by the broker, which an engine may require of response topics.
+func (h *Handler) useResponseInfo(info string) {
+	topic := path.Join(info, h.id, "responses")
+	h.Lock()
+	old := h.respTopic
+	h.respTopic = topic
+	h.Unlock()
+	if old != topic {
+		h.t.Unhandle(old)
+		h.t.HandleExclusive(topic, h.responseHandler)
+	}
+}
+
 func (h *Handler) addCorrelID(cID string, r chan *paho.Publish) {
 	h.Lock()
 	defer h.Unlock()
 	h.correlData[cID] = r
+	h.metrics.AddPending(1)
 }
 
 func (h *Handler) getCorrelIDChan(cID string) chan *paho.Publish {
@@ -53,38 +106,145 @@ func (h *Handler) getCorrelIDChan(cID string) chan *paho.Publish {
 	rChan, ok := h.correlData[cID]
 	if ok {
 		delete(h.correlData, cID)
+		h.metrics.AddPending(-1)
 	}
 	return rChan
 }
 
 // Request sends a request to the MQTT broker and waits for a response.
-func (h *Handler) Request(ctx context.Context, pb *paho.Publish) (*paho.Publish, error) {
+// The publish is copied before the response properties and hooks are applied.
+func (h *Handler) Request(ctx context.Context, pb *paho.Publish) (resp *paho.Publish, err error) {
+	pb = clonePublish(pb)
 	cID := uuid.NewString()
 	rChan := make(chan *paho.Publish, 1)
 
 	h.addCorrelID(cID, rChan)
+	h.prepareRequest(pb, cID)
 
-	if pb.Properties == nil {
-		pb.Properties = &paho.PublishProperties{}
-	}
+	ctx, span := h.tracer.Start(ctx, pb.Topic, trace.SpanKindClient)
+	start := time.Now()
+	defer func() {
+		h.metrics.ObserveRequest(pb.Topic, Status(resp), time.Since(start))
+		span.SetError(err)
+		span.Finish()
+	}()
+	span.SetAttribute("mqtt.topic", pb.Topic)
+	trace.Inject(ctx, pb)
 
-	pb.Properties.CorrelationData = []byte(cID)
-	pb.Properties.ResponseTopic = h.respTopic
-	pb.Retain = false
+	for _, hook := range h.requestHooks {
+		if err := hook(ctx, pb); err != nil {
+			h.getCorrelIDChan(cID)
+			return nil, err
+		}
+	}
 
-	if _, err := h.c.Publish(ctx, pb); err != nil {
+	if _, err := h.t.Publish(ctx, pb); err != nil {
+		h.getCorrelIDChan(cID)
+		h.metrics.PublishFailed()
 		return nil, err
 	}
 
 	select {
-	case resp := <-rChan:
+	case resp = <-rChan:
+		for i := len(h.responseHooks) - 1; i >= 0; i-- {
+			if err := h.responseHooks[i](ctx, pb, resp); err != nil {
+				return nil, err
+			}
+		}
 		return resp, nil
 	case <-ctx.Done():
-		h.getCorrelIDChan(cID)
+		if h.getCorrelIDChan(cID) != nil {
+			go h.cancel(pb)
+		}
+		h.metrics.DropRequest(metrics.ReasonTimeout)
 		return nil, ctx.Err()
 	}
 }
 
+// Notify sends a request which has no response, such as a JSON-RPC
+// notification. The token, trace context and request hooks are applied as
+// for Request, but the request carries no response topic.
+func (h *Handler) Notify(ctx context.Context, pb *paho.Publish) (err error) {
+	pb = clonePublish(pb)
+	if pb.Properties == nil {
+		pb.Properties = &paho.PublishProperties{}
+	}
+	pb.Properties.CorrelationData = nil
+	pb.Properties.ResponseTopic = ""
+	h.authorize(pb)
+
+	ctx, span := h.tracer.Start(ctx, pb.Topic, trace.SpanKindProducer)
+	defer func() {
+		span.SetError(err)
+		span.Finish()
+	}()
+	span.SetAttribute("mqtt.topic", pb.Topic)
+	trace.Inject(ctx, pb)
+
+	for _, hook := range h.requestHooks {
+		if err := hook(ctx, pb); err != nil {
+			return err
+		}
+	}
+	if _, err := h.t.Publish(ctx, pb); err != nil {
+		h.metrics.PublishFailed()
+		return err
+	}
+	return nil
+}
+
+func clonePublish(pb *paho.Publish) *paho.Publish {
+	clone := *pb
+	if pb.Properties != nil {
+		props := *pb.Properties
+		props.User = append(paho.UserProperties(nil), pb.Properties.User...)
+		clone.Properties = &props
+	}
+	return &clone
+}
+
+// prepareRequest sets the response properties of the request and applies the handler options.
+func (h *Handler) prepareRequest(pb *paho.Publish, cID string) {
+	if pb.Properties == nil {
+		pb.Properties = &paho.PublishProperties{}
+	}
+
+	pb.Properties.CorrelationData = []byte(cID)
+	pb.Properties.ResponseTopic = h.responseTopic()
+	pb.Retain = false
+	h.authorize(pb)
+}
+
+// authorize adds the token of the handler to the request, unless it has one.
+func (h *Handler) authorize(pb *paho.Publish) {
+	if h.token != "" && pb.Properties.User.Get(TokenProperty) == "" {
+		pb.Properties.User = pb.Properties.User.Add(TokenProperty, "Bearer "+h.token)
+	}
+}
+
+// cancel publishes a cancel notice of the request, so that the server
+// stops handling it and sends no response. The notice carries the token of
+// the request, which the server requires. It runs in its own goroutine,
+// so that a timed-out Request returns at once.
+func (h *Handler) cancel(pb *paho.Publish) {
+	notice := &paho.Publish{
+		Topic: pb.Topic,
+		Properties: &paho.PublishProperties{
+			CorrelationData: pb.Properties.CorrelationData,
+			ResponseTopic:   pb.Properties.ResponseTopic,
+			User:            paho.UserProperties{}.Add(CancelProperty, "true"),
+		},
+	}
+	if token := pb.Properties.User.Get(TokenProperty); token != "" {
+		notice.Properties.User = notice.Properties.User.Add(TokenProperty, token)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cancelTimeout)
+	defer cancel()
+	if _, err := h.t.Publish(ctx, notice); err != nil {
+		h.metrics.PublishFailed()
+	}
+}
+
 func (h *Handler) responseHandler(pb *paho.Publish) {
 	if pb.Properties == nil || pb.Properties.CorrelationData == nil {
 		return
@@ -98,11 +258,56 @@ func (h *Handler) responseHandler(pb *paho.Publish) {
 
 // Close unregisters handlers of the response topic.
 func (h *Handler) Close(ctx context.Context) error {
-	if _, err := h.c.Unsubscribe(ctx, &paho.Unsubscribe{
-		Topics: []string{h.respTopic},
+	if _, err := h.t.Unsubscribe(ctx, &paho.Unsubscribe{
+		Topics: []string{h.responseTopic()},
 	}); err != nil {
 		return err
 	}
-	h.router.UnregisterHandler(h.respTopic)
+	h.t.Unhandle(h.responseTopic())
 	return nil
 }
+
+// managerTransport is the transport of a connection manager and router
+// set up by the caller of NewHandler, which manages the connection itself.
+type managerTransport struct {
+	cm     *autopaho.ConnectionManager
+	router paho.Router
+}
+
+func (t *managerTransport) Publish(ctx context.Context, p *paho.Publish) (*paho.PublishResponse, error) {
+	return t.cm.Publish(ctx, p)
+}
+
+func (t *managerTransport) Subscribe(ctx context.Context, s *paho.Subscribe) (*paho.Suback, error) {
+	return t.cm.Subscribe(ctx, s)
+}
+
+func (t *managerTransport) Unsubscribe(ctx context.Context, u *paho.Unsubscribe) (*paho.Unsuback, error) {
+	return t.cm.Unsubscribe(ctx, u)
+}
+
+func (t *managerTransport) Handle(filter string, handler paho.MessageHandler) {
+	t.router.RegisterHandler(filter, handler)
+}
+
+func (t *managerTransport) HandleExclusive(topic string, handler paho.MessageHandler) {
+	t.router.RegisterHandler(topic, handler)
+}
+
+func (t *managerTransport) Unhandle(filter string) {
+	t.router.UnregisterHandler(filter)
+}
+
+func (t *managerTransport) OnConnectionUp(func(connack *paho.Connack)) {}
+
+func (t *managerTransport) Connect(context.Context) error {
+	return nil
+}
+
+func (t *managerTransport) Disconnect(ctx context.Context) error {
+	return t.cm.Disconnect(ctx)
+}
+
+func (t *managerTransport) Done() <-chan struct{} {
+	return t.cm.Done()
+}
@@ -2,29 +2,33 @@ package client
 
 import (
 	"context"
-	"github.com/eclipse/paho.golang/autopaho"
+	"encoding/json"
+	"github.com/eclipse/paho.golang/packets"
 	"github.com/eclipse/paho.golang/paho"
+	"github.com/koho/mqrr"
+	"github.com/koho/mqrr/transport"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
-func newMQTTClient() (*autopaho.ConnectionManager, paho.Router, error) {
-	cc := defaultClientConfig(broker)
-	cc.Router = paho.NewSingleHandlerRouter(nil)
-	cm, err := autopaho.NewConnection(context.Background(), cc)
-	return cm, cc.Router, err
+func newMQTTClient() (*transport.Autopaho, error) {
+	t := transport.NewAutopaho(defaultClientConfig(broker))
+	return t, t.Connect(context.Background())
 }
 
 func TestHandlerRequest(t *testing.T) {
-	cm, router, err := newMQTTClient()
+	tr, err := newMQTTClient()
 	require.NoError(t, err)
-	defer cm.Disconnect(context.Background())
+	defer tr.Disconnect(context.Background())
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	require.NoError(t, cm.AwaitConnection(ctx))
-	h := NewHandler(cm, router)
+	require.NoError(t, tr.ConnectionManager().AwaitConnection(ctx))
+	h := NewHandlerTransport(tr)
 	err = h.Subscribe(ctx)
 	require.NoError(t, err)
 
@@ -40,3 +44,320 @@ func TestHandlerRequest(t *testing.T) {
 	assert.Equal(t, []byte(t.Name()), resp.Payload)
 	h.Close(context.Background())
 }
+
+func TestHandlerPrepareRequest(t *testing.T) {
+	h := &Handler{respTopic: "client/responses"}
+	WithToken("abc")(h)
+	pb := &paho.Publish{Retain: true}
+	h.prepareRequest(pb, "1")
+	assert.False(t, pb.Retain)
+	assert.Equal(t, []byte("1"), pb.Properties.CorrelationData)
+	assert.Equal(t, "client/responses", pb.Properties.ResponseTopic)
+	assert.Equal(t, "Bearer abc", pb.Properties.User.Get(TokenProperty))
+
+	pb = &paho.Publish{Properties: &paho.PublishProperties{User: paho.UserProperties{}.Add(TokenProperty, "Bearer xyz")}}
+	h.prepareRequest(pb, "2")
+	assert.Equal(t, []string{"Bearer xyz"}, pb.Properties.User.GetAll(TokenProperty))
+}
+
+func TestStatus(t *testing.T) {
+	assert.Equal(t, 0, Status(nil))
+	assert.Equal(t, 0, Status(&paho.Publish{}))
+	assert.Equal(t, 429, Status(&paho.Publish{Properties: &paho.PublishProperties{
+		User: paho.UserProperties{}.Add(StatusProperty, "429"),
+	}}))
+}
+
+func TestHandlerLoopback(t *testing.T) {
+	tr := transport.NewLoopback()
+	r := mqrr.New()
+	r.AccessLogger = nil
+	r.Route("echo/:name", func(c *mqrr.Context) {
+		c.String("%s:%s", c.Param("name"), c.GetRawString())
+	})
+	go r.RunTransport(tr)
+	time.Sleep(100 * time.Millisecond)
+	defer tr.Disconnect(context.Background())
+
+	c, err := NewWithTransport(tr)
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := c.Request(ctx, &paho.Publish{Topic: "echo/john", Payload: []byte("hi")})
+	require.NoError(t, err)
+	assert.Equal(t, "john:hi", string(resp.Payload))
+	assert.Equal(t, mqrr.StatusOK, Status(resp))
+}
+
+func TestHandlerSharedTransport(t *testing.T) {
+	tr := transport.NewLoopback()
+	r := mqrr.New()
+	r.AccessLogger = nil
+	var calls int32
+	r.Route("*all", func(c *mqrr.Context) {
+		atomic.AddInt32(&calls, 1)
+		c.String(c.Request.Topic)
+	})
+	require.NoError(t, r.Start(tr))
+	defer r.Close(context.Background())
+	assert.Equal(t, tr, r.Transport())
+
+	c, err := NewWithTransport(tr)
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := c.Request(ctx, &paho.Publish{Topic: "a/b"})
+	require.NoError(t, err)
+	assert.Equal(t, "a/b", string(resp.Payload))
+	// The response is not handled by the route matching every topic
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestHandlerResponseInfo(t *testing.T) {
+	tr := transport.NewLoopback()
+	tr.ResponseInfo = "clients/1/"
+	r := mqrr.New()
+	r.AccessLogger = nil
+	r.UseResponseInfo = true
+	r.MaxPayloadSize = 8
+	r.Route("echo", func(c *mqrr.Context) { c.String(c.Request.Properties.ResponseTopic) })
+	var connect *paho.Connect
+	tr.ConfigureConnect(func(c *paho.Connect) *paho.Connect {
+		// The configurators of the engine and the client are chained to this one
+		connect = c
+		return c
+	})
+	require.NoError(t, r.Start(tr))
+	defer r.Close(context.Background())
+
+	c, err := NewWithTransport(tr)
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// The response topic is under the Response Information, so the engine allows it
+	resp, err := c.Request(ctx, &paho.Publish{Topic: "echo"})
+	require.NoError(t, err)
+	assert.Equal(t, mqrr.StatusOK, Status(resp))
+	assert.True(t, strings.HasPrefix(string(resp.Payload), "clients/1/"))
+	assert.True(t, connect.Properties.RequestResponseInfo)
+	require.NotNil(t, connect.Properties.MaximumPacketSize)
+}
+
+func TestHandlerContextCall(t *testing.T) {
+	tr := transport.NewLoopback()
+	r := mqrr.New()
+	r.AccessLogger = nil
+	r.Route("front", func(c *mqrr.Context) {
+		resp, err := c.Call(c.Context(), "back", c.GetRawData())
+		if err != nil {
+			c.Status(500)
+			return
+		}
+		c.Data(resp.Payload)
+	})
+	r.Route("back", func(c *mqrr.Context) {
+		_, ok := c.Context().Deadline()
+		c.String("%s:%v:%s", c.GetRawString(), ok, c.Property(TokenProperty))
+	})
+	require.NoError(t, r.Start(tr))
+	defer r.Close(context.Background())
+	c, err := NewWithTransport(tr)
+	require.NoError(t, err)
+	r.Requester = c
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := c.Request(ctx, &paho.Publish{Topic: "front", Payload: []byte("hi"), Properties: &paho.PublishProperties{
+		User: paho.UserProperties{}.Add(mqrr.DeadlineProperty, strconv.FormatInt(time.Now().Add(time.Minute).UnixMilli(), 10)).Add(TokenProperty, "Bearer token"),
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, "hi:true:Bearer token", string(resp.Payload))
+}
+
+func TestHandlerCancel(t *testing.T) {
+	tr := transport.NewLoopback()
+	r := mqrr.New()
+	r.AccessLogger = nil
+	canceled := make(chan struct{})
+	r.Route("slow", func(c *mqrr.Context) {
+		<-c.Context().Done()
+		close(canceled)
+	})
+	require.NoError(t, r.Start(tr))
+	defer r.Close(context.Background())
+	c, err := NewWithTransport(tr)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = c.Request(ctx, &paho.Publish{Topic: "slow"})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the handler is not canceled")
+	}
+}
+
+// stallTransport never completes the publish of a cancel notice.
+type stallTransport struct {
+	*transport.Loopback
+}
+
+func (t stallTransport) Publish(ctx context.Context, p *paho.Publish) (*paho.PublishResponse, error) {
+	if p.Properties.User.Get(CancelProperty) != "" {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return t.Loopback.Publish(ctx, p)
+}
+
+func TestHandlerCancelNoWait(t *testing.T) {
+	tr := transport.NewLoopback()
+	require.NoError(t, tr.Connect(context.Background()))
+	h := NewHandlerTransport(stallTransport{tr})
+	require.NoError(t, h.Subscribe(context.Background()))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := h.Request(ctx, &paho.Publish{Topic: "nobody"})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestHandlerJob(t *testing.T) {
+	tr := transport.NewLoopback()
+	r := mqrr.New()
+	r.AccessLogger = nil
+	r.Route("report/:id", func(c *mqrr.Context) {
+		time.Sleep(50 * time.Millisecond)
+		c.String("report %s", c.Param("id"))
+	}, mqrr.Async())
+	r.Route("echo", func(c *mqrr.Context) {})
+	require.NoError(t, r.Start(tr))
+	defer r.Close(context.Background())
+	c, err := NewWithTransport(tr)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = c.StartJob(ctx, &paho.Publish{Topic: "echo"})
+	assert.ErrorIs(t, err, ErrNotJob)
+
+	job, err := c.StartJob(ctx, &paho.Publish{Topic: "report/1"})
+	require.NoError(t, err)
+	job.PollInterval = 10 * time.Millisecond
+	resp, err := job.Wait(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "report 1", string(resp.Payload))
+	status, err := job.Status(ctx)
+	require.NoError(t, err)
+	assert.True(t, status.Done())
+	assert.Equal(t, mqrr.StatusOK, status.Status)
+
+	job.ID = "unknown"
+	_, err = job.Status(ctx)
+	assert.ErrorIs(t, err, ErrJobNotFound)
+}
+
+func TestHandlerRPC(t *testing.T) {
+	tr := transport.NewLoopback()
+	r := mqrr.New()
+	r.AccessLogger = nil
+	r.Use(func(c *mqrr.Context) {
+		// Notifications go through the token and hooks of the handler
+		if c.Request.Topic == "rpc" {
+			assert.Equal(t, "Bearer secret", c.Request.Properties.User.Get(TokenProperty))
+			assert.Equal(t, "1", c.Request.Properties.User.Get("hooked"))
+		}
+		c.Next()
+	})
+	r.JSONRPC("rpc")
+	notified := make(chan string, 1)
+	r.Route("add", func(c *mqrr.Context) {
+		var args []int
+		if err := json.Unmarshal(c.GetRawData(), &args); err != nil || len(args) != 2 {
+			c.Status(mqrr.StatusBadRequest)
+			return
+		}
+		c.JSON(args[0] + args[1])
+	})
+	r.Route("log", func(c *mqrr.Context) { notified <- c.GetRawString() })
+	require.NoError(t, r.Start(tr))
+	defer r.Close(context.Background())
+	c, err := NewWithTransport(tr, WithToken("secret"), WithRequestHook(func(ctx context.Context, req *paho.Publish) error {
+		req.Properties.User = req.Properties.User.Add("hooked", "1")
+		return nil
+	}))
+	require.NoError(t, err)
+	rpc := c.RPC("rpc")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var sum int
+	require.NoError(t, rpc.Call(ctx, "add", []int{1, 2}, &sum))
+	assert.Equal(t, 3, sum)
+
+	err = rpc.Call(ctx, "add", []int{1}, &sum)
+	var rpcErr *RPCError
+	require.ErrorAs(t, err, &rpcErr)
+	assert.Equal(t, -32602, rpcErr.Code)
+
+	var a, b int
+	calls := []*RPCCall{
+		{Method: "add", Params: []int{1, 1}, Result: &a},
+		{Method: "log", Params: "hi", Notify: true},
+		{Method: "none"},
+		{Method: "add", Params: []int{2, 2}, Result: &b},
+	}
+	require.NoError(t, rpc.Batch(ctx, calls...))
+	assert.Equal(t, 2, a)
+	assert.Equal(t, 4, b)
+	assert.ErrorAs(t, calls[2].Error, &rpcErr)
+	assert.Equal(t, -32601, rpcErr.Code)
+	assert.Equal(t, `"hi"`, <-notified)
+
+	require.NoError(t, rpc.Notify(ctx, "log", "bye"))
+	assert.Equal(t, `"bye"`, <-notified)
+}
+
+func TestHandlerRequestBatch(t *testing.T) {
+	tr := transport.NewLoopback()
+	r := mqrr.New()
+	r.AccessLogger = nil
+	r.Batch("batch/device")
+	r.Route("device/:name", func(c *mqrr.Context) {
+		c.SetProperty("unit", "V")
+		c.String("%s:%s", c.Param("name"), c.GetRawString())
+	})
+	require.NoError(t, r.Start(tr))
+	defer r.Close(context.Background())
+	c, err := NewWithTransport(tr, WithBatchTopic("batch/device"))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	results, err := c.RequestBatch(ctx, []Call{
+		{Topic: "device/battery", Payload: []byte("1")},
+		{Topic: "none/a/b"},
+	}, Sequential())
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	assert.Equal(t, Result{Status: 200, Payload: []byte("battery:1"), Properties: map[string]string{"unit": "V"}}, results[0])
+	assert.Equal(t, 404, results[1].Status)
+}
+
+func TestNewHandler(t *testing.T) {
+	router := paho.NewStandardRouter()
+	h := NewHandler(nil, router)
+	rChan := make(chan *paho.Publish, 1)
+	h.addCorrelID("1", rChan)
+	router.Route(&packets.Publish{Topic: h.respTopic, Properties: &packets.Properties{CorrelationData: []byte("1")}})
+	select {
+	case resp := <-rChan:
+		assert.Equal(t, h.respTopic, resp.Topic)
+	default:
+		t.Fatal("no response routed")
+	}
+}
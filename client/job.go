@@ -0,0 +1,160 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/eclipse/paho.golang/paho"
+	"path"
+	"time"
+)
+
+// Properties of the jobs of async routes. They match the ones of the mqrr engine.
+const (
+	JobIDProperty    = "job-id"
+	JobStateProperty = "job-state"
+)
+
+// DefaultPollInterval is the interval between the result queries of Job.Wait.
+const DefaultPollInterval = time.Second
+
+// ErrJobNotFound is returned when the server does not know the job.
+var ErrJobNotFound = errors.New("client: job not found")
+
+// ErrNotJob is returned by StartJob when the response does not accept a job.
+var ErrNotJob = errors.New("client: no job started")
+
+const (
+	statusAccepted = 202
+	statusNotFound = 404
+)
+
+// JobStatus is the state of a job reported by the server.
+type JobStatus struct {
+	ID      string    `json:"id"`
+	Route   string    `json:"route"`
+	Topic   string    `json:"topic"`
+	State   string    `json:"state"`
+	Status  int       `json:"status,omitempty"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+// Done reports whether the job is finished.
+func (s *JobStatus) Done() bool {
+	return s.State == "done"
+}
+
+type requestFunc func(ctx context.Context, pb *paho.Publish) (*paho.Publish, error)
+
+// Job is a job of an async route started by StartJob.
+type Job struct {
+	// ID is the job id assigned by the server.
+	ID string
+	// Response is the response accepting the job.
+	Response *paho.Publish
+	// PollInterval is the interval between the result queries of Wait,
+	// default is DefaultPollInterval.
+	PollInterval time.Duration
+
+	topic   string
+	token   string
+	request requestFunc
+}
+
+// StartJob sends a request to an async route, and returns the job accepted by the server.
+func (h *Handler) StartJob(ctx context.Context, pb *paho.Publish) (*Job, error) {
+	return startJob(ctx, h.Request, pb)
+}
+
+// StartJob sends a request to an async route, and returns the job accepted by the server.
+func (client *Client) StartJob(ctx context.Context, pb *paho.Publish) (*Job, error) {
+	return startJob(ctx, client.Request, pb)
+}
+
+func startJob(ctx context.Context, request requestFunc, pb *paho.Publish) (*Job, error) {
+	topic, token := pb.Topic, ""
+	if pb.Properties != nil {
+		token = pb.Properties.User.Get(TokenProperty)
+	}
+	resp, err := request(ctx, pb)
+	if err != nil {
+		return nil, err
+	}
+	id := ""
+	if resp.Properties != nil {
+		id = resp.Properties.User.Get(JobIDProperty)
+	}
+	if Status(resp) != statusAccepted || id == "" {
+		return nil, fmt.Errorf("%w: status %d", ErrNotJob, Status(resp))
+	}
+	return &Job{
+		ID:       id,
+		Response: resp,
+		topic:    topic,
+		token:    token,
+		request:  request,
+	}, nil
+}
+
+func (j *Job) query(ctx context.Context, name string) (*paho.Publish, error) {
+	pb := &paho.Publish{Topic: path.Join(j.topic, "jobs", j.ID, name), Properties: &paho.PublishProperties{}}
+	if j.token != "" {
+		pb.Properties.User = pb.Properties.User.Add(TokenProperty, j.token)
+	}
+	resp, err := j.request(ctx, pb)
+	if err != nil {
+		return nil, err
+	}
+	if Status(resp) == statusNotFound {
+		return nil, ErrJobNotFound
+	}
+	return resp, nil
+}
+
+// Status queries the state of the job.
+func (j *Job) Status(ctx context.Context) (*JobStatus, error) {
+	resp, err := j.query(ctx, "status")
+	if err != nil {
+		return nil, err
+	}
+	var status JobStatus
+	if err = json.Unmarshal(resp.Payload, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Result queries the response of the job. It reports false if the job is not done.
+func (j *Job) Result(ctx context.Context) (*paho.Publish, bool, error) {
+	resp, err := j.query(ctx, "result")
+	if err != nil {
+		return nil, false, err
+	}
+	if Status(resp) == statusAccepted && resp.Properties.User.Get(JobStateProperty) != "" {
+		return nil, false, nil
+	}
+	return resp, true, nil
+}
+
+// Wait polls the result of the job until it is done or ctx is done.
+func (j *Job) Wait(ctx context.Context) (*paho.Publish, error) {
+	interval := j.PollInterval
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		resp, done, err := j.Result(ctx)
+		if err != nil || done {
+			return resp, err
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/eclipse/paho.golang/paho"
+	"sync/atomic"
+)
+
+// RPCError is a JSON-RPC 2.0 error object returned by the server.
+type RPCError struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("jsonrpc: %s (%d)", e.Message, e.Code)
+}
+
+type rpcRequest struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params,omitempty"`
+	ID      *int64      `json:"id,omitempty"`
+}
+
+type rpcResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  *RPCError       `json:"error"`
+	ID     *int64          `json:"id"`
+}
+
+// RPCCall is a call of a JSON-RPC batch.
+type RPCCall struct {
+	Method string
+	Params interface{}
+	// Result receives the result of the call. The call is a notification
+	// if Notify is set.
+	Result interface{}
+	Notify bool
+	// Error is set after the batch if the call fails.
+	Error error
+}
+
+// RPC makes JSON-RPC 2.0 calls to the engine route registered by mqrr.Engine.JSONRPC.
+type RPC struct {
+	topic   string
+	request requestFunc
+	notify  func(ctx context.Context, pb *paho.Publish) error
+	nextID  int64
+}
+
+// ErrNoResponse is returned when a JSON-RPC response is missing.
+var ErrNoResponse = errors.New("jsonrpc: no response")
+
+// NewRPC returns an RPC calling the JSON-RPC topic over the handler.
+func NewRPC(h *Handler, topic string) *RPC {
+	return &RPC{topic: topic, request: h.Request, notify: h.Notify}
+}
+
+// RPC returns an RPC calling the JSON-RPC topic over the client.
+func (client *Client) RPC(topic string) *RPC {
+	rpc := NewRPC(client.handler, topic)
+	rpc.request = client.Request
+	rpc.notify = client.Notify
+	return rpc
+}
+
+func (r *RPC) id() *int64 {
+	id := atomic.AddInt64(&r.nextID, 1)
+	return &id
+}
+
+// Call calls the method with the params, and decodes the result into result
+// unless it is nil. The error of the server is an *RPCError.
+func (r *RPC) Call(ctx context.Context, method string, params interface{}, result interface{}) error {
+	call := &RPCCall{Method: method, Params: params, Result: result}
+	if err := r.Batch(ctx, call); err != nil {
+		return err
+	}
+	return call.Error
+}
+
+// Notify sends a notification, which has no response. It goes through the
+// request hooks of the handler like a call.
+func (r *RPC) Notify(ctx context.Context, method string, params interface{}) error {
+	payload, err := json.Marshal(rpcRequest{JSONRPC: "2.0", Method: method, Params: params})
+	if err != nil {
+		return err
+	}
+	return r.notify(ctx, &paho.Publish{Topic: r.topic, Payload: payload})
+}
+
+// Batch sends the calls in one request. The error of each call is set in its
+// Error field, and the returned error reports the failure of the request.
+func (r *RPC) Batch(ctx context.Context, calls ...*RPCCall) error {
+	requests := make([]rpcRequest, len(calls))
+	index := make(map[int64]*RPCCall)
+	for i, call := range calls {
+		requests[i] = rpcRequest{JSONRPC: "2.0", Method: call.Method, Params: call.Params}
+		if !call.Notify {
+			requests[i].ID = r.id()
+			index[*requests[i].ID] = call
+		}
+	}
+	var body interface{} = requests
+	if len(calls) == 1 {
+		body = requests[0]
+	}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	if len(index) == 0 {
+		return r.notify(ctx, &paho.Publish{Topic: r.topic, Payload: payload})
+	}
+	resp, err := r.request(ctx, &paho.Publish{Topic: r.topic, Payload: payload})
+	if err != nil {
+		return err
+	}
+	var responses []rpcResponse
+	if len(calls) == 1 {
+		responses = make([]rpcResponse, 1)
+		err = json.Unmarshal(resp.Payload, &responses[0])
+	} else if err = json.Unmarshal(resp.Payload, &responses); err != nil {
+		// The whole batch is rejected with a single error
+		var single rpcResponse
+		if json.Unmarshal(resp.Payload, &single) == nil && single.Error != nil {
+			return single.Error
+		}
+	}
+	if err != nil {
+		return err
+	}
+	for _, res := range responses {
+		if res.ID == nil {
+			if res.Error != nil {
+				return res.Error
+			}
+			continue
+		}
+		call, ok := index[*res.ID]
+		if !ok {
+			continue
+		}
+		delete(index, *res.ID)
+		if res.Error != nil {
+			call.Error = res.Error
+		} else if call.Result != nil {
+			call.Error = json.Unmarshal(res.Result, call.Result)
+		}
+	}
+	for _, call := range index {
+		call.Error = ErrNoResponse
+	}
+	return nil
+}
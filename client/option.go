@@ -0,0 +1,63 @@
+package client
+
+import (
+	"context"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/koho/mqrr/metrics"
+	"github.com/koho/mqrr/trace"
+)
+
+// TokenProperty is the user property key of the bearer token attached by WithToken.
+const TokenProperty = "authorization"
+
+// Option configures a Handler.
+type Option func(h *Handler)
+
+// RequestHook is called before a request is published, with its response
+// properties set. Returning an error fails the request.
+type RequestHook func(ctx context.Context, req *paho.Publish) error
+
+// ResponseHook is called when a response is received, before it is returned
+// from Request. Returning an error fails the request.
+type ResponseHook func(ctx context.Context, req, resp *paho.Publish) error
+
+// WithToken attaches the bearer token to every request,
+// unless the request already carries one.
+func WithToken(token string) Option {
+	return func(h *Handler) {
+		h.token = token
+	}
+}
+
+// WithRequestHook adds a hook called before every request is published.
+func WithRequestHook(hook RequestHook) Option {
+	return func(h *Handler) {
+		h.requestHooks = append(h.requestHooks, hook)
+	}
+}
+
+// WithResponseHook adds a hook called on every response.
+// Response hooks are called in the reverse order they are added, so that
+// a pair of request and response hooks wraps the ones added after it.
+func WithResponseHook(hook ResponseHook) Option {
+	return func(h *Handler) {
+		h.responseHooks = append(h.responseHooks, hook)
+	}
+}
+
+// WithTracer records a span for every request, and injects its trace context
+// into the user properties of the request. The span is the child of the
+// trace context in the context passed to Request.
+func WithTracer(tracer *trace.Tracer) Option {
+	return func(h *Handler) {
+		h.tracer = tracer
+	}
+}
+
+// WithMetrics records the metrics of every request. Requests are recorded
+// by topic, which should be of bounded cardinality.
+func WithMetrics(recorder metrics.Recorder) Option {
+	return func(h *Handler) {
+		h.metrics = recorder
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"github.com/eclipse/paho.golang/autopaho"
 	"github.com/eclipse/paho.golang/paho"
+	"github.com/koho/mqrr/transport"
 	"net/url"
 	"sync"
 )
@@ -14,7 +15,7 @@ type responsePub struct {
 }
 
 // Request sends a request to the given MQTT broker and waits for a response.
-func Request(ctx context.Context, broker string, pb *paho.Publish) (*paho.Publish, error) {
+func Request(ctx context.Context, broker string, pb *paho.Publish, opts ...Option) (*paho.Publish, error) {
 	brokerUrl, err := url.Parse(broker)
 	if err != nil {
 		return nil, err
@@ -23,19 +24,19 @@ func Request(ctx context.Context, broker string, pb *paho.Publish) (*paho.Publis
 		BrokerUrls: []*url.URL{brokerUrl},
 		KeepAlive:  30,
 	}
-	return RequestWithCfg(ctx, cc, pb)
+	return RequestWithCfg(ctx, cc, pb, opts...)
 }
 
 // RequestWithCfg connects to the MQTT broker using given config.
 // After a connection is made, it sends a request to the broker and
 // waits for a response.
-func RequestWithCfg(ctx context.Context, cc autopaho.ClientConfig, pb *paho.Publish) (*paho.Publish, error) {
+func RequestWithCfg(ctx context.Context, cc autopaho.ClientConfig, pb *paho.Publish, opts ...Option) (*paho.Publish, error) {
 	var req sync.Once
 	resp := make(chan responsePub, 1)
-	router := paho.NewSingleHandlerRouter(nil)
-	cc.OnConnectionUp = func(manager *autopaho.ConnectionManager, connack *paho.Connack) {
+	t := transport.NewAutopaho(cc)
+	h := NewHandlerTransport(t, opts...)
+	t.OnConnectionUp(func(*paho.Connack) {
 		req.Do(func() {
-			h := NewHandler(manager, router)
 			if err := h.Subscribe(ctx); err == nil {
 				pub, err := h.Request(ctx, pb)
 				resp <- responsePub{pub, err}
@@ -43,20 +44,18 @@ func RequestWithCfg(ctx context.Context, cc autopaho.ClientConfig, pb *paho.Publ
 				resp <- responsePub{err: err}
 			}
 		})
-	}
-	cc.ClientConfig.Router = router
-	cm, err := autopaho.NewConnection(ctx, cc)
-	if err != nil {
+	})
+	if err := t.Connect(ctx); err != nil {
 		return nil, err
 	}
 	select {
 	// Wait for a response
 	case r := <-resp:
-		if err = cm.Disconnect(ctx); err != nil {
+		if err := t.Disconnect(ctx); err != nil {
 			return nil, err
 		}
 		return r.pub, r.err
-	case <-cm.Done():
+	case <-t.Done():
 		return nil, ctx.Err()
 	}
 }
@@ -0,0 +1,19 @@
+package client
+
+import (
+	"github.com/eclipse/paho.golang/paho"
+	"strconv"
+)
+
+// StatusProperty is the user property key of the response status.
+// It matches the one sent by the mqrr engine.
+const StatusProperty = "status"
+
+// Status returns the status code of the response, or zero if it carries none.
+func Status(resp *paho.Publish) int {
+	if resp == nil || resp.Properties == nil {
+		return 0
+	}
+	status, _ := strconv.Atoi(resp.Properties.User.Get(StatusProperty))
+	return status
+}
@@ -1,24 +1,44 @@
 package mqrr
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/eclipse/paho.golang/paho"
 	"github.com/koho/mqrr/binder"
+	"math"
+	"strconv"
 	"strings"
+	"sync"
 )
 
 // Context is a data container. It allows us to pass variables across
 // different procedures, bind request data, validate struct and render
 // response.
 type Context struct {
-	Request  *paho.Publish
-	Params   map[string][]string
-	response []byte
+	Request     *paho.Publish
+	Params      map[string][]string
+	response    []byte
+	status      int
+	properties  paho.UserProperties
+	fullTopic   string
+	handlers    HandlersChain
+	index       int
+	ctx         context.Context
+	engine      *Engine
+	noReply     bool
+	contentType string
+
+	// Keys is a key/value pair exclusively for the context of each request.
+	Keys map[string]interface{}
+	mu   sync.RWMutex
 }
 
+// abortIndex is greater than the length of any handler chain.
+const abortIndex = math.MaxInt32 >> 1
+
 func buildContext(request *paho.Publish, params map[string]int) *Context {
-	ctx := &Context{Request: request, Params: make(map[string][]string)}
+	ctx := &Context{Request: request, Params: make(map[string][]string), status: StatusOK, index: -1, ctx: context.Background()}
 	topicSplit := strings.Split(request.Topic, "/")
 	// Build topic parameters
 	for k, v := range params {
@@ -31,6 +51,88 @@ func buildContext(request *paho.Publish, params map[string]int) *Context {
 	return ctx
 }
 
+// Next executes the pending handlers in the chain inside the calling handler.
+// It should be used only inside middleware.
+func (c *Context) Next() {
+	c.index++
+	for c.index < len(c.handlers) {
+		c.handlers[c.index](c)
+		c.index++
+	}
+}
+
+// Abort prevents pending handlers from being called. The response written
+// so far is still sent.
+func (c *Context) Abort() {
+	c.index = abortIndex
+}
+
+// IsAborted returns true if the current context was aborted.
+func (c *Context) IsAborted() bool {
+	return c.index >= abortIndex
+}
+
+// FullTopic returns the topic pattern of the matched route, e.g. `user/:name`.
+func (c *Context) FullTopic() string {
+	return c.fullTopic
+}
+
+// Context returns the context.Context of the request. It carries the trace
+// context of the request when tracing is enabled.
+func (c *Context) Context() context.Context {
+	return c.ctx
+}
+
+// SetContext replaces the context.Context of the request.
+func (c *Context) SetContext(ctx context.Context) {
+	c.ctx = ctx
+}
+
+// Logger returns the logger of the engine handling the request.
+func (c *Context) Logger() Logger {
+	if c.engine == nil {
+		return log
+	}
+	return c.engine.logger()
+}
+
+// Set stores a new key/value pair exclusively for this context.
+func (c *Context) Set(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.Keys == nil {
+		c.Keys = make(map[string]interface{})
+	}
+	c.Keys[key] = value
+}
+
+// Get returns the value for the given key, ie: (value, true).
+// If the value does not exist it returns (nil, false).
+func (c *Context) Get(key string) (value interface{}, exists bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	value, exists = c.Keys[key]
+	return
+}
+
+// Property returns the value of the user property in the request.
+func (c *Context) Property(key string) string {
+	if c.Request.Properties == nil {
+		return ""
+	}
+	return c.Request.Properties.User.Get(key)
+}
+
+// SetProperty adds a user property to the response.
+func (c *Context) SetProperty(key, value string) {
+	c.properties = c.properties.Add(key, value)
+}
+
+// SetContentType sets the Content Type property of the response.
+func (c *Context) SetContentType(contentType string) {
+	c.contentType = contentType
+}
+
 // Param returns the value of the topic param.
 func (c *Context) Param(key string) string {
 	if v, ok := c.Params[key]; ok {
@@ -68,6 +170,50 @@ func (c *Context) String(format string, values ...interface{}) {
 	c.response = []byte(fmt.Sprintf(format, values...))
 }
 
+// Status sets the status code of the response.
+func (c *Context) Status(code int) {
+	c.status = code
+}
+
+// GetStatus returns the status code of the response.
+func (c *Context) GetStatus() int {
+	return c.status
+}
+
+// GetResponse returns the response data written so far.
+func (c *Context) GetResponse() []byte {
+	return c.response
+}
+
+// GetProperties returns the user properties of the response set so far.
+func (c *Context) GetProperties() paho.UserProperties {
+	return c.properties
+}
+
+// GetContentType returns the Content Type property of the response.
+func (c *Context) GetContentType() string {
+	return c.contentType
+}
+
+// buildResponse makes the response publish of the request.
+// It returns nil if the request does not carry a response topic.
+func (c *Context) buildResponse() *paho.Publish {
+	if c.noReply || c.Request.Properties == nil || c.Request.Properties.ResponseTopic == "" {
+		return nil
+	}
+	return &paho.Publish{
+		QoS:     0,
+		Retain:  false,
+		Topic:   c.Request.Properties.ResponseTopic,
+		Payload: c.response,
+		Properties: &paho.PublishProperties{
+			CorrelationData: c.Request.Properties.CorrelationData,
+			ContentType:     c.contentType,
+			User:            append(paho.UserProperties{}.Add(StatusProperty, strconv.Itoa(c.status)), c.properties...),
+		},
+	}
+}
+
 // BindTopic binds the passed struct pointer using the topic parameters.
 // e.g. `topic:"var1"`.
 func (c *Context) BindTopic(obj interface{}) error {
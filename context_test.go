@@ -1,10 +1,14 @@
 package mqrr
 
 import (
+	"context"
 	"github.com/eclipse/paho.golang/paho"
+	"github.com/koho/mqrr/trace"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"strconv"
 	"testing"
+	"time"
 )
 
 type contextBinding struct {
@@ -68,3 +72,104 @@ func TestContextParam(t *testing.T) {
 	assert.Equal(t, "50", topicContext.Param("age"))
 	assert.Equal(t, "a/b/c", topicContext.Param("last"))
 }
+
+func TestContextBuildResponse(t *testing.T) {
+	ctx := buildContext(&paho.Publish{}, nil)
+	assert.Nil(t, ctx.buildResponse())
+
+	ctx = buildContext(&paho.Publish{Properties: &paho.PublishProperties{
+		ResponseTopic:   "client/responses",
+		CorrelationData: []byte("1"),
+	}}, nil)
+	resp := ctx.buildResponse()
+	require.NotNil(t, resp)
+	assert.Equal(t, "client/responses", resp.Topic)
+	assert.Empty(t, resp.Payload)
+	assert.Equal(t, []byte("1"), resp.Properties.CorrelationData)
+	assert.Equal(t, "200", resp.Properties.User.Get(StatusProperty))
+
+	ctx.Status(400)
+	ctx.String("bad request")
+	resp = ctx.buildResponse()
+	assert.Equal(t, []byte("bad request"), resp.Payload)
+	assert.Equal(t, "400", resp.Properties.User.Get(StatusProperty))
+}
+
+func TestContextKeys(t *testing.T) {
+	ctx := buildContext(&paho.Publish{}, nil)
+	_, ok := ctx.Get("user")
+	assert.False(t, ok)
+	ctx.Set("user", "john")
+	v, ok := ctx.Get("user")
+	assert.True(t, ok)
+	assert.Equal(t, "john", v)
+}
+
+func TestContextAbort(t *testing.T) {
+	var called []string
+	ctx := buildContext(&paho.Publish{}, nil)
+	ctx.handlers = HandlersChain{
+		func(c *Context) {
+			called = append(called, "outer")
+			c.Next()
+		},
+		func(c *Context) {
+			called = append(called, "abort")
+			c.Abort()
+		},
+		func(c *Context) { called = append(called, "handler") },
+	}
+	ctx.Next()
+	assert.Equal(t, []string{"outer", "abort"}, called)
+	assert.True(t, ctx.IsAborted())
+	// Both loops step past the abort index without overflowing
+	assert.Greater(t, ctx.index, abortIndex)
+}
+
+type testRequester struct {
+	ctx context.Context
+	pb  *paho.Publish
+}
+
+func (r *testRequester) Request(ctx context.Context, pb *paho.Publish) (*paho.Publish, error) {
+	r.ctx, r.pb = ctx, pb
+	return &paho.Publish{Payload: []byte("ok")}, nil
+}
+
+func TestContextCall(t *testing.T) {
+	c := buildContext(&paho.Publish{Topic: "a", Properties: &paho.PublishProperties{
+		User: paho.UserProperties{}.Add("authorization", "Bearer abc"),
+	}}, nil)
+	_, err := c.Call(context.Background(), "b", nil)
+	assert.ErrorIs(t, err, ErrNoRequester)
+
+	requester := &testRequester{}
+	c.engine = &Engine{Requester: requester}
+	deadline := time.Now().Add(time.Minute)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	sc, err := trace.Parse("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "")
+	require.NoError(t, err)
+	c.SetContext(trace.ContextWithSpanContext(ctx, sc))
+
+	resp, err := c.Call(context.Background(), "b", []byte("x"))
+	require.NoError(t, err)
+	assert.Equal(t, "ok", string(resp.Payload))
+	assert.Equal(t, "b", requester.pb.Topic)
+	assert.Equal(t, "Bearer abc", requester.pb.Properties.User.Get("authorization"))
+	assert.Equal(t, strconv.FormatInt(deadline.UnixMilli(), 10), requester.pb.Properties.User.Get(DeadlineProperty))
+	d, ok := requester.ctx.Deadline()
+	assert.True(t, ok)
+	assert.Equal(t, deadline, d)
+	got, ok := trace.SpanContextFromContext(requester.ctx)
+	assert.True(t, ok)
+	assert.Equal(t, sc, got)
+
+	// A shorter deadline of the given context is kept
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = c.Call(ctx, "b", nil)
+	require.NoError(t, err)
+	d, _ = requester.ctx.Deadline()
+	assert.True(t, d.Before(deadline))
+}
@@ -0,0 +1,101 @@
+package mqrr
+
+import (
+	"container/list"
+	"github.com/eclipse/paho.golang/paho"
+	"sync"
+	"time"
+)
+
+// DefaultReplyTTL is how long a request is remembered if Engine.ReplyTTL is not set.
+const DefaultReplyTTL = time.Minute
+
+// ReplyStore remembers the replies of recently handled requests, so that a
+// redelivered request can be answered without running the handler again.
+type ReplyStore interface {
+	// Reserve marks the key as seen for the given ttl if it is not seen yet.
+	// It reports whether the key was seen before, along with the reply stored
+	// for it. The reply is nil while the first request is still being handled.
+	Reserve(key string, ttl time.Duration) (reply *paho.Publish, seen bool)
+	// Store saves the reply of the key for the given ttl.
+	Store(key string, reply *paho.Publish, ttl time.Duration)
+}
+
+type replyEntry struct {
+	key     string
+	reply   *paho.Publish
+	expires time.Time
+}
+
+// maxReplies bounds the entries of the in-memory ReplyStore.
+const maxReplies = 10000
+
+// memoryReplyStore is the in-memory ReplyStore. The entries are kept in the
+// order they are reserved, so the expired ones are swept from the front, and
+// the oldest one is evicted when the store is full.
+type memoryReplyStore struct {
+	sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+// NewMemoryReplyStore returns a ReplyStore keeping up to 10000 replies in memory.
+func NewMemoryReplyStore() ReplyStore {
+	return &memoryReplyStore{entries: make(map[string]*list.Element), order: list.New()}
+}
+
+func (s *memoryReplyStore) Reserve(key string, ttl time.Duration) (*paho.Publish, bool) {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	s.sweep(now)
+	if el, ok := s.entries[key]; ok {
+		if e := el.Value.(*replyEntry); now.Before(e.expires) {
+			return e.reply, true
+		}
+		s.remove(el)
+	}
+	s.add(&replyEntry{key: key, expires: now.Add(ttl)})
+	return nil, false
+}
+
+func (s *memoryReplyStore) Store(key string, reply *paho.Publish, ttl time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	if el, ok := s.entries[key]; ok {
+		e := el.Value.(*replyEntry)
+		e.reply, e.expires = reply, time.Now().Add(ttl)
+		return
+	}
+	s.add(&replyEntry{key: key, reply: reply, expires: time.Now().Add(ttl)})
+}
+
+func (s *memoryReplyStore) add(e *replyEntry) {
+	for s.order.Len() >= maxReplies {
+		s.remove(s.order.Front())
+	}
+	s.entries[e.key] = s.order.PushBack(e)
+}
+
+func (s *memoryReplyStore) remove(el *list.Element) {
+	delete(s.entries, el.Value.(*replyEntry).key)
+	s.order.Remove(el)
+}
+
+// sweep removes the expired entries at the front of the store.
+func (s *memoryReplyStore) sweep(now time.Time) {
+	for el := s.order.Front(); el != nil && !now.Before(el.Value.(*replyEntry).expires); el = s.order.Front() {
+		s.remove(el)
+	}
+}
+
+// replyKey returns the key identifying a request to the route in the
+// ReplyStore. Every route matching the topic handles the request, so the
+// route pattern is part of the key. Requests without correlation data or
+// response topic can not be identified.
+func replyKey(route string, request *paho.Publish) (string, bool) {
+	if request.Properties == nil || request.Properties.ResponseTopic == "" || len(request.Properties.CorrelationData) == 0 {
+		return "", false
+	}
+	return route + "\n" + request.Topic + "\n" + request.Properties.ResponseTopic + "\n" + string(request.Properties.CorrelationData), true
+}
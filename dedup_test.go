@@ -0,0 +1,146 @@
+package mqrr
+
+import (
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMemoryReplyStore(t *testing.T) {
+	s := NewMemoryReplyStore()
+	reply, seen := s.Reserve("a", time.Minute)
+	assert.False(t, seen)
+	assert.Nil(t, reply)
+
+	// In progress
+	reply, seen = s.Reserve("a", time.Minute)
+	assert.True(t, seen)
+	assert.Nil(t, reply)
+
+	s.Store("a", &paho.Publish{Payload: []byte("done")}, time.Minute)
+	reply, seen = s.Reserve("a", time.Minute)
+	assert.True(t, seen)
+	assert.Equal(t, []byte("done"), reply.Payload)
+
+	// Expired
+	s.Store("b", &paho.Publish{}, -time.Second)
+	_, seen = s.Reserve("b", time.Minute)
+	assert.False(t, seen)
+
+	// The oldest entries are evicted when full
+	for i := 0; i < maxReplies; i++ {
+		s.Reserve(strconv.Itoa(i), time.Minute)
+	}
+	assert.Len(t, s.(*memoryReplyStore).entries, maxReplies)
+	_, seen = s.Reserve("a", time.Minute)
+	assert.False(t, seen)
+	_, seen = s.Reserve(strconv.Itoa(maxReplies-1), time.Minute)
+	assert.True(t, seen)
+}
+
+func TestReplyKey(t *testing.T) {
+	_, ok := replyKey("r", &paho.Publish{})
+	assert.False(t, ok)
+	_, ok = replyKey("r", &paho.Publish{Properties: &paho.PublishProperties{ResponseTopic: "resp"}})
+	assert.False(t, ok)
+	pb := &paho.Publish{Properties: &paho.PublishProperties{ResponseTopic: "resp", CorrelationData: []byte("1")}}
+	k1, ok := replyKey("r", pb)
+	assert.True(t, ok)
+	k2, _ := replyKey("r", &paho.Publish{Properties: &paho.PublishProperties{ResponseTopic: "resp", CorrelationData: []byte("2")}})
+	assert.NotEqual(t, k1, k2)
+	k3, _ := replyKey("other", pb)
+	assert.NotEqual(t, k1, k3)
+}
+
+func TestEngineDedup(t *testing.T) {
+	r := New()
+	r.AccessLogger = nil
+	r.ReplyStore = NewMemoryReplyStore()
+	release := make(chan struct{})
+	var calls int32
+	r.Route("slow/:id", func(c *Context) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		c.String("done %s", c.Param("id"))
+	})
+	r.Route("fail", func(c *Context) {
+		atomic.AddInt32(&calls, 1)
+		panic("boom")
+	})
+	request := func(topic string) *paho.Publish {
+		return &paho.Publish{Topic: topic, Properties: &paho.PublishProperties{
+			ResponseTopic:   "client/responses",
+			CorrelationData: []byte("1"),
+		}}
+	}
+
+	w := &testPublisher{}
+	done := make(chan struct{})
+	go func() {
+		r.ServeMQTT(w, request("slow/1"))
+		close(done)
+	}()
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&calls) == 1 }, time.Second, time.Millisecond)
+	// A duplicate in progress is dropped
+	r.ServeMQTT(w, request("slow/1"))
+	close(release)
+	<-done
+	require.Len(t, w.replies, 1)
+	assert.Equal(t, "done 1", string(w.replies[0].Payload))
+
+	// A late duplicate gets the stored reply
+	r.ServeMQTT(w, request("slow/1"))
+	require.Len(t, w.replies, 2)
+	assert.Equal(t, w.replies[0], w.replies[1])
+	assert.EqualValues(t, 1, calls)
+
+	// The same correlation data on another topic is another request
+	r.ServeMQTT(w, request("slow/2"))
+	require.Len(t, w.replies, 3)
+	assert.Equal(t, "done 2", string(w.replies[2].Payload))
+	assert.EqualValues(t, 2, calls)
+
+	// A panic is answered, and so are its redeliveries
+	r.ServeMQTT(w, request("fail"))
+	r.ServeMQTT(w, request("fail"))
+	require.Len(t, w.replies, 5)
+	assert.Equal(t, "500", w.replies[3].Properties.User.Get(StatusProperty))
+	assert.Equal(t, w.replies[3], w.replies[4])
+	assert.EqualValues(t, 3, calls)
+}
+
+func TestEngineDedupOverlap(t *testing.T) {
+	r := New()
+	r.AccessLogger = nil
+	r.ReplyStore = NewMemoryReplyStore()
+	var a, b int32
+	r.Route("sensor/:id", func(c *Context) {
+		atomic.AddInt32(&a, 1)
+		c.String("a")
+	})
+	r.Route("sensor/+", func(c *Context) {
+		atomic.AddInt32(&b, 1)
+		c.String("b")
+	})
+	request := &paho.Publish{Topic: "sensor/1", Properties: &paho.PublishProperties{
+		ResponseTopic:   "client/responses",
+		CorrelationData: []byte("1"),
+	}}
+
+	// Each overlapping route runs and replies once
+	w := &testPublisher{}
+	r.ServeMQTT(w, request)
+	require.Len(t, w.replies, 2)
+	assert.ElementsMatch(t, []string{"a", "b"}, []string{string(w.replies[0].Payload), string(w.replies[1].Payload)})
+
+	// A redelivery gets the stored reply of each route
+	r.ServeMQTT(w, request)
+	require.Len(t, w.replies, 4)
+	assert.Equal(t, w.replies[:2], w.replies[2:])
+	assert.EqualValues(t, 1, a)
+	assert.EqualValues(t, 1, b)
+}
@@ -0,0 +1,66 @@
+package mqrr
+
+import (
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/koho/mqrr/metrics"
+	"sort"
+	"time"
+)
+
+// matchRoute returns the route handling the topic of a call of an envelope.
+// A route without wildcards is preferred. Envelope routes never match.
+func (engine *Engine) matchRoute(topic string) *route {
+	if r, ok := engine.routes[topic]; ok && !r.envelope && r.filter == topic {
+		return r
+	}
+	topics := make([]string, 0, len(engine.routes))
+	for t := range engine.routes {
+		topics = append(topics, t)
+	}
+	sort.Strings(topics)
+	for _, t := range topics {
+		if r := engine.routes[t]; !r.envelope && match(r.filter, topic) {
+			return r
+		}
+	}
+	return nil
+}
+
+// dispatch runs the route matching the topic for a call carried in the
+// envelope request of c, and returns the context holding the response.
+// The call inherits the user properties and context of the envelope.
+// The properties of the envelope come first, so that a call can not
+// override its authorization or deadline. It returns nil if no route matches.
+func (engine *Engine) dispatch(c *Context, topic string, payload []byte, props paho.UserProperties) *Context {
+	r := engine.matchRoute(topic)
+	if r == nil {
+		return nil
+	}
+	var user paho.UserProperties
+	if c.Request.Properties != nil {
+		user = append(user, c.Request.Properties.User...)
+	}
+	user = append(user, props...)
+	ic := buildContext(&paho.Publish{Topic: topic, Payload: payload, Properties: &paho.PublishProperties{User: user}}, r.params)
+	ic.ctx = c.Context()
+	ic.engine = engine
+	ic.fullTopic = r.topic
+	ic.handlers = r.handlers
+	if limit := engine.payloadLimit(r); limit > 0 && len(payload) > limit {
+		ic.handlers = HandlersChain{payloadTooLarge}
+	}
+	m := engine.metrics()
+	start := time.Now()
+	func() {
+		defer func() {
+			if err := recover(); err != nil {
+				m.DropRequest(metrics.ReasonPanic)
+				engine.logger().Errorf("%v", err)
+				internalError(ic)
+			}
+		}()
+		ic.Next()
+	}()
+	m.ObserveRequest(r.topic, ic.status, time.Since(start))
+	return ic
+}
@@ -0,0 +1,196 @@
+// Package e2e provides end-to-end payload encryption between clients and
+// the engine, so that the broker can not read the payloads. Messages are
+// encrypted with NaCl box, using X25519 keys and XSalsa20-Poly1305.
+package e2e
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/koho/mqrr"
+	"github.com/koho/mqrr/client"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// User property keys of an encrypted message.
+const (
+	// KeyIDProperty is the id of the recipient key in a request,
+	// or the id of the sender key in a response.
+	KeyIDProperty = "enc-key-id"
+	// SenderKeyProperty is the public key of the requester, the response is
+	// encrypted to it.
+	SenderKeyProperty = "enc-sender-key"
+)
+
+const nonceSize = 24
+
+// Errors of decryption.
+var (
+	ErrNotEncrypted = errors.New("message is not encrypted")
+	ErrUnknownKey   = errors.New("unknown key id")
+	ErrDecrypt      = errors.New("decryption failed")
+)
+
+// KeyPair is a X25519 key pair with an id, which is used to rotate keys.
+type KeyPair struct {
+	ID      string
+	Public  *[32]byte
+	Private *[32]byte
+}
+
+// GenerateKey generates a new key pair with the id.
+func GenerateKey(id string) (*KeyPair, error) {
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyPair{ID: id, Public: pub, Private: priv}, nil
+}
+
+// Peer returns the public part of the key pair, which is given to the other side.
+func (k *KeyPair) Peer() Peer {
+	return Peer{ID: k.ID, Public: k.Public}
+}
+
+// Peer is the public key of the other side.
+type Peer struct {
+	ID     string
+	Public *[32]byte
+}
+
+func seal(msg []byte, peer, priv *[32]byte) []byte {
+	var nonce [nonceSize]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		panic(err)
+	}
+	return box.Seal(nonce[:], msg, &nonce, peer, priv)
+}
+
+func open(sealed []byte, peer, priv *[32]byte) ([]byte, error) {
+	if len(sealed) < nonceSize {
+		return nil, ErrDecrypt
+	}
+	var nonce [nonceSize]byte
+	copy(nonce[:], sealed)
+	msg, ok := box.Open(nil, sealed[nonceSize:], &nonce, peer, priv)
+	if !ok {
+		return nil, ErrDecrypt
+	}
+	return msg, nil
+}
+
+func decodeKey(s string) (*[32]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(b) != 32 {
+		return nil, ErrDecrypt
+	}
+	var key [32]byte
+	copy(key[:], b)
+	return &key, nil
+}
+
+// Server decrypts requests and encrypts responses in the engine.
+// It holds all the key pairs still in use, so that keys can be rotated.
+type Server struct {
+	keys map[string]*KeyPair
+	// Optional allows plain requests, which are answered in plain.
+	Optional bool
+}
+
+// NewServer creates a Server with the key pairs.
+func NewServer(keys ...*KeyPair) *Server {
+	s := &Server{keys: make(map[string]*KeyPair)}
+	for _, k := range keys {
+		s.keys[k.ID] = k
+	}
+	return s
+}
+
+// Handler returns a middleware decrypting the request payload before the
+// handlers bind it, and encrypting the response back to the requester key.
+// Requests failing decryption are answered in plain with the StatusBadRequest status.
+func (s *Server) Handler() mqrr.HandlerFunc {
+	return func(c *mqrr.Context) {
+		keyID, sender := c.Property(KeyIDProperty), c.Property(SenderKeyProperty)
+		if keyID == "" && sender == "" && s.Optional {
+			c.Next()
+			return
+		}
+		key, peer, err := s.keyPair(keyID, sender)
+		var payload []byte
+		if err == nil {
+			payload, err = open(c.Request.Payload, peer, key.Private)
+		}
+		if err != nil {
+			c.Status(mqrr.StatusBadRequest)
+			c.String(err.Error())
+			c.Abort()
+			return
+		}
+		// Only the pending handlers see the plain request, even if they panic
+		request := c.Request
+		plain := *request
+		plain.Payload = payload
+		c.Request = &plain
+		func() {
+			defer func() { c.Request = request }()
+			c.Next()
+		}()
+		c.Data(seal(c.GetResponse(), peer, key.Private))
+		c.SetProperty(KeyIDProperty, key.ID)
+	}
+}
+
+func (s *Server) keyPair(keyID, sender string) (*KeyPair, *[32]byte, error) {
+	if keyID == "" || sender == "" {
+		return nil, nil, ErrNotEncrypted
+	}
+	key, ok := s.keys[keyID]
+	if !ok {
+		return nil, nil, ErrUnknownKey
+	}
+	peer, err := decodeKey(sender)
+	return key, peer, err
+}
+
+// ClientOption returns a client option encrypting every request to the first
+// server key, and decrypting every response with the server key it names.
+// The other server keys are accepted in responses during key rotation.
+// Plain responses are accepted only with an error status, since the engine
+// answers some failures in plain, e.g. a request failing decryption or a panic.
+func ClientOption(own *KeyPair, server ...Peer) client.Option {
+	if len(server) == 0 {
+		panic("no server key")
+	}
+	return func(h *client.Handler) {
+		client.WithRequestHook(func(ctx context.Context, req *paho.Publish) error {
+			req.Payload = seal(req.Payload, server[0].Public, own.Private)
+			req.Properties.User = req.Properties.User.
+				Add(KeyIDProperty, server[0].ID).
+				Add(SenderKeyProperty, base64.StdEncoding.EncodeToString(own.Public[:]))
+			return nil
+		})(h)
+		client.WithResponseHook(func(ctx context.Context, req, resp *paho.Publish) error {
+			if resp.Properties == nil || resp.Properties.User.Get(KeyIDProperty) == "" {
+				if status := client.Status(resp); status >= 200 && status <= 299 {
+					return ErrNotEncrypted
+				}
+				return nil
+			}
+			keyID := resp.Properties.User.Get(KeyIDProperty)
+			for _, peer := range server {
+				if peer.ID == keyID {
+					payload, err := open(resp.Payload, peer.Public, own.Private)
+					if err != nil {
+						return err
+					}
+					resp.Payload = payload
+					return nil
+				}
+			}
+			return ErrUnknownKey
+		})(h)
+	}
+}
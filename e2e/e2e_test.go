@@ -0,0 +1,153 @@
+package e2e
+
+import (
+	"context"
+	"encoding/base64"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/koho/mqrr"
+	"github.com/koho/mqrr/client"
+	"github.com/koho/mqrr/mqrrtest"
+	"github.com/koho/mqrr/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestSealOpen(t *testing.T) {
+	client, err := GenerateKey("c1")
+	require.NoError(t, err)
+	server, err := GenerateKey("s1")
+	require.NoError(t, err)
+
+	sealed := seal([]byte("hello"), server.Public, client.Private)
+	assert.NotContains(t, string(sealed), "hello")
+	msg, err := open(sealed, client.Public, server.Private)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello"), msg)
+
+	other, err := GenerateKey("s2")
+	require.NoError(t, err)
+	_, err = open(sealed, client.Public, other.Private)
+	assert.ErrorIs(t, err, ErrDecrypt)
+	_, err = open([]byte("short"), client.Public, server.Private)
+	assert.ErrorIs(t, err, ErrDecrypt)
+}
+
+func TestServerKeyPair(t *testing.T) {
+	old, err := GenerateKey("s1")
+	require.NoError(t, err)
+	current, err := GenerateKey("s2")
+	require.NoError(t, err)
+	s := NewServer(old, current)
+	sender := base64.StdEncoding.EncodeToString(current.Public[:])
+
+	key, _, err := s.keyPair("s1", sender)
+	require.NoError(t, err)
+	assert.Equal(t, old, key)
+	_, _, err = s.keyPair("s3", sender)
+	assert.ErrorIs(t, err, ErrUnknownKey)
+	_, _, err = s.keyPair("", "")
+	assert.ErrorIs(t, err, ErrNotEncrypted)
+	_, _, err = s.keyPair("s1", "bad")
+	assert.ErrorIs(t, err, ErrDecrypt)
+}
+
+func TestRoundTrip(t *testing.T) {
+	own, err := GenerateKey("c1")
+	require.NoError(t, err)
+	serverKey, err := GenerateKey("s1")
+	require.NoError(t, err)
+	tr := transport.NewLoopback()
+	r := mqrr.New()
+	r.AccessLogger = nil
+	var outer []byte
+	r.Use(func(c *mqrr.Context) {
+		c.Next()
+		outer = c.Request.Payload
+	})
+	r.Route("echo", func(c *mqrr.Context) { c.String("echo " + c.GetRawString()) }, mqrr.With(NewServer(serverKey).Handler()))
+	r.Route("fail", func(c *mqrr.Context) { panic(c.GetRawString()) }, mqrr.With(NewServer(serverKey).Handler()))
+	deny := func(c *mqrr.Context) {
+		c.Status(mqrr.StatusForbidden)
+		c.Abort()
+	}
+	r.Route("denied", func(c *mqrr.Context) { c.String("secret") }, mqrr.With(deny, NewServer(serverKey).Handler()))
+	require.NoError(t, r.Start(tr))
+	defer r.Close(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c, err := client.NewWithTransport(tr, ClientOption(own, serverKey.Peer()))
+	require.NoError(t, err)
+	pb := &paho.Publish{Topic: "echo", Payload: []byte("hello")}
+	for i := 0; i < 2; i++ {
+		resp, err := c.Request(ctx, pb)
+		require.NoError(t, err)
+		assert.Equal(t, "echo hello", string(resp.Payload))
+		// Neither the request nor the middleware before the server see the plain payload
+		assert.Equal(t, "hello", string(pb.Payload))
+		assert.NotContains(t, string(outer), "hello")
+	}
+
+	// Plain error replies reach the caller with their status, and a panic
+	// does not leave the plain request in place
+	resp, err := c.Request(ctx, &paho.Publish{Topic: "fail", Payload: []byte("hello")})
+	require.NoError(t, err)
+	assert.Equal(t, mqrr.StatusInternalServerError, client.Status(resp))
+	assert.NotContains(t, string(outer), "hello")
+	resp, err = c.Request(ctx, &paho.Publish{Topic: "denied", Payload: []byte("hello")})
+	require.NoError(t, err)
+	assert.Equal(t, mqrr.StatusForbidden, client.Status(resp))
+
+	// The server can not decrypt a request sealed to another key with the same id
+	wrong, err := GenerateKey("s1")
+	require.NoError(t, err)
+	c, err = client.NewWithTransport(tr, ClientOption(own, wrong.Peer()))
+	require.NoError(t, err)
+	resp, err = c.Request(ctx, &paho.Publish{Topic: "echo", Payload: []byte("hello")})
+	require.NoError(t, err)
+	assert.Equal(t, mqrr.StatusBadRequest, client.Status(resp))
+	assert.Equal(t, ErrDecrypt.Error(), string(resp.Payload))
+
+	// A plain success reply is rejected
+	c, err = client.NewWithTransport(tr, func(h *client.Handler) {
+		ClientOption(own, serverKey.Peer())(h)
+		client.WithResponseHook(func(ctx context.Context, req, resp *paho.Publish) error {
+			for i, p := range resp.Properties.User {
+				if p.Key == KeyIDProperty {
+					resp.Properties.User[i].Value = ""
+				}
+			}
+			return nil
+		})(h)
+	})
+	require.NoError(t, err)
+	_, err = c.Request(ctx, &paho.Publish{Topic: "echo", Payload: []byte("hello")})
+	assert.ErrorIs(t, err, ErrNotEncrypted)
+
+	// The sender key is not a key
+	rec := mqrrtest.Do(r, "echo", []byte("hello"),
+		paho.UserProperty{Key: KeyIDProperty, Value: "s1"},
+		paho.UserProperty{Key: SenderKeyProperty, Value: "bad"})
+	assert.Equal(t, mqrr.StatusBadRequest, rec.Status())
+	assert.Equal(t, ErrDecrypt.Error(), string(rec.Payload()))
+
+	// The response is sealed by a server key the client does not know
+	unknown, err := GenerateKey("s2")
+	require.NoError(t, err)
+	c, err = client.NewWithTransport(tr, func(h *client.Handler) {
+		ClientOption(own, serverKey.Peer())(h)
+		client.WithResponseHook(func(ctx context.Context, req, resp *paho.Publish) error {
+			for i, p := range resp.Properties.User {
+				if p.Key == KeyIDProperty {
+					resp.Properties.User[i].Value = unknown.ID
+				}
+			}
+			return nil
+		})(h)
+	})
+	require.NoError(t, err)
+	_, err = c.Request(ctx, &paho.Publish{Topic: "echo", Payload: []byte("hello")})
+	assert.ErrorIs(t, err, ErrUnknownKey)
+}
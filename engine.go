@@ -2,33 +2,108 @@ package mqrr
 
 import (
 	"context"
+	"fmt"
 	"github.com/eclipse/paho.golang/autopaho"
 	"github.com/eclipse/paho.golang/paho"
+	"github.com/koho/mqrr/metrics"
+	"github.com/koho/mqrr/trace"
+	"github.com/koho/mqrr/transport"
 	"net/url"
 	"path"
 	"reflect"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// Engine is the server instance, it contains the connection manager, router and subscriptions.
+// Engine is the server instance, it contains the transport, routes and subscriptions.
 // Create an instance of Engine, by using New().
 type Engine struct {
 	RouterGroup
-	BaseTopic     string
-	subscriptions map[string]paho.SubscribeOptions
-	router        *paho.StandardRouter
-	cm            *autopaho.ConnectionManager
-	handlers      map[string]interface{}
+	BaseTopic string
+	// ReplyStore enables duplicate suppression when set. A request carrying the
+	// same topic, correlation data and response topic as a recent one is
+	// answered with the cached reply, instead of running the handler again.
+	// Each route matching the topic keeps its own reply.
+	ReplyStore ReplyStore
+	// ReplyTTL is how long a request is remembered by the ReplyStore.
+	ReplyTTL time.Duration
+	// ResponseTopics is the allowlist of response topic filters, e.g. `+/responses`.
+	// Requests asking for a response outside the allowlist are dropped, so that
+	// the engine can not be used to publish into arbitrary topics.
+	// Every response topic is allowed if no allowlist is configured.
+	ResponseTopics []string
+	// UseResponseInfo requests the Response Information from the broker when
+	// connecting, then the response topics starting with it are allowed.
+	// The client package builds its response topics from the Response
+	// Information, so this allows the requests of a Client sharing the
+	// transport of the engine. See ConfigureConnect.
+	UseResponseInfo bool
+	// MaxPayloadSize is the maximum request payload size in bytes, zero means
+	// no limit. Oversized requests are answered with the StatusPayloadTooLarge
+	// status before the handlers run. The largest limit of the engine and the
+	// routes is also advertised to the broker as the Maximum Packet Size, with an
+	// allowance for the topic and properties, unless a route has no limit.
+	// See ConfigureConnect.
+	MaxPayloadSize int
+	// MaxBatchSize is the maximum number of calls of a JSON-RPC batch or a batch
+	// envelope, default is DefaultMaxBatchSize. Larger batches are rejected.
+	MaxBatchSize int
+	// BatchWorkers is the maximum number of calls of a batch running at once,
+	// default is DefaultBatchWorkers.
+	BatchWorkers int
+	// Tracer records a span for each request and its response publish, when set.
+	// The trace context of the request is extracted from its user properties.
+	Tracer *trace.Tracer
+	// Metrics receives the metrics of requests and responses, when set.
+	Metrics metrics.Recorder
+	// AccessLogger is the first middleware of every route, default is AccessLog().
+	// Set it to nil to disable the access log.
+	AccessLogger HandlerFunc
+	// ResponseHooks are called in order with every response before it is
+	// published, e.g. to sign it.
+	ResponseHooks []ResponseHook
+	// Logger is the logger of the engine, default is the mqrr log.
+	Logger Logger
+	// JobStore keeps the jobs of async routes, default is a memory store.
+	JobStore JobStore
+	// Requester makes the outbound requests of Context.Call. It is not set by
+	// default, since the engine does not depend on the client package. Set it
+	// to a client.Client sharing the transport of the engine, so that the calls
+	// use the connection of the engine:
+	//
+	//	t := transport.NewAutopaho(cc)
+	//	c, err := client.NewWithTransport(t)
+	//	r.Requester = c
+	//	r.RunTransport(t)
+	Requester Requester
+
+	mode           string
+	responseInfo   atomic.Value
+	mu             sync.Mutex
+	running        map[string]*runningRequest
+	pendingCancels int
+	cancelSweep    *time.Timer
+	defaultJobs    JobStore
+	jobs           sync.WaitGroup
+	jobsCtx        context.Context
+	cancelJobs     context.CancelFunc
+	subscriptions  map[string]paho.SubscribeOptions
+	transport      transport.Transport
+	routes         map[string]*route
 }
 
 // New returns a new server instance.
 func New() *Engine {
 	engine := &Engine{
-		router:        paho.NewStandardRouter(),
 		subscriptions: make(map[string]paho.SubscribeOptions),
-		handlers:      make(map[string]interface{}),
+		routes:        make(map[string]*route),
+		running:       make(map[string]*runningRequest),
+		AccessLogger:  AccessLog(),
 	}
 	engine.RouterGroup.engine = engine
 	return engine
@@ -38,14 +113,27 @@ func New() *Engine {
 // A topic contains multiple levels, each level is separated by a forward slash.
 // A level can be a name, or wildcards like `+` and `#`, or a named variable
 // starts with `:` and `*`.
-func (engine *Engine) Route(topic string, handler func(c *Context)) {
+// A response is always sent when the request carries a response topic,
+// unless the NoReply option is given.
+func (engine *Engine) Route(topic string, handler HandlerFunc, opts ...RouteOption) {
+	engine.RouterGroup.Route(topic, handler, opts...)
+}
+
+func (engine *Engine) addRoute(topic string, handlers HandlersChain, handler HandlerFunc, opts []RouteOption) {
 	namedTopic := path.Join(engine.BaseTopic, topic)
 	absoluteTopic, params := engine.buildTopic(namedTopic)
+	r := &route{topic: namedTopic, filter: absoluteTopic, params: params}
+	for _, opt := range opts {
+		opt(r)
+	}
+	handlers = append(handlers, r.middleware...)
+	if r.async {
+		engine.addJobRoutes(topic, params, handlers)
+		handler = engine.startJob(handler)
+	}
+	r.handlers = append(handlers[:len(handlers):len(handlers)], handler)
 	engine.subscriptions[absoluteTopic] = paho.SubscribeOptions{QoS: 0}
-	engine.handlers[namedTopic] = handler
-	engine.router.RegisterHandler(absoluteTopic, func(publish *paho.Publish) {
-		go engine.handleRequest(buildContext(publish, params), handler)
-	})
+	engine.routes[namedTopic] = r
 }
 
 // Run connects to the given MQTT broker, then starts listening requests.
@@ -78,38 +166,92 @@ func (engine *Engine) RunUser(broker, user, password string) {
 // RunCfg connects to the MQTT broker using the given client config,
 // then starts listening requests.
 func (engine *Engine) RunCfg(cc autopaho.ClientConfig) {
-	var err error
-	engine.printRoute(cc.BrokerUrls)
-	subs := engine.buildSubscriptions()
-	if len(subs) == 0 {
-		panic("no route found")
-	}
+	engine.debugPrint("Connecting to %v", cc.BrokerUrls)
 	// User-defined callbacks
-	onConnectionUp := cc.OnConnectionUp
 	onConnectError := cc.OnConnectError
-	cc.OnConnectionUp = func(manager *autopaho.ConnectionManager, connack *paho.Connack) {
-		// Subscribe all the registered topics
-		if _, err := manager.Subscribe(context.Background(), &paho.Subscribe{Subscriptions: subs}); err != nil {
-			log.Error(err)
-		}
-		if onConnectionUp != nil {
-			onConnectionUp(manager, connack)
-		}
-	}
 	cc.OnConnectError = func(err error) {
-		log.Error(err)
+		engine.logger().Errorf("%v", err)
 		if onConnectError != nil {
 			onConnectError(err)
 		}
 	}
-	cc.ClientConfig.Router = engine.router
-	// Start making connection to the broker
-	engine.cm, err = autopaho.NewConnection(context.Background(), cc)
-	if err != nil {
+	engine.RunTransport(transport.NewAutopaho(cc))
+}
+
+// RunTransport starts listening requests over the given transport,
+// then waits for the transport to exit.
+func (engine *Engine) RunTransport(t transport.Transport) {
+	if err := engine.Start(t); err != nil {
 		panic(err)
 	}
-	// Wait for the connection manager to exit
-	<-engine.cm.Done()
+	// Wait for the transport to exit
+	<-t.Done()
+}
+
+// Start starts listening requests over the given transport without waiting
+// for it to exit. The transport may be shared with a Client, e.g. by
+// client.NewWithTransport, then only one broker connection is needed.
+// The transport is connected if it is not connected yet. ConfigureConnect
+// is added to the transport if it is a transport.ConnectConfigurer.
+func (engine *Engine) Start(t transport.Transport) error {
+	subs := engine.buildSubscriptions()
+	if len(subs) == 0 {
+		panic("no route found")
+	}
+	engine.printRoute(t)
+	engine.transport = t
+	if c, ok := t.(transport.ConnectConfigurer); ok && (engine.UseResponseInfo || engine.maxPayloadSize() > 0) {
+		c.ConfigureConnect(engine.ConfigureConnect)
+	}
+	for _, r := range engine.routes {
+		r := r
+		t.Handle(r.filter, func(publish *paho.Publish) {
+			go engine.handleRequest(t, buildContext(publish, r.params), r)
+		})
+	}
+	t.OnConnectionUp(func(connack *paho.Connack) {
+		if engine.UseResponseInfo {
+			if connack.Properties != nil && connack.Properties.ResponseInfo != "" {
+				engine.responseInfo.Store(connack.Properties.ResponseInfo)
+			} else {
+				engine.logger().Warnf("no response information assigned by the broker")
+			}
+		}
+		// Subscribe all the registered topics
+		if _, err := t.Subscribe(context.Background(), &paho.Subscribe{Subscriptions: subs}); err != nil {
+			engine.logger().Errorf("%v", err)
+		}
+	})
+	// Start making connection to the broker
+	return t.Connect(context.Background())
+}
+
+// Transport returns the transport the engine runs on, or nil if it is not started.
+func (engine *Engine) Transport() transport.Transport {
+	return engine.transport
+}
+
+// packetOverhead is the allowance for the fixed header, topic and properties
+// of a request, when advertising the Maximum Packet Size.
+const packetOverhead = 16 * 1024
+
+// ConfigureConnect is the connect packet configurator of the engine. It
+// requests the Response Information for UseResponseInfo, and advertises the
+// Maximum Packet Size for MaxPayloadSize. Start adds it to the transports
+// implementing transport.ConnectConfigurer; chain it in the configurator of
+// other transports.
+func (engine *Engine) ConfigureConnect(connect *paho.Connect) *paho.Connect {
+	if connect.Properties == nil {
+		connect.Properties = &paho.ConnectProperties{}
+	}
+	if engine.UseResponseInfo {
+		connect.Properties.RequestResponseInfo = true
+	}
+	if max := engine.maxPayloadSize(); max > 0 {
+		size := uint32(max + packetOverhead)
+		connect.Properties.MaximumPacketSize = &size
+	}
+	return connect
 }
 
 func (engine *Engine) buildTopic(s string) (string, map[string]int) {
@@ -173,39 +315,302 @@ func (engine *Engine) buildSubscriptions() map[string]paho.SubscribeOptions {
 	return subs
 }
 
-func (engine *Engine) handleRequest(c *Context, handler func(c *Context)) {
+// Publisher publishes the responses of an engine.
+// Every transport.Transport satisfies it.
+type Publisher interface {
+	Publish(ctx context.Context, p *paho.Publish) (*paho.PublishResponse, error)
+}
+
+// ServeMQTT handles the request by every route matching its topic in the
+// calling goroutine, and publishes the responses with w. It returns false
+// if no route matches. It is mostly used to test the routes without a broker.
+func (engine *Engine) ServeMQTT(w Publisher, request *paho.Publish) bool {
+	topics := make([]string, 0, len(engine.routes))
+	for topic, r := range engine.routes {
+		if match(r.filter, request.Topic) {
+			topics = append(topics, topic)
+		}
+	}
+	sort.Strings(topics)
+	for _, topic := range topics {
+		r := engine.routes[topic]
+		engine.handleRequest(w, buildContext(request, r.params), r)
+	}
+	return len(topics) > 0
+}
+
+func (engine *Engine) handleRequest(w Publisher, c *Context, r *route) {
+	m := engine.metrics()
+	// The reply store key reserved for the request without a reply yet
+	var reserved string
 	defer func() {
 		if err := recover(); err != nil {
-			log.Error(err)
+			m.DropRequest(metrics.ReasonPanic)
+			engine.logger().Errorf("%v", err)
+			// Answer the redeliveries instead of dropping them as duplicates
+			if reserved != "" {
+				var resp *paho.Publish
+				if !r.noReply {
+					internalError(c)
+					resp = engine.response(c)
+				}
+				engine.ReplyStore.Store(reserved, resp, engine.replyTTL())
+			}
 		}
 	}()
-	// Calling handler function
+	// Drop the request if its response topic is not allowed
+	if !r.noReply && !engine.allowResponseTopic(c.Request) {
+		m.DropRequest(metrics.ReasonBlocked)
+		engine.logger().Warnf("%13s | %#v -> %#v", "blocked", c.Request.Topic, c.Request.Properties.ResponseTopic)
+		return
+	}
+	// Cancel the running request of the notice
+	key, identified := replyKey(r.topic, c.Request)
+	if isCancelNotice(c.Request) {
+		if identified {
+			engine.cancelRequest(key, requestOwner(c.Request))
+		}
+		return
+	}
+	// Start a span as the child of the request trace context
+	ctx, span := engine.Tracer.Start(trace.Extract(context.Background(), c.Request), r.topic, trace.SpanKindServer)
+	defer span.Finish()
+	span.SetAttribute("mqtt.topic", c.Request.Topic)
+	// Enforce the deadline set by the caller
+	if deadline, ok := requestDeadline(c.Request); ok {
+		if !time.Now().Before(deadline) {
+			m.DropRequest(metrics.ReasonExpired)
+			engine.logger().Infof("%13s | %#v", "expired", c.Request.Topic)
+			span.SetAttribute("mqrr.expired", "true")
+			return
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	// Suppress duplicate requests
+	dedup := identified && engine.ReplyStore != nil
+	ttl := engine.replyTTL()
+	if dedup {
+		if reply, seen := engine.ReplyStore.Reserve(key, ttl); seen {
+			m.DropRequest(metrics.ReasonDuplicate)
+			engine.logger().Infof("%13s | %#v", "duplicate", c.Request.Topic)
+			span.SetAttribute("mqrr.duplicate", "true")
+			if reply != nil {
+				engine.publish(ctx, w, reply)
+			}
+			return
+		}
+		reserved = key
+	}
+	// Track the request for cancel notices
+	var running *runningRequest
+	if identified {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		if running = engine.track(key, requestOwner(c.Request), cancel); running == nil {
+			m.DropRequest(metrics.ReasonCanceled)
+			span.SetAttribute("mqrr.canceled", "true")
+			if dedup {
+				engine.ReplyStore.Store(key, nil, ttl)
+				reserved = ""
+			}
+			return
+		}
+		defer engine.untrack(key, running)
+	}
+	c.ctx = ctx
+	// Calling handler chain
+	c.engine = engine
+	c.fullTopic = r.topic
+	c.handlers = r.handlers
+	if limit := engine.payloadLimit(r); limit > 0 && len(c.Request.Payload) > limit {
+		c.handlers = HandlersChain{payloadTooLarge}
+	}
+	if engine.AccessLogger != nil {
+		c.handlers = append(HandlersChain{engine.AccessLogger}, c.handlers...)
+	}
 	start := time.Now()
-	handler(c)
-	elapsed := time.Since(start)
-	log.Infof("%13v | %#v", elapsed, c.Request.Topic)
-	// Write response to client
-	if c.Request.Properties.ResponseTopic != "" && len(c.response) > 0 {
-		engine.cm.Publish(context.Background(), &paho.Publish{
-			QoS:        0,
-			Retain:     false,
-			Topic:      c.Request.Properties.ResponseTopic,
-			Payload:    c.response,
-			Properties: &paho.PublishProperties{CorrelationData: c.Request.Properties.CorrelationData},
-		})
+	m.AddInFlight(1)
+	func() {
+		defer m.AddInFlight(-1)
+		defer func() {
+			if err := recover(); err != nil {
+				m.DropRequest(metrics.ReasonPanic)
+				engine.logger().Errorf("%v", err)
+				internalError(c)
+			}
+		}()
+		c.Next()
+	}()
+	m.ObserveRequest(r.topic, c.status, time.Since(start))
+	span.SetAttribute("mqrr.status", strconv.Itoa(c.status))
+	// The client is no longer waiting for a canceled request
+	if running != nil && engine.untrack(key, running) {
+		m.DropRequest(metrics.ReasonCanceled)
+		engine.logger().Infof("%13s | %#v", "canceled", c.Request.Topic)
+		span.SetAttribute("mqrr.canceled", "true")
+		if dedup {
+			engine.ReplyStore.Store(key, nil, ttl)
+			reserved = ""
+		}
+		return
+	}
+	// Write response to client, an empty payload still acknowledges the request
+	var resp *paho.Publish
+	if !r.noReply {
+		resp = engine.response(c)
+	}
+	if dedup {
+		engine.ReplyStore.Store(key, resp, ttl)
+		reserved = ""
+	}
+	if resp != nil {
+		engine.publish(ctx, w, resp)
+	}
+}
+
+// response builds the response of the request and applies the response hooks.
+func (engine *Engine) response(c *Context) *paho.Publish {
+	resp := c.buildResponse()
+	if resp != nil {
+		for _, hook := range engine.ResponseHooks {
+			hook(c, resp)
+		}
+	}
+	return resp
+}
+
+func payloadTooLarge(c *Context) {
+	c.Status(StatusPayloadTooLarge)
+	c.String("payload too large")
+}
+
+// internalError replaces the response of a panicking handler. The panic
+// is logged, not sent to the caller.
+func internalError(c *Context) {
+	c.Status(StatusInternalServerError)
+	c.String("internal server error")
+}
+
+func (engine *Engine) replyTTL() time.Duration {
+	if engine.ReplyTTL <= 0 {
+		return DefaultReplyTTL
+	}
+	return engine.ReplyTTL
+}
+
+func (engine *Engine) metrics() metrics.Recorder {
+	if engine.Metrics == nil {
+		return metrics.Nop{}
+	}
+	return engine.Metrics
+}
+
+func (engine *Engine) payloadLimit(r *route) int {
+	if r.maxPayload > 0 {
+		return r.maxPayload
 	}
+	return engine.MaxPayloadSize
 }
 
-func (engine *Engine) printRoute(urls []*url.URL) {
-	for topic, handler := range engine.handlers {
-		debugPrint("%-25s --> %s", topic, runtime.FuncForPC(reflect.ValueOf(handler).Pointer()).Name())
+// maxPayloadSize returns the largest payload size accepted by the routes,
+// or zero if a route has no limit.
+func (engine *Engine) maxPayloadSize() int {
+	max := 0
+	for _, r := range engine.routes {
+		limit := engine.payloadLimit(r)
+		if limit <= 0 {
+			return 0
+		}
+		if limit > max {
+			max = limit
+		}
 	}
-	debugPrint("Listening requests on %v", urls)
+	return max
 }
 
-// Close closes the connection and waits for goroutine to exit.
+// allowResponseTopic reports whether the response topic of the request
+// is in the allowlist.
+func (engine *Engine) allowResponseTopic(request *paho.Publish) bool {
+	if request.Properties == nil || request.Properties.ResponseTopic == "" {
+		return true
+	}
+	if len(engine.ResponseTopics) == 0 && !engine.UseResponseInfo {
+		return true
+	}
+	topic := request.Properties.ResponseTopic
+	if strings.ContainsAny(topic, "+#") {
+		return false
+	}
+	if info, _ := engine.responseInfo.Load().(string); info != "" && strings.HasPrefix(topic, info) {
+		return true
+	}
+	for _, filter := range engine.ResponseTopics {
+		if match(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+func (engine *Engine) publish(ctx context.Context, w Publisher, pb *paho.Publish) {
+	ctx, span := engine.Tracer.Start(ctx, "publish "+pb.Topic, trace.SpanKindProducer)
+	defer span.Finish()
+	if span != nil {
+		// The reply may be cached, inject the trace context into a copy
+		props := *pb.Properties
+		pb = &paho.Publish{QoS: pb.QoS, Retain: pb.Retain, Topic: pb.Topic, Payload: pb.Payload, Properties: &props}
+		trace.Inject(ctx, pb)
+	}
+	if _, err := w.Publish(context.Background(), pb); err != nil {
+		engine.metrics().PublishFailed()
+		span.SetError(err)
+		engine.logger().Errorf("%v", err)
+	}
+}
+
+func (engine *Engine) printRoute(t transport.Transport) {
+	for topic, r := range engine.routes {
+		handler := r.handlers.Last()
+		engine.debugPrint("%-25s --> %s (%d handlers)", topic, runtime.FuncForPC(reflect.ValueOf(handler).Pointer()).Name(), len(r.handlers))
+	}
+	if s, ok := t.(fmt.Stringer); ok {
+		engine.debugPrint("Listening requests on %s", s)
+	} else {
+		engine.debugPrint("Listening requests on %T", t)
+	}
+}
+
+// Close cancels the running jobs and waits for them to exit, or until ctx is
+// done, then closes the connection. If ctx is done first, the connection is
+// still closed and ctx.Err() is returned. No job can be started after Close.
 func (engine *Engine) Close(ctx context.Context) error {
-	return engine.cm.Disconnect(ctx)
+	engine.mu.Lock()
+	if engine.jobsCtx == nil {
+		engine.jobsCtx, engine.cancelJobs = context.WithCancel(context.Background())
+	}
+	engine.cancelJobs()
+	engine.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		engine.jobs.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if engine.transport != nil {
+		if derr := engine.transport.Disconnect(ctx); err == nil {
+			err = derr
+		}
+	}
+	return err
 }
 
 func match(r1, r2 string) bool {
@@ -3,8 +3,15 @@ package mqrr
 import (
 	"context"
 	"github.com/eclipse/paho.golang/paho"
+	"github.com/koho/mqrr/metrics"
+	"github.com/koho/mqrr/trace"
+	"github.com/koho/mqrr/transport"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -35,5 +42,344 @@ func TestEngineRun(t *testing.T) {
 	time.Sleep(2 * time.Second)
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-	require.NoError(t, r.engine.cm.AwaitConnection(ctx))
+	require.NoError(t, r.engine.transport.(*transport.Autopaho).ConnectionManager().AwaitConnection(ctx))
+}
+
+func TestEngineMiddleware(t *testing.T) {
+	r := New()
+	var trace []string
+	mark := func(name string) HandlerFunc {
+		return func(c *Context) {
+			trace = append(trace, name)
+		}
+	}
+	r.Use(mark("engine"))
+	g := r.Group("G1")
+	g.Use(mark("group"))
+	g.Route(":name", mark("handler"), With(mark("route")))
+	g.Route("abort", mark("handler"), With(func(c *Context) {
+		c.Status(403)
+		c.Abort()
+	}))
+
+	rt := r.routes["G1/:name"]
+	c := buildContext(&paho.Publish{Topic: "G1/john"}, rt.params)
+	r.handleRequest(nil, c, rt)
+	assert.Equal(t, []string{"engine", "group", "route", "handler"}, trace)
+	assert.Equal(t, "G1/:name", c.FullTopic())
+
+	trace = nil
+	rt = r.routes["G1/abort"]
+	c = buildContext(&paho.Publish{Topic: "G1/abort"}, rt.params)
+	r.handleRequest(nil, c, rt)
+	assert.Equal(t, []string{"engine", "group"}, trace)
+	assert.True(t, c.IsAborted())
+	assert.Equal(t, 403, c.GetStatus())
+}
+
+func TestEngineAllowResponseTopic(t *testing.T) {
+	request := func(topic string) *paho.Publish {
+		return &paho.Publish{Properties: &paho.PublishProperties{ResponseTopic: topic}}
+	}
+	r := New()
+	assert.True(t, r.allowResponseTopic(request("device/1/commands")))
+	assert.True(t, r.allowResponseTopic(&paho.Publish{}))
+
+	r.ResponseTopics = []string{"+/responses", "clients/#"}
+	assert.True(t, r.allowResponseTopic(request("abc/responses")))
+	assert.True(t, r.allowResponseTopic(request("clients/1/inbox")))
+	assert.False(t, r.allowResponseTopic(request("device/1/commands")))
+	assert.False(t, r.allowResponseTopic(request("+/responses")))
+
+	r.UseResponseInfo = true
+	r.responseInfo.Store("resp/engine/")
+	assert.True(t, r.allowResponseTopic(request("resp/engine/1")))
+	assert.False(t, r.allowResponseTopic(request("resp/other/1")))
+}
+
+func TestEngineMaxPayloadSize(t *testing.T) {
+	r := New()
+	r.MaxPayloadSize = 4
+	called := 0
+	r.Route("small", func(c *Context) { called++ })
+	r.Route("large", func(c *Context) { called++ }, MaxPayloadSize(8))
+
+	rt := r.routes["small"]
+	c := buildContext(&paho.Publish{Topic: "small", Payload: []byte("12345")}, rt.params)
+	r.handleRequest(nil, c, rt)
+	assert.Equal(t, 0, called)
+	assert.Equal(t, StatusPayloadTooLarge, c.GetStatus())
+
+	rt = r.routes["large"]
+	c = buildContext(&paho.Publish{Topic: "large", Payload: []byte("12345")}, rt.params)
+	r.handleRequest(nil, c, rt)
+	assert.Equal(t, 1, called)
+	assert.Equal(t, StatusOK, c.GetStatus())
+
+	// The largest limit is advertised
+	connect := r.ConfigureConnect(&paho.Connect{})
+	assert.Equal(t, uint32(8+packetOverhead), *connect.Properties.MaximumPacketSize)
+
+	// No limit is advertised if a route has none
+	r.MaxPayloadSize = 0
+	connect = r.ConfigureConnect(&paho.Connect{})
+	assert.Nil(t, connect.Properties.MaximumPacketSize)
+}
+
+func TestEngineTracer(t *testing.T) {
+	recorder := &trace.Recorder{}
+	r := New()
+	r.Tracer = trace.New(recorder)
+	var sc trace.SpanContext
+	r.Route("user/:name", func(c *Context) {
+		sc, _ = trace.SpanContextFromContext(c.Context())
+	})
+	rt := r.routes["user/:name"]
+	c := buildContext(&paho.Publish{Topic: "user/john", Properties: &paho.PublishProperties{
+		User: paho.UserProperties{}.Add(trace.TraceParentProperty, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"),
+	}}, rt.params)
+	r.handleRequest(nil, c, rt)
+
+	spans := recorder.Spans()
+	require.Len(t, spans, 1)
+	assert.Equal(t, "user/:name", spans[0].Name)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", spans[0].TraceID.String())
+	assert.Equal(t, "00f067aa0ba902b7", spans[0].Parent.String())
+	assert.Equal(t, spans[0].SpanID, sc.SpanID)
+	assert.Equal(t, "200", spans[0].Attributes["mqrr.status"])
+}
+
+func TestEngineMetrics(t *testing.T) {
+	recorder := metrics.NewPrometheus("")
+	r := New()
+	r.Metrics = recorder
+	r.ResponseTopics = []string{"+/responses"}
+	r.Route("user/:name", func(c *Context) { c.Status(404) })
+	rt := r.routes["user/:name"]
+	r.handleRequest(nil, buildContext(&paho.Publish{Topic: "user/john"}, rt.params), rt)
+	r.handleRequest(nil, buildContext(&paho.Publish{Topic: "user/john", Properties: &paho.PublishProperties{
+		ResponseTopic: "device/1/commands",
+	}}, rt.params), rt)
+
+	var b strings.Builder
+	_, err := recorder.WriteTo(&b)
+	require.NoError(t, err)
+	assert.Contains(t, b.String(), `requests_total{route="user/:name",status="404"} 1`)
+	assert.Contains(t, b.String(), `dropped_requests_total{reason="blocked"} 1`)
+	assert.Contains(t, b.String(), "in_flight_requests 0\n")
+}
+
+func TestEngineDeadline(t *testing.T) {
+	recorder := metrics.NewPrometheus("")
+	r := New()
+	r.Metrics = recorder
+	var deadline time.Time
+	var called int
+	r.Route("user/:name", func(c *Context) {
+		called++
+		deadline, _ = c.Context().Deadline()
+	})
+	rt := r.routes["user/:name"]
+	request := func(deadline time.Time) *paho.Publish {
+		return &paho.Publish{Topic: "user/john", Properties: &paho.PublishProperties{
+			User: paho.UserProperties{}.Add(DeadlineProperty, strconv.FormatInt(deadline.UnixMilli(), 10)),
+		}}
+	}
+	r.handleRequest(nil, buildContext(request(time.Now().Add(-time.Second)), rt.params), rt)
+	assert.Equal(t, 0, called)
+
+	expected := time.Now().Add(time.Minute)
+	r.handleRequest(nil, buildContext(request(expected), rt.params), rt)
+	assert.Equal(t, 1, called)
+	assert.Equal(t, expected.UnixMilli(), deadline.UnixMilli())
+
+	var b strings.Builder
+	_, err := recorder.WriteTo(&b)
+	require.NoError(t, err)
+	assert.Contains(t, b.String(), `dropped_requests_total{reason="expired"} 1`)
+}
+
+type testPublisher struct {
+	mu      sync.Mutex
+	replies []*paho.Publish
+}
+
+func (p *testPublisher) Publish(_ context.Context, pb *paho.Publish) (*paho.PublishResponse, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.replies = append(p.replies, pb)
+	return &paho.PublishResponse{}, nil
+}
+
+func TestEngineCancel(t *testing.T) {
+	recorder := metrics.NewPrometheus("")
+	r := New()
+	r.Metrics = recorder
+	started := make(chan struct{})
+	var called int32
+	r.Route("job/:id", func(c *Context) {
+		atomic.AddInt32(&called, 1)
+		close(started)
+		<-c.Context().Done()
+		c.String("late")
+	})
+	rt := r.routes["job/:id"]
+	request := func(correlation string, cancel bool) *Context {
+		pb := &paho.Publish{Topic: "job/1", Properties: &paho.PublishProperties{
+			ResponseTopic:   "client/responses",
+			CorrelationData: []byte(correlation),
+			User:            paho.UserProperties{}.Add(authorizationProperty, "Bearer owner"),
+		}}
+		if cancel {
+			pb.Properties.User = pb.Properties.User.Add(CancelProperty, "true")
+		}
+		return buildContext(pb, rt.params)
+	}
+	w := &testPublisher{}
+	done := make(chan struct{})
+	go func() {
+		r.handleRequest(w, request("1", false), rt)
+		close(done)
+	}()
+	<-started
+	r.handleRequest(w, request("1", true), rt)
+	<-done
+	assert.Empty(t, w.replies)
+	assert.Empty(t, r.running)
+
+	// A notice arriving before its request drops the request
+	r.handleRequest(w, request("2", true), rt)
+	r.handleRequest(w, request("2", false), rt)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&called))
+	assert.Empty(t, w.replies)
+	assert.Empty(t, r.running)
+
+	var b strings.Builder
+	_, err := recorder.WriteTo(&b)
+	require.NoError(t, err)
+	assert.Contains(t, b.String(), `dropped_requests_total{reason="canceled"} 2`)
+
+	// Only the sender of the request can cancel it
+	forged := func(correlation string) *Context {
+		c := request(correlation, true)
+		c.Request.Properties.User = paho.UserProperties{}.Add(CancelProperty, "true").Add(authorizationProperty, "Bearer other")
+		return c
+	}
+	started = make(chan struct{})
+	done = make(chan struct{})
+	go func() {
+		r.handleRequest(w, request("3", false), rt)
+		close(done)
+	}()
+	<-started
+	r.handleRequest(w, forged("3"), rt)
+	select {
+	case <-done:
+		t.Fatal("canceled by a forged notice")
+	case <-time.After(50 * time.Millisecond):
+	}
+	r.handleRequest(w, request("3", true), rt)
+	<-done
+
+	started = make(chan struct{})
+	r.handleRequest(w, forged("4"), rt)
+	go r.handleRequest(w, request("4", false), rt)
+	<-started
+	r.handleRequest(w, request("4", true), rt)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&called))
+}
+
+func TestEngineCancelOverlap(t *testing.T) {
+	r := New()
+	r.AccessLogger = nil
+	var started sync.WaitGroup
+	started.Add(2)
+	handler := func(c *Context) {
+		started.Done()
+		<-c.Context().Done()
+		c.String("late")
+	}
+	r.Route("job/:id", handler)
+	r.Route("job/+", handler)
+	request := &paho.Publish{Topic: "job/1", Properties: &paho.PublishProperties{
+		ResponseTopic:   "client/responses",
+		CorrelationData: []byte("1"),
+	}}
+	w := &testPublisher{}
+	var done sync.WaitGroup
+	for _, rt := range r.routes {
+		done.Add(1)
+		go func(rt *route) {
+			defer done.Done()
+			r.handleRequest(w, buildContext(request, rt.params), rt)
+		}(rt)
+	}
+	started.Wait()
+
+	// The notice cancels the request on every route
+	notice := &paho.Publish{Topic: "job/1", Properties: &paho.PublishProperties{
+		ResponseTopic:   "client/responses",
+		CorrelationData: []byte("1"),
+		User:            paho.UserProperties{}.Add(CancelProperty, "true"),
+	}}
+	r.ServeMQTT(w, notice)
+	done.Wait()
+	assert.Empty(t, w.replies)
+	assert.Empty(t, r.running)
+}
+
+func TestEngineCancelPending(t *testing.T) {
+	r := New()
+	key := func(i int) string { return strconv.Itoa(i) }
+	r.cancelRequest(key(0), "")
+	require.NotNil(t, r.cancelSweep)
+	r.pendingCancels = maxPendingCancels
+	r.cancelRequest(key(1), "")
+	assert.Len(t, r.running, 1)
+
+	// Expired notices are swept
+	r.pendingCancels = 1
+	r.running[key(0)].created = time.Now().Add(-cancelTTL)
+	r.cancelSweep.Stop()
+	r.sweepCancels()
+	assert.Empty(t, r.running)
+	assert.Zero(t, r.pendingCancels)
+	assert.Nil(t, r.cancelSweep)
+}
+
+func TestEnginePanic(t *testing.T) {
+	r := New()
+	r.AccessLogger = nil
+	r.Route("fail", func(c *Context) {
+		c.String("partial")
+		panic("secret detail")
+	})
+	w := &testPublisher{}
+	r.ServeMQTT(w, &paho.Publish{Topic: "fail", Properties: &paho.PublishProperties{ResponseTopic: "client/responses"}})
+	require.Len(t, w.replies, 1)
+	assert.Equal(t, "500", w.replies[0].Properties.User.Get(StatusProperty))
+	assert.Equal(t, "internal server error", string(w.replies[0].Payload))
+}
+
+func TestEngineSameFilter(t *testing.T) {
+	tr := transport.NewLoopback()
+	r := New()
+	r.AccessLogger = nil
+	got := make(chan string, 2)
+	r.Route("user/:name/x", func(c *Context) { got <- "name " + c.Param("name") }, NoReply())
+	r.Route("user/:id/x", func(c *Context) { got <- "id " + c.Param("id") }, NoReply())
+	require.NoError(t, r.Start(tr))
+	defer r.Close(context.Background())
+	_, err := tr.Publish(context.Background(), &paho.Publish{Topic: "user/1/x"})
+	require.NoError(t, err)
+	var handled []string
+	for i := 0; i < 2; i++ {
+		select {
+		case s := <-got:
+			handled = append(handled, s)
+		case <-time.After(time.Second):
+			t.Fatal("route not called")
+		}
+	}
+	assert.ElementsMatch(t, []string{"name 1", "id 1"}, handled)
 }
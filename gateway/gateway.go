@@ -0,0 +1,229 @@
+// Package gateway exposes mqrr routes as HTTP endpoints. A Gateway is a
+// net/http handler forwarding each request to a request topic, and writing
+// the reply as the HTTP response.
+package gateway
+
+import (
+	"context"
+	"errors"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/koho/mqrr/client"
+	"io"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// DefaultTimeout is how long a Gateway waits for a reply.
+const DefaultTimeout = 10 * time.Second
+
+// DefaultMaxBodySize is the largest request body accepted by a Gateway.
+const DefaultMaxBodySize = 1 << 20
+
+// Requester sends a request and waits for the reply, e.g. client.Client.
+type Requester interface {
+	Request(ctx context.Context, pb *paho.Publish) (*paho.Publish, error)
+}
+
+// Gateway maps HTTP methods and paths to request topics. The Content-Type
+// header maps to the Content Type property both ways.
+type Gateway struct {
+	// Timeout is how long to wait for a reply before responding 504,
+	// default is DefaultTimeout.
+	Timeout time.Duration
+	// MaxBodySize is the largest request body, default is DefaultMaxBodySize.
+	// A negative value disables the limit.
+	MaxBodySize int64
+	// Headers are the request headers forwarded as user properties, with
+	// lower case keys. Default is the Authorization header.
+	Headers []string
+	// ResponseHeaders are the user properties of the reply written as response
+	// headers, matched regardless of case. Other properties are not exposed.
+	ResponseHeaders []string
+
+	requester Requester
+	routes    []*route
+}
+
+type route struct {
+	method string
+	path   []string
+	topic  []string
+}
+
+// New returns a Gateway sending requests with the requester.
+func New(requester Requester) *Gateway {
+	return &Gateway{
+		Timeout:     DefaultTimeout,
+		MaxBodySize: DefaultMaxBodySize,
+		Headers:     []string{"Authorization"},
+		requester:   requester,
+	}
+}
+
+// Handle maps the method and path to the topic. An empty method matches any
+// method. The path may have parameters as in mqrr routes, e.g. `/users/:name`
+// or `/files/*path`, and the topic refers to them by the same names,
+// e.g. `user/:name/get`.
+func (g *Gateway) Handle(method, path, topic string) {
+	r := &route{method: method, path: split(path), topic: split(topic)}
+	params := make(map[string]bool)
+	for i, part := range r.path {
+		if part == "" {
+			panic("invalid path")
+		}
+		if part[0] == '*' && i != len(r.path)-1 {
+			panic("the catch-all parameter must be placed as the last segment in the path")
+		}
+		if part[0] == ':' || part[0] == '*' {
+			params[part[1:]] = true
+		}
+	}
+	for _, part := range r.topic {
+		if part == "" {
+			panic("invalid topic")
+		}
+		if (part[0] == ':' || part[0] == '*') && !params[part[1:]] {
+			panic("unknown param " + part + " in topic")
+		}
+	}
+	g.routes = append(g.routes, r)
+}
+
+// GET is a shortcut for Handle("GET", path, topic).
+func (g *Gateway) GET(path, topic string) {
+	g.Handle(http.MethodGet, path, topic)
+}
+
+// POST is a shortcut for Handle("POST", path, topic).
+func (g *Gateway) POST(path, topic string) {
+	g.Handle(http.MethodPost, path, topic)
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	topic, found, allowed := g.match(req.Method, split(req.URL.Path))
+	if !found {
+		http.NotFound(w, req)
+		return
+	}
+	if !allowed {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if strings.ContainsAny(topic, "+#\x00") || !utf8.ValidString(topic) {
+		http.Error(w, "invalid topic", http.StatusBadRequest)
+		return
+	}
+	var body io.Reader = req.Body
+	if g.MaxBodySize >= 0 {
+		body = io.LimitReader(req.Body, g.MaxBodySize+1)
+	}
+	payload, err := io.ReadAll(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if g.MaxBodySize >= 0 && int64(len(payload)) > g.MaxBodySize {
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+	pb := &paho.Publish{Topic: topic, Payload: payload, Properties: &paho.PublishProperties{
+		ContentType: req.Header.Get("Content-Type"),
+	}}
+	for _, key := range g.Headers {
+		for _, value := range req.Header.Values(key) {
+			pb.Properties.User = pb.Properties.User.Add(strings.ToLower(key), value)
+		}
+	}
+	ctx := req.Context()
+	if g.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, g.Timeout)
+		defer cancel()
+	}
+	resp, err := g.requester.Request(ctx, pb)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			http.Error(w, http.StatusText(http.StatusGatewayTimeout), http.StatusGatewayTimeout)
+		} else {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		}
+		return
+	}
+	status := client.Status(resp)
+	if status < 100 || status > 999 {
+		http.Error(w, "invalid status", http.StatusBadGateway)
+		return
+	}
+	if resp.Properties != nil {
+		if resp.Properties.ContentType != "" {
+			w.Header().Set("Content-Type", resp.Properties.ContentType)
+		}
+		for _, key := range g.ResponseHeaders {
+			for _, p := range resp.Properties.User {
+				if strings.EqualFold(p.Key, key) {
+					w.Header().Add(textproto.CanonicalMIMEHeaderKey(key), p.Value)
+				}
+			}
+		}
+	}
+	w.WriteHeader(status)
+	w.Write(resp.Payload)
+}
+
+// match returns the topic of the route matching the method and path.
+// found reports whether a route matches the path regardless of the method.
+func (g *Gateway) match(method string, path []string) (topic string, found, allowed bool) {
+	for _, r := range g.routes {
+		params, ok := r.match(path)
+		if !ok {
+			continue
+		}
+		found = true
+		if r.method != "" && r.method != method {
+			continue
+		}
+		levels := make([]string, 0, len(r.topic))
+		for _, part := range r.topic {
+			if part[0] == ':' || part[0] == '*' {
+				part = params[part[1:]]
+			}
+			levels = append(levels, part)
+		}
+		return strings.Join(levels, "/"), true, true
+	}
+	return "", found, false
+}
+
+func (r *route) match(path []string) (map[string]string, bool) {
+	params := make(map[string]string)
+	for i, part := range r.path {
+		if part[0] == '*' {
+			if i >= len(path) {
+				return nil, false
+			}
+			for _, p := range path[i:] {
+				if p == "" {
+					return nil, false
+				}
+			}
+			params[part[1:]] = strings.Join(path[i:], "/")
+			return params, true
+		}
+		if i >= len(path) || path[i] == "" {
+			return nil, false
+		}
+		if part[0] == ':' {
+			params[part[1:]] = path[i]
+		} else if part != path[i] {
+			return nil, false
+		}
+	}
+	return params, len(path) == len(r.path)
+}
+
+func split(s string) []string {
+	return strings.Split(strings.Trim(s, "/"), "/")
+}
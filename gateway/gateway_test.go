@@ -0,0 +1,114 @@
+package gateway
+
+import (
+	"context"
+	"github.com/koho/mqrr"
+	"github.com/koho/mqrr/client"
+	"github.com/koho/mqrr/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestGateway(t *testing.T) {
+	tr := transport.NewLoopback()
+	r := mqrr.New()
+	r.AccessLogger = nil
+	r.Route("user/:name/get", func(c *mqrr.Context) {
+		c.SetProperty("x-user", c.Param("name"))
+		c.SetProperty("internal", "secret")
+		c.String("hello %s, %s", c.Param("name"), c.Property("authorization"))
+	})
+	r.Route("user/:name/set", func(c *mqrr.Context) {
+		c.Status(http.StatusCreated)
+		c.Data(c.GetRawData())
+	})
+	r.Route("convert", func(c *mqrr.Context) {
+		c.SetContentType("application/json")
+		c.String("%q", c.Request.Properties.ContentType)
+	})
+	r.Route("file/*path", func(c *mqrr.Context) { c.String("%s", c.Param("path")) })
+	r.Route("slow", func(c *mqrr.Context) { <-c.Context().Done() })
+	require.NoError(t, r.Start(tr))
+	defer r.Close(context.Background())
+	c, err := client.NewWithTransport(tr)
+	require.NoError(t, err)
+
+	g := New(c)
+	g.GET("/users/:name", "user/:name/get")
+	g.POST("/users/:name", "user/:name/set")
+	g.Handle("", "/files/*path", "file/*path")
+	g.POST("/convert", "convert")
+	g.GET("/slow", "slow")
+	g.GET("/none", "none")
+	g.Timeout = 100 * time.Millisecond
+	g.ResponseHeaders = []string{"X-User"}
+	srv := httptest.NewServer(g)
+	defer srv.Close()
+
+	do := func(method, path, body string) (*http.Response, string) {
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer t")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(data)
+	}
+
+	resp, body := do(http.MethodGet, "/users/john", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "hello john, Bearer t", body)
+	assert.Equal(t, "john", resp.Header.Get("X-User"))
+	assert.Empty(t, resp.Header.Get("Status"))
+	assert.Empty(t, resp.Header.Get("Internal"))
+
+	resp, body = do(http.MethodPost, "/users/john", "data")
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "data", body)
+
+	resp, err = http.Post(srv.URL+"/convert", "text/csv", strings.NewReader("a,b"))
+	require.NoError(t, err)
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, `"text/csv"`, string(data))
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+	resp, body = do(http.MethodPut, "/files/a/b.txt", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "a/b.txt", body)
+
+	resp, _ = do(http.MethodDelete, "/users/john", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	resp, _ = do(http.MethodGet, "/users", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	for _, path := range []string{"/users/a+b", "/users/a%00b", "/users/%ff"} {
+		resp, _ = do(http.MethodGet, path, "")
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, path)
+	}
+
+	resp, _ = do(http.MethodGet, "/slow", "")
+	assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+
+	resp, _ = do(http.MethodGet, "/none", "")
+	assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+
+	g.MaxBodySize = 2
+	resp, _ = do(http.MethodPost, "/users/john", "data")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/users/john", iotest.ErrReader(io.ErrUnexpectedEOF)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -2,23 +2,38 @@ package mqrr
 
 import "path"
 
-// RouterGroup is associated with a topic prefix.
+// RouterGroup is associated with a topic prefix and middlewares.
 // In the Route call, it joins all the topic levels to form a full topic.
 type RouterGroup struct {
-	engine *Engine
-	base   string
+	engine   *Engine
+	base     string
+	handlers HandlersChain
+}
+
+// Use adds middlewares to the group. They are applied to the routes
+// registered after this call, including those of the subgroups.
+func (g *RouterGroup) Use(middleware ...HandlerFunc) {
+	g.handlers = append(g.handlers, middleware...)
 }
 
 // Group creates a new router group with the given topic prefix.
+// The new group inherits the middlewares of this group.
 func (g *RouterGroup) Group(base string) *RouterGroup {
 	return &RouterGroup{
-		engine: g.engine,
-		base:   path.Join(g.base, base),
+		engine:   g.engine,
+		base:     path.Join(g.base, base),
+		handlers: g.combineHandlers(nil),
 	}
 }
 
 // Route registers a request handler with the given topic.
 // See Engine.Route for detail.
-func (g *RouterGroup) Route(topic string, handler func(c *Context)) {
-	g.engine.Route(path.Join(g.base, topic), handler)
+func (g *RouterGroup) Route(topic string, handler HandlerFunc, opts ...RouteOption) {
+	g.engine.addRoute(path.Join(g.base, topic), g.combineHandlers(nil), handler, opts)
+}
+
+func (g *RouterGroup) combineHandlers(handlers HandlersChain) HandlersChain {
+	merged := make(HandlersChain, 0, len(g.handlers)+len(handlers))
+	merged = append(merged, g.handlers...)
+	return append(merged, handlers...)
 }
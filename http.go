@@ -0,0 +1,133 @@
+package mqrr
+
+import (
+	"bytes"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+// MethodProperty is the user property carrying the HTTP method of a request
+// to a net/http handler route.
+const MethodProperty = "method"
+
+// RouteHTTP registers a net/http handler with the given topic.
+// The URL path of the request is the topic from the first param of the
+// route itself, the params of the group prefix are not part of it, e.g.
+// `/x/y` for `device/1/state/x/y` on the route `state/*path` of the group
+// `device/:id`. See WrapHTTP for how the request and response are mapped.
+func (g *RouterGroup) RouteHTTP(topic string, h http.Handler, opts ...RouteOption) {
+	prefix := path.Join(g.engine.BaseTopic, g.base)
+	skip := 0
+	if prefix != "" {
+		skip = strings.Count(prefix, "/") + 1
+	}
+	g.Route(topic, wrapHTTP(h, skip), opts...)
+}
+
+// WrapHTTP returns a handler running the net/http handler. The URL path of
+// the request is the topic from the first param of the route, including the
+// params of a group prefix, e.g. `/users/1` for `api/users/1` on the route
+// `api/*path`. The user properties become headers, the Content Type property
+// becomes the Content-Type header, and the method is taken from
+// MethodProperty, default is GET without payload and POST with payload.
+// The status, headers and body written by the handler become the status,
+// user properties and payload of the response, with the Content-Type header
+// as the Content Type property. The headers are sorted by key.
+func WrapHTTP(h http.Handler) HandlerFunc {
+	return wrapHTTP(h, 0)
+}
+
+// wrapHTTP is WrapHTTP taking the URL path from the first param after the
+// skipped levels of the route.
+func wrapHTTP(h http.Handler, skip int) HandlerFunc {
+	return func(c *Context) {
+		method := c.Property(MethodProperty)
+		if method == "" {
+			method = http.MethodGet
+			if len(c.Request.Payload) > 0 {
+				method = http.MethodPost
+			}
+		}
+		req, err := http.NewRequestWithContext(c.Context(), method, "/", bytes.NewReader(c.Request.Payload))
+		if err != nil {
+			c.Status(StatusBadRequest)
+			c.String("%v", err)
+			return
+		}
+		req.URL.Path = httpPath(c, skip)
+		req.RequestURI = req.URL.RequestURI()
+		if c.Request.Properties != nil {
+			for _, p := range c.Request.Properties.User {
+				if p.Key != MethodProperty {
+					req.Header.Add(p.Key, p.Value)
+				}
+			}
+			if c.Request.Properties.ContentType != "" {
+				req.Header.Set("Content-Type", c.Request.Properties.ContentType)
+			}
+		}
+		w := &responseWriter{header: make(http.Header)}
+		h.ServeHTTP(w, req)
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		c.Status(w.status)
+		c.Data(w.body.Bytes())
+		if contentType := w.header.Get("Content-Type"); contentType != "" {
+			c.SetContentType(contentType)
+			w.header.Del("Content-Type")
+		}
+		keys := make([]string, 0, len(w.header))
+		for key := range w.header {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			for _, value := range w.header[key] {
+				c.SetProperty(strings.ToLower(key), value)
+			}
+		}
+	}
+}
+
+// httpPath returns the URL path of the request to a net/http handler route,
+// from the first param after the skipped levels of the route.
+func httpPath(c *Context, skip int) string {
+	route := strings.Split(c.fullTopic, "/")
+	levels := strings.Split(c.Request.Topic, "/")
+	for i := skip; i < len(route); i++ {
+		if level := route[i]; level[0] == ':' || level[0] == '*' {
+			if i < len(levels) {
+				return "/" + strings.Join(levels[i:], "/")
+			}
+			break
+		}
+	}
+	return "/"
+}
+
+// responseWriter captures the response of a net/http handler.
+type responseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *responseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *responseWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.body.Write(data)
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
@@ -0,0 +1,75 @@
+package mqrr
+
+import (
+	"fmt"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestRouteHTTP(t *testing.T) {
+	r := New()
+	r.AccessLogger = nil
+	mux := http.NewServeMux()
+	mux.HandleFunc("/users/", func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		w.Header().Set("X-Method", req.Method)
+		w.Header().Set("X-B", "b")
+		w.Header().Set("X-A", "a")
+		w.Header().Set("Content-Type", req.Header.Get("Content-Type"))
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "%s %s %s", req.URL.Path, req.Header.Get("Authorization"), body)
+	})
+	r.RouteHTTP("api/*path", mux)
+	path := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.URL.Path))
+	})
+	device := r.Group("device/:id")
+	device.Route("state", WrapHTTP(path))
+	device.RouteHTTP("files/*path", path)
+	device.RouteHTTP("info", path)
+
+	request := func(topic, payload string, props paho.UserProperties) *paho.Publish {
+		w := &testPublisher{}
+		require.True(t, r.ServeMQTT(w, &paho.Publish{Topic: topic, Payload: []byte(payload), Properties: &paho.PublishProperties{
+			ResponseTopic: "client/responses",
+			ContentType:   "text/plain",
+			User:          props,
+		}}))
+		require.Len(t, w.replies, 1)
+		return w.replies[0]
+	}
+
+	resp := request("api/users/1", "data", paho.UserProperties{}.Add("authorization", "token").Add(MethodProperty, http.MethodPut))
+	assert.Equal(t, "201", resp.Properties.User.Get(StatusProperty))
+	assert.Equal(t, "PUT", resp.Properties.User.Get("x-method"))
+	assert.Equal(t, "/users/1 token data", string(resp.Payload))
+	assert.Equal(t, "text/plain", resp.Properties.ContentType)
+	assert.Empty(t, resp.Properties.User.Get("content-type"))
+	assert.Equal(t, paho.UserProperties{
+		{Key: StatusProperty, Value: "201"},
+		{Key: "x-a", Value: "a"},
+		{Key: "x-b", Value: "b"},
+		{Key: "x-method", Value: "PUT"},
+	}, resp.Properties.User)
+
+	resp = request("api/users/2", "", nil)
+	assert.Equal(t, "GET", resp.Properties.User.Get("x-method"))
+	resp = request("api/users/2", "x", nil)
+	assert.Equal(t, "POST", resp.Properties.User.Get("x-method"))
+
+	resp = request("api/other", "", nil)
+	assert.Equal(t, "404", resp.Properties.User.Get(StatusProperty))
+
+	resp = request("device/a b/state", "", nil)
+	assert.Equal(t, "200", resp.Properties.User.Get(StatusProperty))
+	assert.Equal(t, "/a b/state", string(resp.Payload))
+	// RouteHTTP starts the path at the params of the route, not of the group
+	resp = request("device/a/files/x/y", "", nil)
+	assert.Equal(t, "/x/y", string(resp.Payload))
+	resp = request("device/a/info", "", nil)
+	assert.Equal(t, "/", string(resp.Payload))
+}
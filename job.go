@@ -0,0 +1,298 @@
+package mqrr
+
+import (
+	"container/list"
+	"context"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/google/uuid"
+	"github.com/koho/mqrr/trace"
+	"path"
+	"sync"
+	"time"
+)
+
+// JobIDProperty is the user property carrying the job id in the response
+// of an async route.
+const JobIDProperty = "job-id"
+
+// JobStateProperty is the user property carrying the job state in the
+// response of a result query of a job which is not done.
+const JobStateProperty = "job-state"
+
+// jobParam is the topic parameter of the job id in the derived topics.
+const jobParam = "_job"
+
+// DefaultJobTTL is how long a memory job store keeps a job after it is saved.
+const DefaultJobTTL = time.Hour
+
+// States of a job.
+const (
+	JobPending = "pending"
+	JobRunning = "running"
+	JobDone    = "done"
+)
+
+// Job is the state of a handler running in the background for an async route.
+type Job struct {
+	ID      string    `json:"id"`
+	Route   string    `json:"route"`
+	Topic   string    `json:"topic"`
+	State   string    `json:"state"`
+	Status  int       `json:"status,omitempty"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+	// Result and Properties are the response of the finished handler.
+	Result     []byte              `json:"-"`
+	Properties paho.UserProperties `json:"-"`
+	// Owner is the authorization of the request starting the job. Only the
+	// requests with the same authorization can query the job.
+	Owner string `json:"-"`
+}
+
+// JobStore keeps the jobs of async routes. Implementations must be safe for concurrent use.
+type JobStore interface {
+	// Save creates or updates the job.
+	Save(job Job) error
+	// Load returns the job with the id.
+	Load(id string) (Job, bool, error)
+}
+
+type jobEntry struct {
+	job     Job
+	expires time.Time
+}
+
+// maxJobs bounds the jobs of the in-memory JobStore.
+const maxJobs = 10000
+
+// memoryJobStore is the in-memory JobStore. The jobs are kept in the order
+// they are saved, so the expired ones are swept from the front, and the
+// least recently saved one is evicted when the store is full.
+type memoryJobStore struct {
+	sync.Mutex
+	jobs  map[string]*list.Element
+	order *list.List
+	ttl   time.Duration
+}
+
+// NewMemoryJobStore returns a JobStore keeping up to 10000 jobs in memory.
+// A finished job is removed after the ttl, or DefaultJobTTL if ttl is not
+// positive. A pending or running job not saved again within the ttl is
+// considered lost and removed as well.
+func NewMemoryJobStore(ttl time.Duration) JobStore {
+	if ttl <= 0 {
+		ttl = DefaultJobTTL
+	}
+	return &memoryJobStore{jobs: make(map[string]*list.Element), order: list.New(), ttl: ttl}
+}
+
+func (s *memoryJobStore) Save(job Job) error {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	s.sweep(now)
+	if el, ok := s.jobs[job.ID]; ok {
+		s.remove(el)
+	}
+	for s.order.Len() >= maxJobs {
+		s.remove(s.order.Front())
+	}
+	e := &jobEntry{job: job, expires: now.Add(s.ttl)}
+	if job.State == JobDone {
+		e.expires = job.Updated.Add(s.ttl)
+	}
+	s.jobs[job.ID] = s.order.PushBack(e)
+	return nil
+}
+
+func (s *memoryJobStore) Load(id string) (Job, bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	el, ok := s.jobs[id]
+	if !ok {
+		return Job{}, false, nil
+	}
+	if e := el.Value.(*jobEntry); time.Now().Before(e.expires) {
+		return e.job, true, nil
+	}
+	s.remove(el)
+	return Job{}, false, nil
+}
+
+func (s *memoryJobStore) remove(el *list.Element) {
+	delete(s.jobs, el.Value.(*jobEntry).job.ID)
+	s.order.Remove(el)
+}
+
+// sweep removes the expired jobs at the front of the store.
+func (s *memoryJobStore) sweep(now time.Time) {
+	for el := s.order.Front(); el != nil && !now.Before(el.Value.(*jobEntry).expires); el = s.order.Front() {
+		s.remove(el)
+	}
+}
+
+// Async makes an async route for long-running handlers. The engine replies
+// at once with StatusAccepted and the job id in JobIDProperty, then runs the
+// handler in the background with a copy of the Context. Two routes are
+// derived from the topic of the route:
+//
+//	<topic>/jobs/<id>/status answers the Job in JSON
+//	<topic>/jobs/<id>/result answers the response of the finished handler
+//
+// They share the middlewares of the route.
+func Async() RouteOption {
+	return func(r *route) {
+		r.async = true
+	}
+}
+
+// jobStore returns the job store of the engine, a memory store by default.
+func (engine *Engine) jobStore() JobStore {
+	if engine.JobStore != nil {
+		return engine.JobStore
+	}
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+	if engine.defaultJobs == nil {
+		engine.defaultJobs = NewMemoryJobStore(0)
+	}
+	return engine.defaultJobs
+}
+
+// addJobRoutes registers the derived routes of an async route.
+func (engine *Engine) addJobRoutes(topic string, params map[string]int, handlers HandlersChain) {
+	for _, i := range params {
+		if i < 0 {
+			panic("an async route can not end with a multi-level wildcard")
+		}
+	}
+	engine.addRoute(path.Join(topic, "jobs", ":"+jobParam, "status"), handlers, engine.jobStatus, nil)
+	engine.addRoute(path.Join(topic, "jobs", ":"+jobParam, "result"), handlers, engine.jobResult, nil)
+}
+
+// startJob wraps the handler of an async route.
+func (engine *Engine) startJob(handler HandlerFunc) HandlerFunc {
+	return func(c *Context) {
+		now := time.Now()
+		job := Job{ID: uuid.NewString(), Route: c.FullTopic(), Topic: c.Request.Topic, State: JobPending, Created: now, Updated: now, Owner: requestOwner(c.Request)}
+		engine.mu.Lock()
+		if engine.jobsCtx == nil {
+			engine.jobsCtx, engine.cancelJobs = context.WithCancel(context.Background())
+		}
+		closed := engine.jobsCtx.Err() != nil
+		if !closed {
+			engine.jobs.Add(1)
+		}
+		engine.mu.Unlock()
+		if closed {
+			c.Status(StatusServiceUnavailable)
+			return
+		}
+		if err := engine.jobStore().Save(job); err != nil {
+			engine.jobs.Done()
+			engine.logger().Errorf("%v", err)
+			c.Status(StatusInternalServerError)
+			return
+		}
+		c.Status(StatusAccepted)
+		c.SetProperty(JobIDProperty, job.ID)
+		go engine.runJob(job, c.copy(engine.jobsCtx), handler)
+	}
+}
+
+func (engine *Engine) runJob(job Job, c *Context, handler HandlerFunc) {
+	defer engine.jobs.Done()
+	save := func() {
+		job.Updated = time.Now()
+		if err := engine.jobStore().Save(job); err != nil {
+			engine.logger().Errorf("%v", err)
+		}
+	}
+	defer func() {
+		if err := recover(); err != nil {
+			engine.logger().Errorf("%v", err)
+			internalError(c)
+		}
+		job.State = JobDone
+		job.Status = c.status
+		job.Result = c.response
+		job.Properties = c.properties
+		save()
+	}()
+	job.State = JobRunning
+	save()
+	handler(c)
+}
+
+// loadJob returns the job of the derived route, or replies StatusNotFound.
+// The job of another owner is not found either.
+func (engine *Engine) loadJob(c *Context) (Job, bool) {
+	job, ok, err := engine.jobStore().Load(c.Param(jobParam))
+	if err != nil {
+		engine.logger().Errorf("%v", err)
+		c.Status(StatusInternalServerError)
+		return job, false
+	}
+	// The job is only visible to its owner, on the topics derived from its request topic
+	if !ok || !sameOwner(job.Owner, requestOwner(c.Request)) ||
+		path.Join(job.Topic, "jobs", job.ID, path.Base(c.Request.Topic)) != c.Request.Topic {
+		c.Status(StatusNotFound)
+		return job, false
+	}
+	return job, true
+}
+
+func (engine *Engine) jobStatus(c *Context) {
+	if job, ok := engine.loadJob(c); ok {
+		c.JSON(job)
+	}
+}
+
+func (engine *Engine) jobResult(c *Context) {
+	job, ok := engine.loadJob(c)
+	if !ok {
+		return
+	}
+	if job.State != JobDone {
+		c.Status(StatusAccepted)
+		c.SetProperty(JobStateProperty, job.State)
+		return
+	}
+	c.Status(job.Status)
+	c.Data(job.Result)
+	for _, p := range job.Properties {
+		c.SetProperty(p.Key, p.Value)
+	}
+}
+
+// Copy returns a copy of the context which is safe to use after the handler
+// returns, e.g. in a goroutine. The copy carries the trace context, but is
+// not canceled with the request. Its handler chain is empty.
+func (c *Context) Copy() *Context {
+	return c.copy(context.Background())
+}
+
+// copy returns a copy of the context whose context.Context is derived from parent.
+func (c *Context) copy(parent context.Context) *Context {
+	cp := &Context{
+		Request:   c.Request,
+		Params:    c.Params,
+		status:    StatusOK,
+		fullTopic: c.fullTopic,
+		index:     abortIndex,
+		ctx:       parent,
+		engine:    c.engine,
+	}
+	if sc, ok := trace.SpanContextFromContext(c.Context()); ok {
+		cp.ctx = trace.ContextWithSpanContext(cp.ctx, sc)
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.Keys != nil {
+		cp.Keys = make(map[string]interface{}, len(c.Keys))
+		for k, v := range c.Keys {
+			cp.Keys[k] = v
+		}
+	}
+	return cp
+}
@@ -0,0 +1,155 @@
+package mqrr
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/koho/mqrr/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMemoryJobStore(t *testing.T) {
+	s := NewMemoryJobStore(time.Minute)
+	require.NoError(t, s.Save(Job{ID: "1", State: JobRunning}))
+	job, ok, err := s.Load("1")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, JobRunning, job.State)
+
+	require.NoError(t, s.Save(Job{ID: "1", State: JobDone, Updated: time.Now().Add(-time.Hour)}))
+	_, ok, _ = s.Load("1")
+	assert.False(t, ok)
+
+	// A job which is not saved again is lost after the ttl
+	s = NewMemoryJobStore(10 * time.Millisecond)
+	require.NoError(t, s.Save(Job{ID: "1", State: JobRunning}))
+	time.Sleep(20 * time.Millisecond)
+	_, ok, _ = s.Load("1")
+	assert.False(t, ok)
+
+	// The least recently saved job is evicted when the store is full
+	s = NewMemoryJobStore(time.Minute)
+	for i := 0; i <= maxJobs; i++ {
+		require.NoError(t, s.Save(Job{ID: strconv.Itoa(i), State: JobPending}))
+	}
+	assert.Equal(t, maxJobs, s.(*memoryJobStore).order.Len())
+	_, ok, _ = s.Load("0")
+	assert.False(t, ok)
+	_, ok, _ = s.Load(strconv.Itoa(maxJobs))
+	assert.True(t, ok)
+}
+
+func TestEngineAsync(t *testing.T) {
+	r := New()
+	r.AccessLogger = nil
+	release := make(chan struct{})
+	r.Route("device/:id/firmware", func(c *Context) {
+		<-release
+		c.SetProperty("version", "2.0")
+		c.String("updated %s", c.Param("id"))
+	}, Async())
+	assert.Contains(t, r.routes, "device/:id/firmware/jobs/:_job/status")
+	assert.Contains(t, r.routes, "device/:id/firmware/jobs/:_job/result")
+	assert.Panics(t, func() { r.Route("files/*path", func(c *Context) {}, Async()) })
+
+	doAs := func(topic, token string) *paho.Publish {
+		w := &testPublisher{}
+		require.True(t, r.ServeMQTT(w, &paho.Publish{Topic: topic, Properties: &paho.PublishProperties{
+			ResponseTopic:   "client/responses",
+			CorrelationData: []byte(topic + token),
+			User:            paho.UserProperties{}.Add(authorizationProperty, token),
+		}}))
+		require.Len(t, w.replies, 1)
+		return w.replies[0]
+	}
+	do := func(topic string) *paho.Publish {
+		return doAs(topic, "Bearer owner")
+	}
+	status := func(resp *paho.Publish) int {
+		code, _ := strconv.Atoi(resp.Properties.User.Get(StatusProperty))
+		return code
+	}
+	resp := do("device/1/firmware")
+	assert.Equal(t, StatusAccepted, status(resp))
+	id := resp.Properties.User.Get(JobIDProperty)
+	require.NotEmpty(t, id)
+
+	resp = do("device/1/firmware/jobs/" + id + "/result")
+	assert.Equal(t, StatusAccepted, status(resp))
+	assert.Contains(t, []string{JobPending, JobRunning}, resp.Properties.User.Get(JobStateProperty))
+	// A job is not visible from the topics of other requests
+	assert.Equal(t, StatusNotFound, status(do("device/2/firmware/jobs/"+id+"/status")))
+	assert.Equal(t, StatusNotFound, status(do("device/1/firmware/jobs/unknown/status")))
+	// A job is only visible to the sender of its request
+	assert.Equal(t, StatusNotFound, status(doAs("device/1/firmware/jobs/"+id+"/status", "Bearer other")))
+	assert.Equal(t, StatusNotFound, status(doAs("device/1/firmware/jobs/"+id+"/result", "")))
+
+	close(release)
+	require.Eventually(t, func() bool {
+		var job Job
+		resp := do("device/1/firmware/jobs/" + id + "/status")
+		return json.Unmarshal(resp.Payload, &job) == nil && job.State == JobDone
+	}, time.Second, 10*time.Millisecond)
+	resp = do("device/1/firmware/jobs/" + id + "/result")
+	assert.Equal(t, StatusOK, status(resp))
+	assert.Equal(t, "updated 1", string(resp.Payload))
+	assert.Equal(t, "2.0", resp.Properties.User.Get("version"))
+}
+
+func TestEngineAsyncClose(t *testing.T) {
+	r := New()
+	r.AccessLogger = nil
+	r.JobStore = NewMemoryJobStore(0)
+	canceled := make(chan struct{})
+	r.Route("device/:id/firmware", func(c *Context) {
+		<-c.Context().Done()
+		close(canceled)
+	}, Async())
+	r.JobStore = nil
+
+	do := func() int {
+		w := &testPublisher{}
+		require.True(t, r.ServeMQTT(w, &paho.Publish{Topic: "device/1/firmware", Properties: &paho.PublishProperties{
+			ResponseTopic:   "client/responses",
+			CorrelationData: []byte("1"),
+		}}))
+		require.Len(t, w.replies, 1)
+		code, _ := strconv.Atoi(w.replies[0].Properties.User.Get(StatusProperty))
+		return code
+	}
+	assert.Equal(t, StatusAccepted, do())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, r.Close(ctx))
+	select {
+	case <-canceled:
+	default:
+		t.Fatal("job not canceled")
+	}
+	assert.Equal(t, StatusServiceUnavailable, do())
+
+	// The connection is closed even if the jobs do not exit in time
+	r = New()
+	r.AccessLogger = nil
+	release := make(chan struct{})
+	defer close(release)
+	r.Route("device/:id/firmware", func(c *Context) {
+		<-release
+	}, Async())
+	tr := transport.NewLoopback()
+	require.NoError(t, r.Start(tr))
+	assert.Equal(t, StatusAccepted, do())
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, r.Close(ctx), context.DeadlineExceeded)
+	select {
+	case <-tr.Done():
+	default:
+		t.Fatal("connection not closed")
+	}
+}
@@ -0,0 +1,191 @@
+package mqrr
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Error codes of JSON-RPC 2.0.
+const (
+	RPCParseError     = -32700
+	RPCInvalidRequest = -32600
+	RPCMethodNotFound = -32601
+	RPCInvalidParams  = -32602
+	RPCInternalError  = -32603
+	// RPCServerError is the code of the other failures of a route. The
+	// status of the route is in the data of the error.
+	RPCServerError = -32000
+)
+
+// Defaults of the batch limits of the engine.
+const (
+	DefaultMaxBatchSize = 100
+	DefaultBatchWorkers = 8
+)
+
+// RPCRequest is a JSON-RPC 2.0 request. A request without id is a notification.
+type RPCRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"`
+}
+
+// RPCResponse is a JSON-RPC 2.0 response.
+type RPCResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *RPCError       `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// RPCError is a JSON-RPC 2.0 error object.
+type RPCError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func (e *RPCError) Error() string {
+	return e.Message
+}
+
+// RPCErrorData is the data of the error of a failed route.
+type RPCErrorData struct {
+	Status  int    `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// JSONRPC registers a route on the topic carrying JSON-RPC 2.0 requests,
+// including batches. The method of a request is the topic of the route to
+// run, relative to the BaseTopic, and the params are its payload. The
+// response of the route becomes the result, or an error object if its status
+// is not 2xx. Notifications run without a response.
+func (engine *Engine) JSONRPC(topic string, opts ...RouteOption) {
+	engine.Route(topic, engine.serveJSONRPC, append(opts, envelope)...)
+}
+
+func (engine *Engine) serveJSONRPC(c *Context) {
+	payload := bytes.TrimSpace(c.GetRawData())
+	if len(payload) > 0 && payload[0] == '[' {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(payload, &batch); err != nil {
+			c.JSON(rpcError(nil, RPCParseError, "Parse error"))
+			return
+		}
+		if len(batch) == 0 || len(batch) > engine.maxBatchSize() {
+			c.JSON(rpcError(nil, RPCInvalidRequest, "Invalid Request"))
+			return
+		}
+		responses := make([]*RPCResponse, len(batch))
+		engine.runBatch(len(batch), func(i int) {
+			responses[i] = engine.callJSONRPC(c, batch[i])
+		})
+		results := make([]*RPCResponse, 0, len(responses))
+		for _, resp := range responses {
+			if resp != nil {
+				results = append(results, resp)
+			}
+		}
+		if len(results) == 0 {
+			c.noReply = true
+			return
+		}
+		c.JSON(results)
+		return
+	}
+	var request json.RawMessage
+	if err := json.Unmarshal(payload, &request); err != nil {
+		c.JSON(rpcError(nil, RPCParseError, "Parse error"))
+		return
+	}
+	if resp := engine.callJSONRPC(c, request); resp != nil {
+		c.JSON(resp)
+	} else {
+		c.noReply = true
+	}
+}
+
+func (engine *Engine) maxBatchSize() int {
+	if engine.MaxBatchSize > 0 {
+		return engine.MaxBatchSize
+	}
+	return DefaultMaxBatchSize
+}
+
+// runBatch calls fn for each call of a batch, with at most BatchWorkers
+// calls running at once, and waits for them.
+func (engine *Engine) runBatch(n int, fn func(i int)) {
+	workers := engine.BatchWorkers
+	if workers <= 0 {
+		workers = DefaultBatchWorkers
+	}
+	if workers > n {
+		workers = n
+	}
+	var wg sync.WaitGroup
+	calls := make(chan int)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range calls {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		calls <- i
+	}
+	close(calls)
+	wg.Wait()
+}
+
+// callJSONRPC runs a request of the envelope. It returns nil for a notification.
+func (engine *Engine) callJSONRPC(c *Context, raw json.RawMessage) *RPCResponse {
+	var req RPCRequest
+	if err := json.Unmarshal(raw, &req); err != nil {
+		return rpcError(nil, RPCInvalidRequest, "Invalid Request")
+	}
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		return rpcError(req.ID, RPCInvalidRequest, "Invalid Request")
+	}
+	var ic *Context
+	if !strings.HasPrefix(req.Method, "rpc.") && !strings.ContainsAny(req.Method, "+#") {
+		ic = engine.dispatch(c, path.Join(engine.BaseTopic, req.Method), req.Params, nil)
+	}
+	if req.ID == nil {
+		return nil
+	}
+	if ic == nil {
+		return rpcError(req.ID, RPCMethodNotFound, "Method not found")
+	}
+	if ic.status < 200 || ic.status > 299 {
+		resp := rpcError(req.ID, RPCServerError, http.StatusText(ic.status))
+		switch ic.status {
+		case StatusBadRequest:
+			resp.Error.Code, resp.Error.Message = RPCInvalidParams, "Invalid params"
+		case StatusNotFound:
+			resp.Error.Code, resp.Error.Message = RPCMethodNotFound, "Method not found"
+		case StatusInternalServerError:
+			resp.Error.Code, resp.Error.Message = RPCInternalError, "Internal error"
+		}
+		resp.Error.Data = RPCErrorData{Status: ic.status, Message: string(ic.response)}
+		return resp
+	}
+	result := json.RawMessage(ic.response)
+	if len(bytes.TrimSpace(result)) == 0 {
+		result = json.RawMessage("null")
+	} else if !json.Valid(result) {
+		result, _ = json.Marshal(string(ic.response))
+	}
+	return &RPCResponse{JSONRPC: "2.0", Result: result, ID: req.ID}
+}
+
+func rpcError(id json.RawMessage, code int, message string) *RPCResponse {
+	return &RPCResponse{JSONRPC: "2.0", Error: &RPCError{Code: code, Message: message}, ID: id}
+}
@@ -0,0 +1,125 @@
+package mqrr
+
+import (
+	"encoding/json"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newRPCEngine() *Engine {
+	r := New()
+	r.AccessLogger = nil
+	r.BaseTopic = "app"
+	r.JSONRPC("rpc")
+	r.Route("math/add", func(c *Context) {
+		var args []int
+		if err := json.Unmarshal(c.GetRawData(), &args); err != nil || len(args) != 2 {
+			c.Status(StatusBadRequest)
+			return
+		}
+		c.JSON(args[0] + args[1])
+	})
+	r.Route("user/:name", func(c *Context) {
+		c.String("hello %s, %s", c.Param("name"), c.Property("authorization"))
+	})
+	r.Route("fail", func(c *Context) { c.Status(StatusForbidden) })
+	return r
+}
+
+func rpc(t *testing.T, r *Engine, payload string) *paho.Publish {
+	w := &testPublisher{}
+	require.True(t, r.ServeMQTT(w, &paho.Publish{Topic: "app/rpc", Payload: []byte(payload), Properties: &paho.PublishProperties{
+		ResponseTopic:   "client/responses",
+		CorrelationData: []byte("1"),
+		User:            paho.UserProperties{}.Add("authorization", "token"),
+	}}))
+	if len(w.replies) == 0 {
+		return nil
+	}
+	return w.replies[0]
+}
+
+func TestJSONRPC(t *testing.T) {
+	r := newRPCEngine()
+	resp := rpc(t, r, `{"jsonrpc":"2.0","method":"math/add","params":[1,2],"id":1}`)
+	assert.JSONEq(t, `{"jsonrpc":"2.0","result":3,"id":1}`, string(resp.Payload))
+
+	resp = rpc(t, r, `{"jsonrpc":"2.0","method":"user/john","id":"a"}`)
+	assert.JSONEq(t, `{"jsonrpc":"2.0","result":"hello john, token","id":"a"}`, string(resp.Payload))
+
+	resp = rpc(t, r, `{"jsonrpc":"2.0","method":"math/add","params":[1],"id":2}`)
+	assert.JSONEq(t, `{"jsonrpc":"2.0","error":{"code":-32602,"message":"Invalid params","data":{"status":400}},"id":2}`, string(resp.Payload))
+
+	resp = rpc(t, r, `{"jsonrpc":"2.0","method":"fail","id":3}`)
+	assert.JSONEq(t, `{"jsonrpc":"2.0","error":{"code":-32000,"message":"Forbidden","data":{"status":403}},"id":3}`, string(resp.Payload))
+
+	resp = rpc(t, r, `{"jsonrpc":"2.0","method":"none","id":4}`)
+	assert.JSONEq(t, `{"jsonrpc":"2.0","error":{"code":-32601,"message":"Method not found"},"id":4}`, string(resp.Payload))
+
+	resp = rpc(t, r, `{"jsonrpc":"2.0","method":"rpc","id":5}`)
+	assert.JSONEq(t, `{"jsonrpc":"2.0","error":{"code":-32601,"message":"Method not found"},"id":5}`, string(resp.Payload))
+
+	resp = rpc(t, r, `{"jsonrpc":"2.0","method":"math/add","params":"bar","baz]`)
+	assert.JSONEq(t, `{"jsonrpc":"2.0","error":{"code":-32700,"message":"Parse error"},"id":null}`, string(resp.Payload))
+
+	resp = rpc(t, r, `{"jsonrpc":"1.0","method":"math/add","id":6}`)
+	assert.JSONEq(t, `{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":6}`, string(resp.Payload))
+
+	assert.Nil(t, rpc(t, r, `{"jsonrpc":"2.0","method":"math/add","params":[1,2]}`))
+}
+
+func TestJSONRPCBatch(t *testing.T) {
+	r := newRPCEngine()
+	resp := rpc(t, r, `[
+		{"jsonrpc":"2.0","method":"math/add","params":[1,2],"id":1},
+		{"jsonrpc":"2.0","method":"math/add","params":[3,4]},
+		{"foo":"boo"},
+		{"jsonrpc":"2.0","method":"user/jane","id":2}
+	]`)
+	assert.JSONEq(t, `[
+		{"jsonrpc":"2.0","result":3,"id":1},
+		{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":null},
+		{"jsonrpc":"2.0","result":"hello jane, token","id":2}
+	]`, string(resp.Payload))
+
+	resp = rpc(t, r, `[]`)
+	assert.JSONEq(t, `{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":null}`, string(resp.Payload))
+
+	resp = rpc(t, r, `[1]`)
+	assert.JSONEq(t, `[{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":null}]`, string(resp.Payload))
+
+	assert.Nil(t, rpc(t, r, `[{"jsonrpc":"2.0","method":"math/add","params":[1,2]}]`))
+}
+
+func TestJSONRPCBatchLimits(t *testing.T) {
+	r := newRPCEngine()
+	r.MaxBatchSize = 3
+	r.BatchWorkers = 2
+	var running, peak int32
+	r.Route("slow", func(c *Context) {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		c.JSON(true)
+	})
+	call := `{"jsonrpc":"2.0","method":"slow","id":1}`
+	resp := rpc(t, r, "["+strings.Repeat(call+",", 3)+call+"]")
+	assert.JSONEq(t, `{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":null}`, string(resp.Payload))
+
+	resp = rpc(t, r, "["+strings.Repeat(call+",", 2)+call+"]")
+	var results []RPCResponse
+	require.NoError(t, json.Unmarshal(resp.Payload, &results))
+	assert.Len(t, results, 3)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&peak))
+}
@@ -10,6 +10,20 @@ import (
 
 var log = logrus.New()
 
+// Logger is the logging interface of an engine. A *logrus.Logger satisfies it,
+// see also LogrusLogger and SlogLogger.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// LogrusLogger adapts a logrus logger or entry to the Logger interface.
+func LogrusLogger(l logrus.FieldLogger) Logger {
+	return l
+}
+
 // LogDisableColors disables the color of the log output.
 var LogDisableColors = false
 
@@ -28,13 +42,25 @@ func SetLogFormatter(formatter logrus.Formatter) {
 	log.SetFormatter(formatter)
 }
 
-func debugPrint(format string, values ...interface{}) {
-	if IsDebugging() {
-		if !strings.HasSuffix(format, "\n") {
-			format += "\n"
-		}
-		fmt.Fprintf(log.Out, "[MQRR] "+format, values...)
+// logger returns the logger of the engine, default is the mqrr log.
+func (engine *Engine) logger() Logger {
+	if engine.Logger != nil {
+		return engine.Logger
+	}
+	return log
+}
+
+// debugPrint writes the debug message in debug mode. Without a Logger of the
+// engine, it writes to the mqrr log output directly.
+func (engine *Engine) debugPrint(format string, values ...interface{}) {
+	if !engine.IsDebugging() {
+		return
+	}
+	if engine.Logger == nil {
+		fmt.Fprintf(log.Out, "[MQRR] "+strings.TrimSuffix(format, "\n")+"\n", values...)
+		return
 	}
+	engine.Logger.Debugf(format, values...)
 }
 
 // textFormatter is the default log formatter of mqrr.
@@ -0,0 +1,18 @@
+//go:build go1.21
+
+package mqrr
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"testing"
+)
+
+func TestSlogLogger(t *testing.T) {
+	var b bytes.Buffer
+	l := SlogLogger(slog.New(slog.NewTextHandler(&b, nil)))
+	l.Warnf("hello %s", "world")
+	assert.Contains(t, b.String(), "level=WARN")
+	assert.Contains(t, b.String(), `msg="hello world"`)
+}
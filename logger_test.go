@@ -0,0 +1,81 @@
+package mqrr
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/koho/mqrr/transport"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+type recordLogger struct {
+	lines []string
+}
+
+func (l *recordLogger) Debugf(format string, args ...interface{}) {
+	l.lines = append(l.lines, "DEBUG "+fmt.Sprintf(format, args...))
+}
+
+func (l *recordLogger) Infof(format string, args ...interface{}) {
+	l.lines = append(l.lines, "INFO "+fmt.Sprintf(format, args...))
+}
+
+func (l *recordLogger) Warnf(format string, args ...interface{}) {
+	l.lines = append(l.lines, "WARN "+fmt.Sprintf(format, args...))
+}
+
+func (l *recordLogger) Errorf(format string, args ...interface{}) {
+	l.lines = append(l.lines, "ERROR "+fmt.Sprintf(format, args...))
+}
+
+func TestEngineLogger(t *testing.T) {
+	l1, l2 := &recordLogger{}, &recordLogger{}
+	r1, r2 := New(), New()
+	r1.Logger, r2.Logger = l1, l2
+	r1.Route("a", func(c *Context) {})
+	r2.Route("b", func(c *Context) { c.Logger().Warnf("from handler") })
+
+	r1.handleRequest(nil, buildContext(&paho.Publish{Topic: "a"}, nil), r1.routes["a"])
+	r2.handleRequest(nil, buildContext(&paho.Publish{Topic: "b"}, nil), r2.routes["b"])
+	assert.Len(t, l1.lines, 1)
+	assert.Contains(t, l1.lines[0], `INFO `)
+	assert.Contains(t, l1.lines[0], `"a"`)
+	assert.Equal(t, "WARN from handler", l2.lines[0])
+}
+
+func TestEngineMode(t *testing.T) {
+	l := &recordLogger{}
+	r := New()
+	r.Logger = l
+	assert.Equal(t, IsDebugging(), r.IsDebugging())
+	r.SetMode(ReleaseMode)
+	assert.False(t, r.IsDebugging())
+	r.debugPrint("hidden")
+	r.SetMode(DebugMode)
+	assert.True(t, r.IsDebugging())
+	r.debugPrint("shown %d", 1)
+	assert.Equal(t, []string{"DEBUG shown 1"}, l.lines)
+
+	// The routes and the transport are listed at start
+	l.lines = nil
+	r.Route("a", func(c *Context) {})
+	tr := transport.NewLoopback()
+	defer tr.Disconnect(context.Background())
+	require.NoError(t, r.Start(tr))
+	require.Len(t, l.lines, 2)
+	assert.Contains(t, l.lines[0], "DEBUG a ")
+	assert.Equal(t, "DEBUG Listening requests on loopback", l.lines[1])
+	assert.Panics(t, func() { r.SetMode("unknown") })
+}
+
+func TestLogrusLogger(t *testing.T) {
+	var b bytes.Buffer
+	l := logrus.New()
+	l.SetOutput(&b)
+	LogrusLogger(l).Warnf("hello %s", "world")
+	assert.Contains(t, b.String(), "hello world")
+}
@@ -0,0 +1,41 @@
+// Package metrics defines the metrics hook of the engine and the client,
+// along with a Prometheus adapter.
+package metrics
+
+import "time"
+
+// Reasons of dropped requests.
+const (
+	ReasonBlocked   = "blocked"
+	ReasonCanceled  = "canceled"
+	ReasonDuplicate = "duplicate"
+	ReasonExpired   = "expired"
+	ReasonPanic     = "panic"
+	ReasonTimeout   = "timeout"
+)
+
+// Recorder receives the metrics of an engine or a client.
+// Implementations must be safe for concurrent use.
+type Recorder interface {
+	// ObserveRequest records a completed request with its route pattern, or
+	// the topic in a client, along with the response status and latency.
+	// The status is zero if no response is received.
+	ObserveRequest(route string, status int, latency time.Duration)
+	// AddInFlight adds delta to the number of running handlers.
+	AddInFlight(delta int)
+	// DropRequest records a request which is not answered for the reason.
+	DropRequest(reason string)
+	// PublishFailed records a failed publish of a request or response.
+	PublishFailed()
+	// AddPending adds delta to the number of correlations waiting for a response in a client.
+	AddPending(delta int)
+}
+
+// Nop is a Recorder discarding all the metrics.
+type Nop struct{}
+
+func (Nop) ObserveRequest(string, int, time.Duration) {}
+func (Nop) AddInFlight(int)                           {}
+func (Nop) DropRequest(string)                        {}
+func (Nop) PublishFailed()                            {}
+func (Nop) AddPending(int)                            {}
@@ -0,0 +1,172 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are the latency histogram buckets in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type requestKey struct {
+	route  string
+	status int
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Prometheus is a Recorder collecting the metrics in memory. It serves them
+// in the Prometheus text exposition format as a http.Handler, so that it can
+// be scraped without extra dependencies.
+type Prometheus struct {
+	sync.Mutex
+	namespace     string
+	buckets       []float64
+	requests      map[requestKey]uint64
+	latency       map[string]*histogram
+	dropped       map[string]uint64
+	inFlight      int64
+	pending       int64
+	publishErrors uint64
+}
+
+// NewPrometheus creates a Prometheus recorder. The namespace prefixes all
+// the metric names, e.g. `mqrr` or `mqrr_client`.
+func NewPrometheus(namespace string) *Prometheus {
+	return &Prometheus{
+		namespace: namespace,
+		buckets:   DefaultBuckets,
+		requests:  make(map[requestKey]uint64),
+		latency:   make(map[string]*histogram),
+		dropped:   make(map[string]uint64),
+	}
+}
+
+func (p *Prometheus) ObserveRequest(route string, status int, latency time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+	p.requests[requestKey{route, status}]++
+	h, ok := p.latency[route]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(p.buckets))}
+		p.latency[route] = h
+	}
+	seconds := latency.Seconds()
+	for i, le := range p.buckets {
+		if seconds <= le {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+func (p *Prometheus) AddInFlight(delta int) {
+	p.Lock()
+	defer p.Unlock()
+	p.inFlight += int64(delta)
+}
+
+func (p *Prometheus) DropRequest(reason string) {
+	p.Lock()
+	defer p.Unlock()
+	p.dropped[reason]++
+}
+
+func (p *Prometheus) PublishFailed() {
+	p.Lock()
+	defer p.Unlock()
+	p.publishErrors++
+}
+
+func (p *Prometheus) AddPending(delta int) {
+	p.Lock()
+	defer p.Unlock()
+	p.pending += int64(delta)
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format.
+func (p *Prometheus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	p.WriteTo(w)
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format.
+func (p *Prometheus) WriteTo(w io.Writer) (int64, error) {
+	p.Lock()
+	defer p.Unlock()
+	var b strings.Builder
+	name := func(s string) string {
+		if p.namespace == "" {
+			return s
+		}
+		return p.namespace + "_" + s
+	}
+
+	metric := name("requests_total")
+	fmt.Fprintf(&b, "# HELP %s Number of handled requests by route and status.\n# TYPE %s counter\n", metric, metric)
+	keys := make([]requestKey, 0, len(p.requests))
+	for k := range p.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		}
+		return keys[i].status < keys[j].status
+	})
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s{route=%s,status=\"%d\"} %d\n", metric, quote(k.route), k.status, p.requests[k])
+	}
+
+	metric = name("request_duration_seconds")
+	fmt.Fprintf(&b, "# HELP %s Latency of handled requests by route.\n# TYPE %s histogram\n", metric, metric)
+	for _, route := range sortedKeys(p.latency) {
+		h := p.latency[route]
+		for i, le := range p.buckets {
+			fmt.Fprintf(&b, "%s_bucket{route=%s,le=\"%s\"} %d\n", metric, quote(route), strconv.FormatFloat(le, 'g', -1, 64), h.counts[i])
+		}
+		fmt.Fprintf(&b, "%s_bucket{route=%s,le=\"+Inf\"} %d\n", metric, quote(route), h.count)
+		fmt.Fprintf(&b, "%s_sum{route=%s} %s\n", metric, quote(route), strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(&b, "%s_count{route=%s} %d\n", metric, quote(route), h.count)
+	}
+
+	metric = name("dropped_requests_total")
+	fmt.Fprintf(&b, "# HELP %s Number of requests not answered by reason.\n# TYPE %s counter\n", metric, metric)
+	for _, reason := range sortedKeys(p.dropped) {
+		fmt.Fprintf(&b, "%s{reason=%s} %d\n", metric, quote(reason), p.dropped[reason])
+	}
+
+	metric = name("in_flight_requests")
+	fmt.Fprintf(&b, "# HELP %s Number of running handlers.\n# TYPE %s gauge\n%s %d\n", metric, metric, metric, p.inFlight)
+	metric = name("publish_errors_total")
+	fmt.Fprintf(&b, "# HELP %s Number of failed publishes.\n# TYPE %s counter\n%s %d\n", metric, metric, metric, p.publishErrors)
+	metric = name("pending_correlations")
+	fmt.Fprintf(&b, "# HELP %s Number of requests waiting for a response.\n# TYPE %s gauge\n%s %d\n", metric, metric, metric, p.pending)
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
@@ -0,0 +1,38 @@
+package metrics
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPrometheus(t *testing.T) {
+	p := NewPrometheus("mqrr")
+	p.ObserveRequest("user/:name", 200, 20*time.Millisecond)
+	p.ObserveRequest("user/:name", 200, 2*time.Second)
+	p.ObserveRequest("user/:name", 429, time.Millisecond)
+	p.AddInFlight(2)
+	p.AddInFlight(-1)
+	p.DropRequest(ReasonDuplicate)
+	p.PublishFailed()
+	p.AddPending(3)
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	assert.Contains(t, w.Header().Get("Content-Type"), "text/plain")
+	assert.Contains(t, body, `mqrr_requests_total{route="user/:name",status="200"} 2`)
+	assert.Contains(t, body, `mqrr_requests_total{route="user/:name",status="429"} 1`)
+	assert.Contains(t, body, `mqrr_request_duration_seconds_bucket{route="user/:name",le="0.025"} 2`)
+	assert.Contains(t, body, `mqrr_request_duration_seconds_bucket{route="user/:name",le="+Inf"} 3`)
+	assert.Contains(t, body, `mqrr_request_duration_seconds_count{route="user/:name"} 3`)
+	assert.Contains(t, body, `mqrr_dropped_requests_total{reason="duplicate"} 1`)
+	assert.Contains(t, body, "mqrr_in_flight_requests 1\n")
+	assert.Contains(t, body, "mqrr_publish_errors_total 1\n")
+	assert.Contains(t, body, "mqrr_pending_correlations 3\n")
+}
+
+func TestQuote(t *testing.T) {
+	assert.Equal(t, `"a\"b\\c\n"`, quote("a\"b\\c\n"))
+}
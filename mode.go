@@ -33,3 +33,22 @@ func SetMode(value string) {
 func IsDebugging() bool {
 	return mode == debugCode
 }
+
+// SetMode sets the running mode of the engine, overriding the mode set by
+// the SetMode function. An empty value restores the package mode.
+func (engine *Engine) SetMode(value string) {
+	switch value {
+	case "", DebugMode, ReleaseMode:
+		engine.mode = value
+	default:
+		panic("mode unknown: " + value)
+	}
+}
+
+// IsDebugging returns true if the engine is running in debug mode.
+func (engine *Engine) IsDebugging() bool {
+	if engine.mode == "" {
+		return IsDebugging()
+	}
+	return engine.mode == DebugMode
+}
@@ -0,0 +1,104 @@
+// Package mqrrtest provides utilities for testing mqrr routes without a broker.
+package mqrrtest
+
+import (
+	"context"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/google/uuid"
+	"github.com/koho/mqrr"
+	"strconv"
+	"sync"
+)
+
+// ResponseTopic is the response topic of requests built by NewRequest.
+const ResponseTopic = "mqrrtest/responses"
+
+// ResponseRecorder is an mqrr.Publisher that records the replies published by the engine.
+type ResponseRecorder struct {
+	// Request is the request handled by the engine.
+	Request *paho.Publish
+	// Replies holds every reply in publish order.
+	Replies []*paho.Publish
+	// Matched reports whether any route matched the request.
+	Matched bool
+
+	mu sync.Mutex
+}
+
+// NewRecorder returns an initialized ResponseRecorder.
+func NewRecorder() *ResponseRecorder {
+	return &ResponseRecorder{}
+}
+
+// Publish implements mqrr.Publisher.
+func (rec *ResponseRecorder) Publish(_ context.Context, p *paho.Publish) (*paho.PublishResponse, error) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.Replies = append(rec.Replies, p)
+	return &paho.PublishResponse{}, nil
+}
+
+// Replied reports whether a reply was published.
+func (rec *ResponseRecorder) Replied() bool {
+	return rec.Result() != nil
+}
+
+// Result returns the last published reply, or nil if there is none.
+func (rec *ResponseRecorder) Result() *paho.Publish {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if len(rec.Replies) == 0 {
+		return nil
+	}
+	return rec.Replies[len(rec.Replies)-1]
+}
+
+// Payload returns the payload of the reply.
+func (rec *ResponseRecorder) Payload() []byte {
+	if r := rec.Result(); r != nil {
+		return r.Payload
+	}
+	return nil
+}
+
+// Status returns the status code of the reply, or 0 if there is no reply.
+func (rec *ResponseRecorder) Status() int {
+	status, _ := strconv.Atoi(rec.Property(mqrr.StatusProperty))
+	return status
+}
+
+// Property returns the user property of the reply with the given key.
+func (rec *ResponseRecorder) Property(key string) string {
+	if r := rec.Result(); r != nil && r.Properties != nil {
+		return r.Properties.User.Get(key)
+	}
+	return ""
+}
+
+// NewRequest returns a request publish for the topic, carrying a response
+// topic, a unique correlation data and the given user properties.
+func NewRequest(topic string, payload []byte, props ...paho.UserProperty) *paho.Publish {
+	return &paho.Publish{
+		Topic:   topic,
+		Payload: payload,
+		Properties: &paho.PublishProperties{
+			ResponseTopic:   ResponseTopic,
+			CorrelationData: []byte(uuid.NewString()),
+			User:            append(paho.UserProperties{}, props...),
+		},
+	}
+}
+
+// Do sends a request built by NewRequest to the engine and records the replies.
+func Do(engine *mqrr.Engine, topic string, payload []byte, props ...paho.UserProperty) *ResponseRecorder {
+	return DoRequest(engine, NewRequest(topic, payload, props...))
+}
+
+// DoRequest sends the request to the engine and records the replies.
+// The handlers run in the calling goroutine.
+func DoRequest(engine *mqrr.Engine, request *paho.Publish) *ResponseRecorder {
+	rec := NewRecorder()
+	rec.Request = request
+	rec.Matched = engine.ServeMQTT(rec, request)
+	return rec
+}
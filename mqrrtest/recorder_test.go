@@ -0,0 +1,72 @@
+package mqrrtest
+
+import (
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/koho/mqrr"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDo(t *testing.T) {
+	r := mqrr.New()
+	r.AccessLogger = nil
+	r.Route("user/:name", func(c *mqrr.Context) {
+		c.SetProperty("greeting", "hello")
+		c.String("%s:%s", c.Param("name"), c.Property("lang"))
+	})
+	rec := Do(r, "user/john", nil, paho.UserProperty{Key: "lang", Value: "en"})
+	assert.True(t, rec.Matched)
+	assert.True(t, rec.Replied())
+	assert.Equal(t, mqrr.StatusOK, rec.Status())
+	assert.Equal(t, "john:en", string(rec.Payload()))
+	assert.Equal(t, "hello", rec.Property("greeting"))
+	assert.Equal(t, ResponseTopic, rec.Result().Topic)
+	assert.Equal(t, rec.Request.Properties.CorrelationData, rec.Result().Properties.CorrelationData)
+}
+
+func TestDoReplyStore(t *testing.T) {
+	r := mqrr.New()
+	r.AccessLogger = nil
+	r.ReplyStore = mqrr.NewMemoryReplyStore()
+	calls := 0
+	r.Route("counter", func(c *mqrr.Context) {
+		calls++
+		c.String("%d", calls)
+	})
+	assert.Equal(t, "1", string(Do(r, "counter", nil).Payload()))
+	assert.Equal(t, "2", string(Do(r, "counter", nil).Payload()))
+}
+
+func TestDoStatus(t *testing.T) {
+	r := mqrr.New()
+	r.AccessLogger = nil
+	r.Use(func(c *mqrr.Context) {
+		if c.Property("authorization") == "" {
+			c.Status(mqrr.StatusUnauthorized)
+			c.Abort()
+		}
+	})
+	r.Route("user/:name", func(c *mqrr.Context) {})
+	rec := Do(r, "user/john", nil)
+	assert.Equal(t, mqrr.StatusUnauthorized, rec.Status())
+}
+
+func TestDoNoMatch(t *testing.T) {
+	r := mqrr.New()
+	r.AccessLogger = nil
+	r.Route("user/:name", func(c *mqrr.Context) {})
+	rec := Do(r, "device/1", nil)
+	assert.False(t, rec.Matched)
+	assert.False(t, rec.Replied())
+	assert.Equal(t, 0, rec.Status())
+	assert.Nil(t, rec.Payload())
+}
+
+func TestDoNoReply(t *testing.T) {
+	r := mqrr.New()
+	r.AccessLogger = nil
+	r.Route("event/#", func(c *mqrr.Context) {}, mqrr.NoReply())
+	rec := Do(r, "event/a/b", nil)
+	assert.True(t, rec.Matched)
+	assert.False(t, rec.Replied())
+}
@@ -0,0 +1,175 @@
+// Package policy provides an authorization middleware deciding which routes
+// a caller may request, based on the topic and the claims of its identity.
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/koho/mqrr"
+	"github.com/koho/mqrr/auth"
+	"os"
+	"strings"
+)
+
+// Effects of a rule.
+const (
+	Allow = "allow"
+	Deny  = "deny"
+)
+
+// Rule decides the access of the requests matching the topic pattern.
+type Rule struct {
+	// Topic is a pattern matched against the request topic, using the same
+	// syntax as Engine.Route, e.g. `device/:id/*`.
+	Topic string `json:"topic"`
+	// Params are the conditions of the named levels in Topic. A value in braces
+	// refers to a claim, e.g. `{"id": "{device}"}` requires the id level to
+	// equal the device claim. Otherwise, the value is compared literally.
+	Params map[string]string `json:"params,omitempty"`
+	// Claims are the conditions of the caller claims. A claim holding a list
+	// matches if any of its elements equals the value.
+	Claims map[string]string `json:"claims,omitempty"`
+	// Effect is either Allow or Deny, default is Allow.
+	Effect string `json:"effect,omitempty"`
+
+	levels []string
+}
+
+// Policy is an ordered list of rules. The first rule matching a request
+// decides its access. Requests matching no rule are denied.
+type Policy struct {
+	rules []Rule
+}
+
+// New creates a Policy from the rules.
+func New(rules ...Rule) (*Policy, error) {
+	p := &Policy{rules: make([]Rule, 0, len(rules))}
+	for i, r := range rules {
+		if err := r.compile(); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+		p.rules = append(p.rules, r)
+	}
+	return p, nil
+}
+
+// Load reads a Policy from a JSON file, e.g. `{"rules": [{"topic": "device/:id/*", "params": {"id": "{device}"}}]}`.
+func Load(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Rules []Rule `json:"rules"`
+	}
+	if err = json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	return New(file.Rules...)
+}
+
+// Handler returns a middleware replying with the StatusForbidden status
+// when the policy denies the request. It works with the claims verified by
+// the auth middleware, which must run before it.
+func (p *Policy) Handler() mqrr.HandlerFunc {
+	return func(c *mqrr.Context) {
+		claims, _ := auth.GetClaims(c)
+		if !p.Allowed(c.Request.Topic, claims) {
+			c.Status(mqrr.StatusForbidden)
+			c.String("forbidden")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// Allowed reports whether the caller with the claims may request the topic.
+func (p *Policy) Allowed(topic string, claims auth.Claims) bool {
+	levels := strings.Split(topic, "/")
+	for _, r := range p.rules {
+		if r.match(levels, claims) {
+			return r.Effect != Deny
+		}
+	}
+	return false
+}
+
+func (r *Rule) compile() error {
+	if r.Effect != "" && r.Effect != Allow && r.Effect != Deny {
+		return fmt.Errorf("unknown effect %q", r.Effect)
+	}
+	r.levels = strings.Split(r.Topic, "/")
+	names := make(map[string]bool)
+	for i, level := range r.levels {
+		if level == "" {
+			return fmt.Errorf("invalid topic %q", r.Topic)
+		}
+		if (level[0] == '*' || level == "#") && i != len(r.levels)-1 {
+			return fmt.Errorf("the multi-level wildcard must be placed as the last level in %q", r.Topic)
+		}
+		if level[0] == ':' || level[0] == '*' {
+			names[level[1:]] = true
+		}
+	}
+	for name := range r.Params {
+		if !names[name] {
+			return fmt.Errorf("param %q not found in %q", name, r.Topic)
+		}
+	}
+	return nil
+}
+
+func (r *Rule) match(levels []string, claims auth.Claims) bool {
+	params := make(map[string]string)
+	for i, level := range r.levels {
+		if level[0] == '*' || level == "#" {
+			if i >= len(levels) {
+				return false
+			}
+			params[level[1:]] = strings.Join(levels[i:], "/")
+			levels = levels[:i]
+			break
+		}
+		if i >= len(levels) {
+			return false
+		}
+		if level[0] == ':' {
+			params[level[1:]] = levels[i]
+		} else if level != "+" && level != levels[i] {
+			return false
+		}
+	}
+	if len(levels) > len(r.levels) {
+		return false
+	}
+	for name, want := range r.Params {
+		if len(want) > 2 && want[0] == '{' && want[len(want)-1] == '}' {
+			claim := want[1 : len(want)-1]
+			if _, ok := claims[claim]; !ok || claims.String(claim) != params[name] {
+				return false
+			}
+		} else if params[name] != want {
+			return false
+		}
+	}
+	for name, want := range r.Claims {
+		if !hasClaim(claims, name, want) {
+			return false
+		}
+	}
+	return true
+}
+
+func hasClaim(claims auth.Claims, name, want string) bool {
+	if list, ok := claims[name].([]interface{}); ok {
+		for _, v := range list {
+			if fmt.Sprint(v) == want {
+				return true
+			}
+		}
+		return false
+	}
+	_, ok := claims[name]
+	return ok && claims.String(name) == want
+}
@@ -0,0 +1,92 @@
+package policy
+
+import (
+	"encoding/json"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/koho/mqrr"
+	"github.com/koho/mqrr/auth"
+	"github.com/koho/mqrr/mqrrtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPolicyAllowed(t *testing.T) {
+	p, err := New(
+		Rule{Topic: "device/:id/firmware/*", Claims: map[string]string{"role": "operator"}, Effect: Deny},
+		Rule{Topic: "device/:id/*rest", Params: map[string]string{"id": "{device}"}},
+		Rule{Topic: "admin/#", Claims: map[string]string{"role": "admin"}},
+		Rule{Topic: "public/+"},
+	)
+	require.NoError(t, err)
+
+	device := auth.Claims{"device": "42", "role": "device"}
+	assert.True(t, p.Allowed("device/42/report", device))
+	assert.True(t, p.Allowed("device/42/a/b", device))
+	assert.False(t, p.Allowed("device/42", device))
+	assert.False(t, p.Allowed("device/43/report", device))
+	assert.False(t, p.Allowed("admin/users", device))
+	assert.True(t, p.Allowed("public/info", nil))
+	assert.False(t, p.Allowed("public/info/more", nil))
+	assert.False(t, p.Allowed("device/42/report", nil))
+
+	operator := auth.Claims{"device": "42", "role": []interface{}{"operator", "admin"}}
+	assert.False(t, p.Allowed("device/42/firmware/update", operator))
+	assert.True(t, p.Allowed("admin/users", operator))
+}
+
+func TestPolicyInvalid(t *testing.T) {
+	_, err := New(Rule{Topic: "device/*rest/x"})
+	assert.Error(t, err)
+	_, err = New(Rule{Topic: "device/:id", Params: map[string]string{"name": "x"}})
+	assert.Error(t, err)
+	_, err = New(Rule{Topic: "device/:id", Effect: "maybe"})
+	assert.Error(t, err)
+}
+
+func TestLoad(t *testing.T) {
+	data, err := json.Marshal(map[string]interface{}{"rules": []Rule{
+		{Topic: "device/:id/*", Params: map[string]string{"id": "{device}"}},
+	}})
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "policy.json")
+	require.NoError(t, os.WriteFile(path, data, 0600))
+	p, err := Load(path)
+	require.NoError(t, err)
+	assert.True(t, p.Allowed("device/1/report", auth.Claims{"device": "1"}))
+}
+
+func TestPolicyHandler(t *testing.T) {
+	p, err := New(
+		Rule{Topic: "device/:id/firmware", Effect: Deny},
+		Rule{Topic: "device/:id/*rest", Params: map[string]string{"id": "{device}"}},
+	)
+	require.NoError(t, err)
+	// Stands in for the auth middleware
+	claims := func(c *mqrr.Context) {
+		c.Set(auth.ClaimsKey, auth.Claims{"device": c.Property("device")})
+		c.Next()
+	}
+	r := mqrr.New()
+	r.AccessLogger = nil
+	calls := 0
+	r.Route("device/:id/*rest", func(c *mqrr.Context) {
+		calls++
+		c.String("ok")
+	}, mqrr.With(claims, p.Handler()))
+	device := paho.UserProperty{Key: "device", Value: "42"}
+
+	rec := mqrrtest.Do(r, "device/42/report", nil, device)
+	assert.Equal(t, mqrr.StatusOK, rec.Status())
+	assert.Equal(t, "ok", string(rec.Payload()))
+
+	rec = mqrrtest.Do(r, "device/43/report", nil, device)
+	assert.Equal(t, mqrr.StatusForbidden, rec.Status())
+	assert.Equal(t, "forbidden", string(rec.Payload()))
+
+	rec = mqrrtest.Do(r, "device/42/firmware", nil, device)
+	assert.Equal(t, mqrr.StatusForbidden, rec.Status())
+	assert.Equal(t, 1, calls)
+}
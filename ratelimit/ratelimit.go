@@ -0,0 +1,120 @@
+// Package ratelimit provides a token bucket rate limiting middleware.
+package ratelimit
+
+import (
+	"github.com/koho/mqrr"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RetryAfterProperty is the user property key of the retry hint in seconds,
+// sent along with the StatusTooManyRequests status.
+const RetryAfterProperty = "retry-after"
+
+// KeyFunc returns the key of the bucket a request takes tokens from.
+type KeyFunc func(c *mqrr.Context) string
+
+// ByRoute shares one bucket among all the requests of a route.
+func ByRoute() KeyFunc {
+	return func(c *mqrr.Context) string {
+		return c.FullTopic()
+	}
+}
+
+// ByParam gives each value of the topic param a bucket, e.g. `id` in `device/:id/report`.
+func ByParam(name string) KeyFunc {
+	return func(c *mqrr.Context) string {
+		return c.FullTopic() + "\n" + c.Param(name)
+	}
+}
+
+// ByProperty gives each value of the request user property a bucket.
+func ByProperty(key string) KeyFunc {
+	return func(c *mqrr.Context) string {
+		return c.Property(key)
+	}
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter is a set of token buckets, each filled at the given rate
+// up to burst tokens. It is safe for concurrent use.
+type Limiter struct {
+	sync.Mutex
+	rate      float64
+	burst     float64
+	key       KeyFunc
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// New creates a Limiter allowing rate requests per second with the given
+// burst for each key.
+func New(rate float64, burst int, key KeyFunc) *Limiter {
+	if rate <= 0 || burst <= 0 {
+		panic("rate and burst must be positive")
+	}
+	return &Limiter{
+		rate:    rate,
+		burst:   float64(burst),
+		key:     key,
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// Handler returns a middleware which replies with the StatusTooManyRequests
+// status and a retry hint when the bucket of the request is empty.
+func (l *Limiter) Handler() mqrr.HandlerFunc {
+	return func(c *mqrr.Context) {
+		if ok, wait := l.Allow(l.key(c)); !ok {
+			c.Status(mqrr.StatusTooManyRequests)
+			c.SetProperty(RetryAfterProperty, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			c.String("rate limited")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// Allow takes a token from the bucket of the key. If the bucket is empty,
+// it returns false and the duration until a token is available.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+	now := l.now()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// sweep removes the buckets which are full again, they are the same as new ones.
+func (l *Limiter) sweep(now time.Time) {
+	interval := time.Duration(l.burst / l.rate * float64(time.Second))
+	if now.Sub(l.lastSweep) < interval {
+		return
+	}
+	l.lastSweep = now
+	for k, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, k)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package ratelimit
+
+import (
+	"github.com/koho/mqrr"
+	"github.com/koho/mqrr/mqrrtest"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestLimiterAllow(t *testing.T) {
+	now := time.Now()
+	l := New(2, 2, ByRoute())
+	l.now = func() time.Time { return now }
+
+	ok, _ := l.Allow("a")
+	assert.True(t, ok)
+	ok, _ = l.Allow("a")
+	assert.True(t, ok)
+	ok, wait := l.Allow("a")
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	// Other keys have their own bucket
+	ok, _ = l.Allow("b")
+	assert.True(t, ok)
+
+	now = now.Add(500 * time.Millisecond)
+	ok, _ = l.Allow("a")
+	assert.True(t, ok)
+	ok, _ = l.Allow("a")
+	assert.False(t, ok)
+}
+
+func TestLimiterSweep(t *testing.T) {
+	now := time.Now()
+	l := New(1, 1, ByRoute())
+	l.now = func() time.Time { return now }
+	l.Allow("a")
+	l.Allow("b")
+	now = now.Add(2 * time.Second)
+	l.Allow("c")
+	assert.Len(t, l.buckets, 1)
+}
+
+func TestLimiterHandler(t *testing.T) {
+	now := time.Now()
+	l := New(1, 1, ByParam("id"))
+	l.now = func() time.Time { return now }
+	r := mqrr.New()
+	r.AccessLogger = nil
+	calls := 0
+	r.Route("device/:id", func(c *mqrr.Context) {
+		calls++
+		c.String("ok")
+	}, mqrr.With(l.Handler()))
+
+	rec := mqrrtest.Do(r, "device/1", nil)
+	assert.Equal(t, mqrr.StatusOK, rec.Status())
+	assert.Equal(t, "ok", string(rec.Payload()))
+
+	// The chain is aborted
+	rec = mqrrtest.Do(r, "device/1", nil)
+	assert.Equal(t, mqrr.StatusTooManyRequests, rec.Status())
+	assert.Equal(t, "1", rec.Property(RetryAfterProperty))
+	assert.Equal(t, "rate limited", string(rec.Payload()))
+	assert.Equal(t, 1, calls)
+
+	// Another param has its own bucket
+	rec = mqrrtest.Do(r, "device/2", nil)
+	assert.Equal(t, mqrr.StatusOK, rec.Status())
+	assert.Equal(t, 2, calls)
+}
@@ -0,0 +1,74 @@
+package mqrr
+
+import (
+	"context"
+	"errors"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/koho/mqrr/trace"
+	"strconv"
+	"time"
+)
+
+// DeadlineProperty is the user property carrying the deadline of a request,
+// in milliseconds since the Unix epoch. The engine drops a request arriving
+// after its deadline, and sets the deadline of the handler context.
+// The deadline is an absolute time, so the clocks of the caller and the
+// engine are assumed to be synchronized, e.g. by NTP. A clock skew shortens
+// or extends the deadline by the same amount.
+const DeadlineProperty = "deadline"
+
+// authorizationProperty is the user property of the bearer token, which is
+// forwarded to the outbound requests.
+const authorizationProperty = "authorization"
+
+// ErrNoRequester is returned by Context.Call if Engine.Requester is not set.
+var ErrNoRequester = errors.New("mqrr: no requester")
+
+// Requester sends a request and waits for the response.
+// *client.Client and *client.Handler satisfy it.
+type Requester interface {
+	Request(ctx context.Context, pb *paho.Publish) (*paho.Publish, error)
+}
+
+// Call sends a request to another service with Engine.Requester, which must
+// be set before, and waits for the response.
+// The request inherits the remaining deadline, the trace context and the
+// authorization of the current request. The deadline is sent in the
+// DeadlineProperty for the downstream engine to enforce.
+func (c *Context) Call(ctx context.Context, topic string, payload []byte) (*paho.Publish, error) {
+	if c.engine == nil || c.engine.Requester == nil {
+		return nil, ErrNoRequester
+	}
+	if deadline, ok := c.Context().Deadline(); ok {
+		if d, ok := ctx.Deadline(); !ok || deadline.Before(d) {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithDeadline(ctx, deadline)
+			defer cancel()
+		}
+	}
+	if _, ok := trace.SpanContextFromContext(ctx); !ok {
+		if sc, ok := trace.SpanContextFromContext(c.Context()); ok {
+			ctx = trace.ContextWithSpanContext(ctx, sc)
+		}
+	}
+	pb := &paho.Publish{Topic: topic, Payload: payload, Properties: &paho.PublishProperties{}}
+	if token := c.Property(authorizationProperty); token != "" {
+		pb.Properties.User = pb.Properties.User.Add(authorizationProperty, token)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		pb.Properties.User = pb.Properties.User.Add(DeadlineProperty, strconv.FormatInt(deadline.UnixMilli(), 10))
+	}
+	return c.engine.Requester.Request(ctx, pb)
+}
+
+// requestDeadline returns the deadline carried by the request.
+func requestDeadline(request *paho.Publish) (time.Time, bool) {
+	if request.Properties == nil {
+		return time.Time{}, false
+	}
+	ms, err := strconv.ParseInt(request.Properties.User.Get(DeadlineProperty), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(ms), true
+}
@@ -0,0 +1,69 @@
+package mqrr
+
+import "github.com/eclipse/paho.golang/paho"
+
+// HandlerFunc defines the handler used by middlewares and routes.
+type HandlerFunc func(c *Context)
+
+// HandlersChain defines a HandlerFunc slice.
+type HandlersChain []HandlerFunc
+
+// ResponseHook is called with the response of a request before it is
+// published. The response is final, including the status of a panicking
+// handler or an oversized request, and the hook may change it.
+type ResponseHook func(c *Context, resp *paho.Publish)
+
+// Last returns the last handler of the chain, which is the route handler.
+func (c HandlersChain) Last() HandlerFunc {
+	if length := len(c); length > 0 {
+		return c[length-1]
+	}
+	return nil
+}
+
+// route holds a registered handler chain and its options.
+type route struct {
+	topic      string
+	filter     string
+	params     map[string]int
+	middleware HandlersChain
+	handlers   HandlersChain
+	noReply    bool
+	async      bool
+	envelope   bool
+	maxPayload int
+}
+
+// RouteOption configures a route registered with Route.
+type RouteOption func(r *route)
+
+// NoReply disables the response of a route, even if the request carries
+// a response topic. It is meant for fire-and-forget handlers.
+func NoReply() RouteOption {
+	return func(r *route) {
+		r.noReply = true
+	}
+}
+
+// envelope marks the route of JSON-RPC or batch envelopes. The calls of an
+// envelope never run an envelope route, so that envelopes can not nest.
+func envelope(r *route) {
+	r.envelope = true
+}
+
+// With adds middlewares to a single route. They run after the middlewares
+// of the engine and groups.
+func With(middleware ...HandlerFunc) RouteOption {
+	return func(r *route) {
+		r.middleware = append(r.middleware, middleware...)
+	}
+}
+
+// MaxPayloadSize limits the request payload size of a route, overriding
+// Engine.MaxPayloadSize. Oversized requests are answered with the
+// StatusPayloadTooLarge status before the handlers run.
+func MaxPayloadSize(size int) RouteOption {
+	return func(r *route) {
+		r.maxPayload = size
+	}
+}
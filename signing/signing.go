@@ -0,0 +1,215 @@
+// Package signing provides HMAC signing of requests and responses with
+// replay protection. The signature covers the payload, topic, response
+// properties, content type, user properties, timestamp and nonce of a message.
+package signing
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/koho/mqrr"
+	"github.com/koho/mqrr/client"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// User property keys carrying the signature.
+const (
+	SignatureProperty = "signature"
+	TimestampProperty = "timestamp"
+	NonceProperty     = "nonce"
+)
+
+// DefaultMaxSkew is the maximum age of a message if Signer.MaxSkew is not set.
+const DefaultMaxSkew = 30 * time.Second
+
+// Errors returned by Signer.Verify.
+var (
+	ErrMissingSignature = errors.New("missing signature")
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrStale            = errors.New("stale message")
+	ErrReplayed         = errors.New("replayed message")
+)
+
+// Signer signs and verifies messages with a shared secret. The nonces of
+// verified messages are remembered for twice the MaxSkew to reject replays.
+type Signer struct {
+	key []byte
+	// MaxSkew is the maximum difference between the timestamp of a message and the local clock.
+	MaxSkew time.Duration
+
+	mu        sync.Mutex
+	nonces    map[string]time.Time
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// New creates a Signer with the shared secret.
+func New(key []byte) *Signer {
+	return &Signer{
+		key:    key,
+		nonces: make(map[string]time.Time),
+		now:    time.Now,
+	}
+}
+
+// message contains the signed fields of a publish.
+type message struct {
+	topic         string
+	responseTopic string
+	correlData    []byte
+	contentType   string
+	user          paho.UserProperties
+	payload       []byte
+}
+
+func messageOf(pb *paho.Publish) message {
+	m := message{topic: pb.Topic, payload: pb.Payload}
+	if pb.Properties != nil {
+		m.responseTopic = pb.Properties.ResponseTopic
+		m.correlData = pb.Properties.CorrelationData
+		m.contentType = pb.Properties.ContentType
+		for _, p := range pb.Properties.User {
+			switch p.Key {
+			case SignatureProperty, TimestampProperty, NonceProperty:
+			default:
+				m.user = append(m.user, p)
+			}
+		}
+	}
+	return m
+}
+
+func (s *Signer) maxSkew() time.Duration {
+	if s.MaxSkew > 0 {
+		return s.MaxSkew
+	}
+	return DefaultMaxSkew
+}
+
+func (s *Signer) digest(m message, timestamp, nonce string) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	fields := [][]byte{[]byte(m.topic), []byte(m.responseTopic), m.correlData, []byte(m.contentType), []byte(timestamp), []byte(nonce), m.payload}
+	for _, p := range m.user {
+		fields = append(fields, []byte(p.Key), []byte(p.Value))
+	}
+	for _, field := range fields {
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], uint32(len(field)))
+		mac.Write(size[:])
+		mac.Write(field)
+	}
+	return mac.Sum(nil)
+}
+
+// sign returns the signature properties of the message.
+func (s *Signer) sign(m message) paho.UserProperties {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	nonce := hex.EncodeToString(b[:])
+	timestamp := strconv.FormatInt(s.now().UnixMilli(), 10)
+	return paho.UserProperties{}.
+		Add(TimestampProperty, timestamp).
+		Add(NonceProperty, nonce).
+		Add(SignatureProperty, hex.EncodeToString(s.digest(m, timestamp, nonce)))
+}
+
+// Sign adds the signature properties to the publish. It must be the last
+// change to the publish, since the user properties are signed.
+func (s *Signer) Sign(pb *paho.Publish) {
+	if pb.Properties == nil {
+		pb.Properties = &paho.PublishProperties{}
+	}
+	pb.Properties.User = append(pb.Properties.User, s.sign(messageOf(pb))...)
+}
+
+// Verify checks the signature, timestamp and nonce of the publish.
+func (s *Signer) Verify(pb *paho.Publish) error {
+	if pb.Properties == nil {
+		return ErrMissingSignature
+	}
+	return s.verify(messageOf(pb), pb.Properties.User)
+}
+
+func (s *Signer) verify(m message, props paho.UserProperties) error {
+	signature, timestamp, nonce := props.Get(SignatureProperty), props.Get(TimestampProperty), props.Get(NonceProperty)
+	if signature == "" || timestamp == "" || nonce == "" {
+		return ErrMissingSignature
+	}
+	sig, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(sig, s.digest(m, timestamp, nonce)) {
+		return ErrInvalidSignature
+	}
+	ms, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	now := s.now()
+	if skew := now.Sub(time.UnixMilli(ms)); skew > s.maxSkew() || skew < -s.maxSkew() {
+		return ErrStale
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(now)
+	if _, ok := s.nonces[nonce]; ok {
+		return ErrReplayed
+	}
+	s.nonces[nonce] = now.Add(2 * s.maxSkew())
+	return nil
+}
+
+func (s *Signer) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < s.maxSkew() {
+		return
+	}
+	s.lastSweep = now
+	for k, expires := range s.nonces {
+		if now.After(expires) {
+			delete(s.nonces, k)
+		}
+	}
+}
+
+// Handler returns a middleware verifying the signature of requests.
+// Requests failing the verification are answered with the StatusUnauthorized
+// status. The responses are signed by SignResponse.
+func (s *Signer) Handler() mqrr.HandlerFunc {
+	return func(c *mqrr.Context) {
+		if err := s.Verify(c.Request); err != nil {
+			c.Status(mqrr.StatusUnauthorized)
+			c.String(err.Error())
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// SignResponse is a response hook signing every response of the engine,
+// including the ones of panicking handlers and oversized requests. It should
+// be the last of Engine.ResponseHooks.
+func (s *Signer) SignResponse(c *mqrr.Context, resp *paho.Publish) {
+	s.Sign(resp)
+}
+
+// ClientOption returns a client option signing every request, and verifying
+// the signature of every response before it is returned from Request.
+func (s *Signer) ClientOption() client.Option {
+	return func(h *client.Handler) {
+		client.WithRequestHook(func(ctx context.Context, req *paho.Publish) error {
+			s.Sign(req)
+			return nil
+		})(h)
+		client.WithResponseHook(func(ctx context.Context, req, resp *paho.Publish) error {
+			return s.Verify(resp)
+		})(h)
+	}
+}
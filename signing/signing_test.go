@@ -0,0 +1,134 @@
+package signing
+
+import (
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/koho/mqrr"
+	"github.com/koho/mqrr/mqrrtest"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func newRequest() *paho.Publish {
+	return &paho.Publish{
+		Topic:   "device/1/reboot",
+		Payload: []byte("now"),
+		Properties: &paho.PublishProperties{
+			ResponseTopic:   "client/responses",
+			CorrelationData: []byte("1"),
+		},
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	client, server := New([]byte("secret")), New([]byte("secret"))
+	pb := newRequest()
+	client.Sign(pb)
+	assert.NoError(t, server.Verify(pb))
+	assert.ErrorIs(t, server.Verify(pb), ErrReplayed)
+
+	pb = newRequest()
+	client.Sign(pb)
+	pb.Payload = []byte("later")
+	assert.ErrorIs(t, server.Verify(pb), ErrInvalidSignature)
+
+	pb = newRequest()
+	client.Sign(pb)
+	pb.Properties.ResponseTopic = "device/2/commands"
+	assert.ErrorIs(t, server.Verify(pb), ErrInvalidSignature)
+
+	assert.ErrorIs(t, server.Verify(newRequest()), ErrMissingSignature)
+	pb = newRequest()
+	New([]byte("other")).Sign(pb)
+	assert.ErrorIs(t, server.Verify(pb), ErrInvalidSignature)
+}
+
+func TestVerifyStale(t *testing.T) {
+	client, server := New([]byte("secret")), New([]byte("secret"))
+	client.now = func() time.Time { return time.Now().Add(-time.Minute) }
+	pb := newRequest()
+	client.Sign(pb)
+	assert.ErrorIs(t, server.Verify(pb), ErrStale)
+
+	server.MaxSkew = 2 * time.Minute
+	assert.NoError(t, server.Verify(pb))
+}
+
+func TestVerifyStatus(t *testing.T) {
+	s := New([]byte("secret"))
+	pb := &paho.Publish{
+		Topic:      "client/responses",
+		Properties: &paho.PublishProperties{User: paho.UserProperties{}.Add(mqrr.StatusProperty, "200")},
+	}
+	s.Sign(pb)
+	pb.Properties.User[0].Value = "500"
+	assert.ErrorIs(t, s.Verify(pb), ErrInvalidSignature)
+
+	// The content type and other user properties are signed too
+	pb = &paho.Publish{Topic: "client/responses", Properties: &paho.PublishProperties{ContentType: "text/plain"}}
+	s.Sign(pb)
+	pb.Properties.ContentType = "text/html"
+	assert.ErrorIs(t, s.Verify(pb), ErrInvalidSignature)
+
+	pb = &paho.Publish{Topic: "client/responses", Properties: &paho.PublishProperties{User: paho.UserProperties{}.Add("unit", "C")}}
+	s.Sign(pb)
+	pb.Properties.User = pb.Properties.User.Add("unit", "F")
+	assert.ErrorIs(t, s.Verify(pb), ErrInvalidSignature)
+}
+
+func TestHandler(t *testing.T) {
+	server, caller := New([]byte("secret")), New([]byte("secret"))
+	r := mqrr.New()
+	r.AccessLogger = nil
+	r.ResponseHooks = append(r.ResponseHooks, server.SignResponse)
+	calls := 0
+	r.Route("device/:id/reboot", func(c *mqrr.Context) {
+		calls++
+		c.String("ok")
+	}, mqrr.With(server.Handler()))
+	r.Route("device/:id/fail", func(c *mqrr.Context) { panic("boom") }, mqrr.With(server.Handler()))
+	r.Route("device/:id/upload", func(c *mqrr.Context) {}, mqrr.With(server.Handler()), mqrr.MaxPayloadSize(1))
+
+	// The response is signed
+	req := newRequest()
+	caller.Sign(req)
+	rec := mqrrtest.DoRequest(r, req)
+	assert.Equal(t, mqrr.StatusOK, rec.Status())
+	assert.NoError(t, caller.Verify(rec.Result()))
+
+	// A replayed request is rejected, with a signed response
+	rec = mqrrtest.DoRequest(r, req)
+	assert.Equal(t, mqrr.StatusUnauthorized, rec.Status())
+	assert.Equal(t, ErrReplayed.Error(), string(rec.Payload()))
+	assert.NoError(t, caller.Verify(rec.Result()))
+
+	req = newRequest()
+	caller.Sign(req)
+	req.Payload = []byte("later")
+	rec = mqrrtest.DoRequest(r, req)
+	assert.Equal(t, mqrr.StatusUnauthorized, rec.Status())
+	assert.Equal(t, ErrInvalidSignature.Error(), string(rec.Payload()))
+
+	rec = mqrrtest.DoRequest(r, newRequest())
+	assert.Equal(t, mqrr.StatusUnauthorized, rec.Status())
+	assert.Equal(t, ErrMissingSignature.Error(), string(rec.Payload()))
+	assert.Equal(t, 1, calls)
+
+	// A tampered response fails the verification
+	resp := rec.Result()
+	resp.Payload = []byte("ok")
+	assert.ErrorIs(t, caller.Verify(resp), ErrInvalidSignature)
+
+	// The final responses of a panic and an oversized request are signed
+	for topic, status := range map[string]int{
+		"device/1/fail":   mqrr.StatusInternalServerError,
+		"device/1/upload": mqrr.StatusPayloadTooLarge,
+	} {
+		req = newRequest()
+		req.Topic = topic
+		caller.Sign(req)
+		rec = mqrrtest.DoRequest(r, req)
+		assert.Equal(t, status, rec.Status(), topic)
+		assert.NoError(t, caller.Verify(rec.Result()), topic)
+	}
+}
@@ -0,0 +1,18 @@
+package mqrr
+
+// StatusProperty is the user property key carrying the status code of a response.
+const StatusProperty = "status"
+
+// Status codes of a response. They share the meaning of the HTTP status codes.
+const (
+	StatusOK                  = 200
+	StatusAccepted            = 202
+	StatusBadRequest          = 400
+	StatusUnauthorized        = 401
+	StatusForbidden           = 403
+	StatusNotFound            = 404
+	StatusPayloadTooLarge     = 413
+	StatusTooManyRequests     = 429
+	StatusInternalServerError = 500
+	StatusServiceUnavailable  = 503
+)
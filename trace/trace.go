@@ -0,0 +1,253 @@
+// Package trace propagates the W3C trace context through the user properties
+// of MQTT messages, and records the spans of requests and responses.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/eclipse/paho.golang/paho"
+	"strings"
+	"sync"
+	"time"
+)
+
+// User property keys of the trace context, named after the HTTP headers.
+const (
+	TraceParentProperty = "traceparent"
+	TraceStateProperty  = "tracestate"
+)
+
+// ErrInvalidTraceParent is returned when parsing a malformed traceparent.
+var ErrInvalidTraceParent = errors.New("invalid traceparent")
+
+// TraceID identifies a trace.
+type TraceID [16]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+
+// SpanID identifies a span in a trace.
+type SpanID [8]byte
+
+func (id SpanID) String() string { return hex.EncodeToString(id[:]) }
+
+// SpanContext is the part of a span propagated to the other side.
+type SpanContext struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	Flags      byte
+	TraceState string
+	// Remote is true if the span context is extracted from a message.
+	Remote bool
+}
+
+// IsValid reports whether the trace and span ids are not zero.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// TraceParent formats the span context as a version 00 traceparent.
+func (sc SpanContext) TraceParent() string {
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, sc.Flags)
+}
+
+// Parse parses a traceparent and tracestate pair.
+func Parse(traceParent, traceState string) (SpanContext, error) {
+	parts := strings.Split(traceParent, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return SpanContext{}, ErrInvalidTraceParent
+	}
+	sc := SpanContext{TraceState: traceState, Remote: true}
+	var flags [1]byte
+	if decodeHex(sc.TraceID[:], parts[1]) != nil || decodeHex(sc.SpanID[:], parts[2]) != nil || decodeHex(flags[:], parts[3]) != nil {
+		return SpanContext{}, ErrInvalidTraceParent
+	}
+	sc.Flags = flags[0]
+	if !sc.IsValid() {
+		return SpanContext{}, ErrInvalidTraceParent
+	}
+	return sc, nil
+}
+
+func decodeHex(dst []byte, s string) error {
+	if len(s) != 2*len(dst) || strings.ToLower(s) != s {
+		return ErrInvalidTraceParent
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err
+}
+
+type spanContextKey struct{}
+
+// ContextWithSpanContext returns a copy of ctx carrying the span context.
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// SpanContextFromContext returns the span context carried by ctx.
+func SpanContextFromContext(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(spanContextKey{}).(SpanContext)
+	return sc, ok
+}
+
+// Inject sets the trace context properties of the publish from the span context in ctx.
+func Inject(ctx context.Context, pb *paho.Publish) {
+	sc, ok := SpanContextFromContext(ctx)
+	if !ok || !sc.IsValid() {
+		return
+	}
+	if pb.Properties == nil {
+		pb.Properties = &paho.PublishProperties{}
+	}
+	user := make(paho.UserProperties, 0, len(pb.Properties.User)+2)
+	for _, p := range pb.Properties.User {
+		if p.Key != TraceParentProperty && p.Key != TraceStateProperty {
+			user = append(user, p)
+		}
+	}
+	user = user.Add(TraceParentProperty, sc.TraceParent())
+	if sc.TraceState != "" {
+		user = user.Add(TraceStateProperty, sc.TraceState)
+	}
+	pb.Properties.User = user
+}
+
+// Extract returns a copy of ctx carrying the remote span context of the publish.
+// If the publish carries no valid trace context, ctx is returned.
+func Extract(ctx context.Context, pb *paho.Publish) context.Context {
+	if pb.Properties == nil {
+		return ctx
+	}
+	sc, err := Parse(pb.Properties.User.Get(TraceParentProperty), pb.Properties.User.Get(TraceStateProperty))
+	if err != nil {
+		return ctx
+	}
+	return ContextWithSpanContext(ctx, sc)
+}
+
+// SpanKind describes the role of a span.
+type SpanKind string
+
+// Span kinds used by mqrr.
+const (
+	SpanKindServer   SpanKind = "server"
+	SpanKindClient   SpanKind = "client"
+	SpanKindProducer SpanKind = "producer"
+)
+
+// Span records an operation. All the methods are safe to call on a nil Span,
+// which is returned when tracing is disabled.
+type Span struct {
+	sync.Mutex
+	SpanContext
+	Name       string
+	Kind       SpanKind
+	Parent     SpanID
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]string
+	Err        error
+	tracer     *Tracer
+}
+
+// SetAttribute records an attribute of the span.
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.Attributes[key] = value
+}
+
+// SetError records the error of the operation.
+func (s *Span) SetError(err error) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.Err = err
+}
+
+// Finish ends the span and hands it to the exporter.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	s.End = time.Now()
+	s.Unlock()
+	s.tracer.exporter.ExportSpan(s)
+}
+
+// Exporter receives the finished spans.
+type Exporter interface {
+	ExportSpan(span *Span)
+}
+
+// Tracer starts spans and hands the finished ones to the exporter.
+// A nil Tracer disables tracing.
+type Tracer struct {
+	exporter Exporter
+}
+
+// New creates a Tracer with the exporter.
+func New(exporter Exporter) *Tracer {
+	return &Tracer{exporter: exporter}
+}
+
+// Start starts a span whose parent is the span context in ctx, or a new
+// trace if there is none. It returns a copy of ctx carrying the new span.
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	span := &Span{Name: name, Kind: kind, Start: time.Now(), Attributes: make(map[string]string), tracer: t}
+	if parent, ok := SpanContextFromContext(ctx); ok && parent.IsValid() {
+		span.TraceID = parent.TraceID
+		span.Parent = parent.SpanID
+		span.Flags = parent.Flags
+		span.TraceState = parent.TraceState
+	} else {
+		randomID(span.TraceID[:])
+		span.Flags = 1
+	}
+	randomID(span.SpanID[:])
+	return ContextWithSpanContext(ctx, span.SpanContext), span
+}
+
+func randomID(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+}
+
+// Recorder is an in-memory Exporter, which is useful in tests.
+type Recorder struct {
+	sync.Mutex
+	spans []*Span
+}
+
+// ExportSpan records the span.
+func (r *Recorder) ExportSpan(span *Span) {
+	r.Lock()
+	defer r.Unlock()
+	r.spans = append(r.spans, span)
+}
+
+// Spans returns the recorded spans in the finishing order.
+func (r *Recorder) Spans() []*Span {
+	r.Lock()
+	defer r.Unlock()
+	return append([]*Span(nil), r.spans...)
+}
+
+// Reset removes all the recorded spans.
+func (r *Recorder) Reset() {
+	r.Lock()
+	defer r.Unlock()
+	r.spans = nil
+}
@@ -0,0 +1,93 @@
+package trace
+
+import (
+	"context"
+	"errors"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+const traceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestParse(t *testing.T) {
+	sc, err := Parse(traceParent, "congo=t61rcWkgMzE")
+	require.NoError(t, err)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+	assert.Equal(t, "00f067aa0ba902b7", sc.SpanID.String())
+	assert.Equal(t, byte(1), sc.Flags)
+	assert.True(t, sc.Remote)
+	assert.Equal(t, traceParent, sc.TraceParent())
+
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	} {
+		_, err = Parse(invalid, "")
+		assert.ErrorIs(t, err, ErrInvalidTraceParent, invalid)
+	}
+}
+
+func TestInjectExtract(t *testing.T) {
+	pb := &paho.Publish{Properties: &paho.PublishProperties{
+		User: paho.UserProperties{}.Add(TraceParentProperty, traceParent).Add("status", "200"),
+	}}
+	ctx := Extract(context.Background(), pb)
+	sc, ok := SpanContextFromContext(ctx)
+	require.True(t, ok)
+	assert.Equal(t, traceParent, sc.TraceParent())
+
+	out := &paho.Publish{}
+	Inject(context.Background(), out)
+	assert.Nil(t, out.Properties)
+	Inject(ctx, pb)
+	assert.Equal(t, []string{traceParent}, pb.Properties.User.GetAll(TraceParentProperty))
+	assert.Equal(t, "200", pb.Properties.User.Get("status"))
+
+	_, ok = SpanContextFromContext(Extract(context.Background(), &paho.Publish{}))
+	assert.False(t, ok)
+}
+
+func TestTracerStart(t *testing.T) {
+	recorder := &Recorder{}
+	tracer := New(recorder)
+	sc, _ := Parse(traceParent, "")
+	ctx, parent := tracer.Start(ContextWithSpanContext(context.Background(), sc), "request", SpanKindServer)
+	_, child := tracer.Start(ctx, "publish", SpanKindProducer)
+	child.SetError(errors.New("failed"))
+	child.Finish()
+	parent.SetAttribute("mqrr.status", "200")
+	parent.Finish()
+
+	spans := recorder.Spans()
+	require.Len(t, spans, 2)
+	assert.Equal(t, sc.TraceID, spans[1].TraceID)
+	assert.Equal(t, sc.SpanID, spans[1].Parent)
+	assert.Equal(t, spans[1].SpanID, spans[0].Parent)
+	assert.Equal(t, "200", spans[1].Attributes["mqrr.status"])
+	assert.EqualError(t, spans[0].Err, "failed")
+	assert.False(t, spans[1].End.Before(spans[1].Start))
+
+	// A new trace without parent
+	_, root := tracer.Start(context.Background(), "root", SpanKindClient)
+	assert.True(t, root.IsValid())
+	assert.Equal(t, SpanID{}, root.Parent)
+
+	recorder.Reset()
+	assert.Empty(t, recorder.Spans())
+}
+
+func TestNilTracer(t *testing.T) {
+	var tracer *Tracer
+	ctx, span := tracer.Start(context.Background(), "noop", SpanKindServer)
+	assert.Nil(t, span)
+	span.SetAttribute("a", "b")
+	span.Finish()
+	_, ok := SpanContextFromContext(ctx)
+	assert.False(t, ok)
+}
@@ -0,0 +1,181 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	"sync"
+)
+
+// Autopaho is the Transport backed by an autopaho connection manager,
+// which reconnects automatically.
+type Autopaho struct {
+	cfg        autopaho.ClientConfig
+	router     *Router
+	mu         sync.Mutex
+	connecting bool
+	cm         *autopaho.ConnectionManager
+	connack    *paho.Connack
+	onUp       []func(connack *paho.Connack)
+	configure  []func(connect *paho.Connect) *paho.Connect
+	done       chan struct{}
+}
+
+// NewAutopaho returns a Transport connecting with the given client config.
+// The router of the config is replaced by the transport. So is the connect
+// packet configurator of the config, if any is added by ConfigureConnect;
+// add it by ConfigureConnect too, so that it is chained with the ones of an
+// Engine and a Client sharing the transport.
+func NewAutopaho(cc autopaho.ClientConfig) *Autopaho {
+	return &Autopaho{
+		cfg:    cc,
+		router: NewRouter(),
+		done:   make(chan struct{}),
+	}
+}
+
+// ConnectionManager returns the underlying connection manager,
+// or nil if Connect has not been called.
+func (t *Autopaho) ConnectionManager() *autopaho.ConnectionManager {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.cm
+}
+
+// Publish implements Transport.
+func (t *Autopaho) Publish(ctx context.Context, p *paho.Publish) (*paho.PublishResponse, error) {
+	cm := t.ConnectionManager()
+	if cm == nil {
+		return nil, ErrNotConnected
+	}
+	return cm.Publish(ctx, p)
+}
+
+// Subscribe implements Transport.
+func (t *Autopaho) Subscribe(ctx context.Context, s *paho.Subscribe) (*paho.Suback, error) {
+	cm := t.ConnectionManager()
+	if cm == nil {
+		return nil, ErrNotConnected
+	}
+	return cm.Subscribe(ctx, s)
+}
+
+// Unsubscribe implements Transport.
+func (t *Autopaho) Unsubscribe(ctx context.Context, u *paho.Unsubscribe) (*paho.Unsuback, error) {
+	cm := t.ConnectionManager()
+	if cm == nil {
+		return nil, ErrNotConnected
+	}
+	return cm.Unsubscribe(ctx, u)
+}
+
+// Handle implements Transport.
+func (t *Autopaho) Handle(filter string, handler paho.MessageHandler) {
+	t.router.RegisterHandler(filter, handler)
+}
+
+// HandleExclusive implements Transport.
+func (t *Autopaho) HandleExclusive(topic string, handler paho.MessageHandler) {
+	t.router.RegisterExclusive(topic, handler)
+}
+
+// Unhandle implements Transport.
+func (t *Autopaho) Unhandle(filter string) {
+	t.router.UnregisterHandler(filter)
+}
+
+// OnConnectionUp implements Transport.
+func (t *Autopaho) OnConnectionUp(fn func(connack *paho.Connack)) {
+	t.mu.Lock()
+	t.onUp = append(t.onUp, fn)
+	connack := t.connack
+	t.mu.Unlock()
+	if connack != nil {
+		fn(connack)
+	}
+}
+
+// ConfigureConnect implements ConnectConfigurer. The configurators added
+// after Connect apply from the next connection, if any was added before.
+func (t *Autopaho) ConfigureConnect(fn func(connect *paho.Connect) *paho.Connect) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.configure = append(t.configure, fn)
+}
+
+func (t *Autopaho) configureConnect(connect *paho.Connect) *paho.Connect {
+	t.mu.Lock()
+	configure := append([]func(*paho.Connect) *paho.Connect{}, t.configure...)
+	t.mu.Unlock()
+	for _, fn := range configure {
+		connect = fn(connect)
+	}
+	return connect
+}
+
+// Connect implements Transport. It does nothing if the transport is
+// already connecting, so the transport can be shared by an Engine and a Client.
+func (t *Autopaho) Connect(ctx context.Context) error {
+	t.mu.Lock()
+	if t.connecting {
+		t.mu.Unlock()
+		return nil
+	}
+	t.connecting = true
+	configured := len(t.configure) > 0
+	t.mu.Unlock()
+	cc := t.cfg
+	if configured {
+		cc.SetConnectPacketConfigurator(t.configureConnect)
+	}
+	onConnectionUp := cc.OnConnectionUp
+	cc.OnConnectionUp = func(manager *autopaho.ConnectionManager, connack *paho.Connack) {
+		t.mu.Lock()
+		t.cm = manager
+		t.connack = connack
+		onUp := append([]func(*paho.Connack){}, t.onUp...)
+		t.mu.Unlock()
+		for _, fn := range onUp {
+			fn(connack)
+		}
+		if onConnectionUp != nil {
+			onConnectionUp(manager, connack)
+		}
+	}
+	cc.ClientConfig.Router = t.router
+	cm, err := autopaho.NewConnection(ctx, cc)
+	if err != nil {
+		t.mu.Lock()
+		t.connecting = false
+		t.mu.Unlock()
+		return err
+	}
+	t.mu.Lock()
+	t.cm = cm
+	t.mu.Unlock()
+	go func() {
+		<-cm.Done()
+		close(t.done)
+	}()
+	return nil
+}
+
+// Disconnect implements Transport.
+func (t *Autopaho) Disconnect(ctx context.Context) error {
+	cm := t.ConnectionManager()
+	if cm == nil {
+		return ErrNotConnected
+	}
+	return cm.Disconnect(ctx)
+}
+
+// String returns the broker urls of the transport.
+func (t *Autopaho) String() string {
+	return fmt.Sprint(t.cfg.BrokerUrls)
+}
+
+// Done implements Transport.
+func (t *Autopaho) Done() <-chan struct{} {
+	return t.done
+}
@@ -0,0 +1,185 @@
+package transport
+
+import (
+	"context"
+	"github.com/eclipse/paho.golang/paho"
+	"sync"
+)
+
+// Loopback is an in-process Transport without a broker. The messages
+// published on it are delivered to its own handlers, if a subscription
+// matches the topic. An Engine and a Client sharing one Loopback can talk
+// to each other, which makes deterministic tests possible.
+// It does not keep retained messages.
+type Loopback struct {
+	// ResponseInfo is the Response Information of the connection, sent if a
+	// connect packet configurator requests it.
+	ResponseInfo string
+
+	mu        sync.RWMutex
+	subs      map[string]paho.SubscribeOptions
+	router    *Router
+	onUp      []func(connack *paho.Connack)
+	configure []func(connect *paho.Connect) *paho.Connect
+	connack   *paho.Connack
+	connected bool
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewLoopback returns a new Loopback transport.
+func NewLoopback() *Loopback {
+	return &Loopback{
+		subs:   make(map[string]paho.SubscribeOptions),
+		router: NewRouter(),
+		done:   make(chan struct{}),
+	}
+}
+
+// Publish implements Transport. The message is dispatched by a Router
+// in the calling goroutine.
+func (t *Loopback) Publish(_ context.Context, p *paho.Publish) (*paho.PublishResponse, error) {
+	t.mu.RLock()
+	if !t.connected {
+		t.mu.RUnlock()
+		return nil, ErrNotConnected
+	}
+	subscribed := false
+	for filter := range t.subs {
+		if Match(filter, p.Topic) {
+			subscribed = true
+			break
+		}
+	}
+	t.mu.RUnlock()
+	if subscribed {
+		t.router.Dispatch(clonePublish(p))
+	}
+	return &paho.PublishResponse{}, nil
+}
+
+// Subscribe implements Transport.
+func (t *Loopback) Subscribe(_ context.Context, s *paho.Subscribe) (*paho.Suback, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.connected {
+		return nil, ErrNotConnected
+	}
+	suback := &paho.Suback{}
+	for filter, opts := range s.Subscriptions {
+		t.subs[filter] = opts
+		suback.Reasons = append(suback.Reasons, opts.QoS)
+	}
+	return suback, nil
+}
+
+// Unsubscribe implements Transport.
+func (t *Loopback) Unsubscribe(_ context.Context, u *paho.Unsubscribe) (*paho.Unsuback, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.connected {
+		return nil, ErrNotConnected
+	}
+	unsuback := &paho.Unsuback{}
+	for _, filter := range u.Topics {
+		delete(t.subs, filter)
+		unsuback.Reasons = append(unsuback.Reasons, 0)
+	}
+	return unsuback, nil
+}
+
+// Handle implements Transport.
+func (t *Loopback) Handle(filter string, handler paho.MessageHandler) {
+	t.router.RegisterHandler(filter, handler)
+}
+
+// HandleExclusive implements Transport.
+func (t *Loopback) HandleExclusive(topic string, handler paho.MessageHandler) {
+	t.router.RegisterExclusive(topic, handler)
+}
+
+// Unhandle implements Transport.
+func (t *Loopback) Unhandle(filter string) {
+	t.router.UnregisterHandler(filter)
+}
+
+// OnConnectionUp implements Transport.
+func (t *Loopback) OnConnectionUp(fn func(connack *paho.Connack)) {
+	t.mu.Lock()
+	t.onUp = append(t.onUp, fn)
+	connected, connack := t.connected, t.connack
+	t.mu.Unlock()
+	if connected {
+		fn(connack)
+	}
+}
+
+// ConfigureConnect implements ConnectConfigurer.
+func (t *Loopback) ConfigureConnect(fn func(connect *paho.Connect) *paho.Connect) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.configure = append(t.configure, fn)
+}
+
+// Connect implements Transport. The connection is up immediately.
+func (t *Loopback) Connect(context.Context) error {
+	t.mu.Lock()
+	if t.connected {
+		t.mu.Unlock()
+		return nil
+	}
+	select {
+	case <-t.done:
+		t.mu.Unlock()
+		return ErrNotConnected
+	default:
+	}
+	connect := &paho.Connect{Properties: &paho.ConnectProperties{}}
+	for _, fn := range t.configure {
+		connect = fn(connect)
+	}
+	t.connack = &paho.Connack{Properties: &paho.ConnackProperties{}}
+	if connect.Properties != nil && connect.Properties.RequestResponseInfo {
+		t.connack.Properties.ResponseInfo = t.ResponseInfo
+	}
+	t.connected = true
+	onUp := append([]func(*paho.Connack){}, t.onUp...)
+	connack := t.connack
+	t.mu.Unlock()
+	for _, fn := range onUp {
+		fn(connack)
+	}
+	return nil
+}
+
+// Disconnect implements Transport. A disconnected Loopback cannot connect again.
+func (t *Loopback) Disconnect(context.Context) error {
+	t.mu.Lock()
+	t.connected = false
+	t.mu.Unlock()
+	t.closeOnce.Do(func() {
+		close(t.done)
+	})
+	return nil
+}
+
+// String returns "loopback".
+func (t *Loopback) String() string {
+	return "loopback"
+}
+
+// Done implements Transport.
+func (t *Loopback) Done() <-chan struct{} {
+	return t.done
+}
+
+// clonePublish copies the message, so that handlers never share it with the publisher.
+func clonePublish(p *paho.Publish) *paho.Publish {
+	msg := *p
+	if p.Properties != nil {
+		props := *p.Properties
+		props.User = append(paho.UserProperties(nil), p.Properties.User...)
+		msg.Properties = &props
+	}
+	return &msg
+}
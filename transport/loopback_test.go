@@ -0,0 +1,97 @@
+package transport
+
+import (
+	"context"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	assert.True(t, Match("a/+/c", "a/b/c"))
+	assert.True(t, Match("a/#", "a"))
+	assert.True(t, Match("a/#", "a/b/c"))
+	assert.True(t, Match("$share/g/a/+", "a/b"))
+	assert.False(t, Match("a/+", "a/b/c"))
+	assert.False(t, Match("a/b", "a/c"))
+}
+
+func TestLoopback(t *testing.T) {
+	ctx := context.Background()
+	tr := NewLoopback()
+	_, err := tr.Publish(ctx, &paho.Publish{Topic: "a/b"})
+	assert.ErrorIs(t, err, ErrNotConnected)
+
+	var ups int
+	tr.OnConnectionUp(func(*paho.Connack) { ups++ })
+	require.NoError(t, tr.Connect(ctx))
+	tr.OnConnectionUp(func(*paho.Connack) { ups++ })
+	assert.Equal(t, 2, ups)
+
+	var got []*paho.Publish
+	tr.Handle("a/+", func(p *paho.Publish) { got = append(got, p) })
+	// Not subscribed yet
+	_, err = tr.Publish(ctx, &paho.Publish{Topic: "a/b"})
+	require.NoError(t, err)
+	assert.Empty(t, got)
+
+	_, err = tr.Subscribe(ctx, &paho.Subscribe{Subscriptions: map[string]paho.SubscribeOptions{"$share/g/a/+": {}}})
+	require.NoError(t, err)
+	pb := &paho.Publish{Topic: "a/b", Properties: &paho.PublishProperties{User: paho.UserProperties{}.Add("k", "v")}}
+	_, err = tr.Publish(ctx, pb)
+	require.NoError(t, err)
+	require.Len(t, got, 1)
+	assert.Equal(t, "v", got[0].Properties.User.Get("k"))
+	assert.NotSame(t, pb, got[0])
+
+	_, err = tr.Unsubscribe(ctx, &paho.Unsubscribe{Topics: []string{"$share/g/a/+"}})
+	require.NoError(t, err)
+	_, err = tr.Publish(ctx, pb)
+	require.NoError(t, err)
+	assert.Len(t, got, 1)
+
+	require.NoError(t, tr.Disconnect(ctx))
+	<-tr.Done()
+	assert.ErrorIs(t, tr.Connect(ctx), ErrNotConnected)
+}
+
+func TestRouter(t *testing.T) {
+	r := NewRouter()
+	var got []string
+	r.RegisterHandler("#", func(p *paho.Publish) { got = append(got, "all") })
+	r.RegisterExclusive("a/responses", func(p *paho.Publish) { got = append(got, "responses") })
+	r.Dispatch(&paho.Publish{Topic: "a/responses"})
+	assert.Equal(t, []string{"responses"}, got)
+	r.Dispatch(&paho.Publish{Topic: "a/b"})
+	assert.Equal(t, []string{"responses", "all"}, got)
+	r.UnregisterHandler("a/responses")
+	r.Dispatch(&paho.Publish{Topic: "a/responses"})
+	assert.Equal(t, []string{"responses", "all", "all"}, got)
+	assert.Panics(t, func() { r.RegisterExclusive("a/+", func(p *paho.Publish) {}) })
+}
+
+func TestRouterSameFilter(t *testing.T) {
+	r := NewRouter()
+	var got []string
+	r.RegisterHandler("user/+/x", func(p *paho.Publish) { got = append(got, "name") })
+	r.RegisterHandler("user/+/x", func(p *paho.Publish) { got = append(got, "id") })
+	// A handler of a topic without wildcards is not exclusive
+	r.RegisterHandler("user/1/x", func(p *paho.Publish) { got = append(got, "exact") })
+	r.Dispatch(&paho.Publish{Topic: "user/1/x"})
+	assert.ElementsMatch(t, []string{"name", "id", "exact"}, got)
+}
+
+func TestLoopbackSameFilter(t *testing.T) {
+	ctx := context.Background()
+	tr := NewLoopback()
+	require.NoError(t, tr.Connect(ctx))
+	var got []string
+	tr.Handle("a/+", func(p *paho.Publish) { got = append(got, "first") })
+	tr.Handle("a/+", func(p *paho.Publish) { got = append(got, "second") })
+	_, err := tr.Subscribe(ctx, &paho.Subscribe{Subscriptions: map[string]paho.SubscribeOptions{"a/+": {}}})
+	require.NoError(t, err)
+	_, err = tr.Publish(ctx, &paho.Publish{Topic: "a/b"})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"first", "second"}, got)
+}
@@ -0,0 +1,83 @@
+package transport
+
+import (
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+	"strings"
+	"sync"
+)
+
+// Router is the paho.Router used by the transports. It dispatches a message
+// to every handler of the matching topic filters, except that an exclusive
+// handler of a topic takes the messages of that topic alone. So when an Engine
+// and a Client share one transport, the responses on the response topic of
+// the Client never reach the routes of the Engine.
+type Router struct {
+	mu        sync.RWMutex
+	handlers  map[string][]paho.MessageHandler
+	exclusive map[string]paho.MessageHandler
+}
+
+// NewRouter returns a new Router.
+func NewRouter() *Router {
+	return &Router{
+		handlers:  make(map[string][]paho.MessageHandler),
+		exclusive: make(map[string]paho.MessageHandler),
+	}
+}
+
+// RegisterHandler implements paho.Router. The handlers of a filter are all called.
+func (r *Router) RegisterHandler(filter string, handler paho.MessageHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handlers[filter] = append(r.handlers[filter], handler)
+}
+
+// RegisterExclusive registers the handler taking the messages of the topic,
+// which has no wildcards, exclusively. It replaces the previous one.
+func (r *Router) RegisterExclusive(topic string, handler paho.MessageHandler) {
+	if strings.ContainsAny(topic, "+#") {
+		panic("exclusive handler of a topic filter")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.exclusive[topic] = handler
+}
+
+// UnregisterHandler implements paho.Router. It removes all the handlers of the filter.
+func (r *Router) UnregisterHandler(filter string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.handlers, filter)
+	delete(r.exclusive, filter)
+}
+
+// Route implements paho.Router.
+func (r *Router) Route(pb *packets.Publish) {
+	r.Dispatch(paho.PublishFromPacketPublish(pb))
+}
+
+// SetDebugLogger implements paho.Router.
+func (r *Router) SetDebugLogger(paho.Logger) {}
+
+// Dispatch calls the handlers of the message in the calling goroutine.
+func (r *Router) Dispatch(p *paho.Publish) {
+	for _, handler := range r.match(p.Topic) {
+		handler(p)
+	}
+}
+
+func (r *Router) match(topic string) []paho.MessageHandler {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if handler, ok := r.exclusive[topic]; ok {
+		return []paho.MessageHandler{handler}
+	}
+	var handlers []paho.MessageHandler
+	for filter, fs := range r.handlers {
+		if Match(filter, topic) {
+			handlers = append(handlers, fs...)
+		}
+	}
+	return handlers
+}
@@ -0,0 +1,71 @@
+// Package transport abstracts the MQTT connection used by an Engine or a Client.
+package transport
+
+import (
+	"context"
+	"errors"
+	"github.com/eclipse/paho.golang/paho"
+	"strings"
+)
+
+// ErrNotConnected is returned when the transport has no connection to use.
+var ErrNotConnected = errors.New("transport: not connected")
+
+// Transport carries the MQTT traffic of an Engine or a Client.
+type Transport interface {
+	// Publish sends the message.
+	Publish(ctx context.Context, p *paho.Publish) (*paho.PublishResponse, error)
+	// Subscribe makes the subscriptions.
+	Subscribe(ctx context.Context, s *paho.Subscribe) (*paho.Suback, error)
+	// Unsubscribe removes the subscriptions.
+	Unsubscribe(ctx context.Context, u *paho.Unsubscribe) (*paho.Unsuback, error)
+	// Handle adds a handler of the messages delivered on the topic filter.
+	Handle(filter string, handler paho.MessageHandler)
+	// HandleExclusive registers the handler taking the messages of the topic
+	// alone, e.g. a response topic, so that no handler of a matching filter
+	// receives them.
+	HandleExclusive(topic string, handler paho.MessageHandler)
+	// Unhandle unregisters the handlers of the topic filter.
+	Unhandle(filter string)
+	// OnConnectionUp adds a callback which is called every time the connection
+	// is up. It is called immediately if the connection is already up.
+	OnConnectionUp(fn func(connack *paho.Connack))
+	// Connect starts connecting. It does not wait for the connection to be up.
+	Connect(ctx context.Context) error
+	// Disconnect closes the connection.
+	Disconnect(ctx context.Context) error
+	// Done is closed when the transport exits.
+	Done() <-chan struct{}
+}
+
+// ConnectConfigurer is implemented by the transports whose connect packet
+// can be configured, e.g. to request the Response Information.
+type ConnectConfigurer interface {
+	// ConfigureConnect adds a connect packet configurator. The configurators
+	// are applied in the order they are added.
+	ConfigureConnect(fn func(connect *paho.Connect) *paho.Connect)
+}
+
+// Match reports whether the topic matches the filter. A shared subscription
+// filter `$share/group/filter` matches the topics of its filter.
+func Match(filter, topic string) bool {
+	if strings.HasPrefix(filter, "$share/") {
+		if parts := strings.SplitN(filter, "/", 3); len(parts) == 3 {
+			filter = parts[2]
+		}
+	}
+	return matchDeep(strings.Split(filter, "/"), strings.Split(topic, "/"))
+}
+
+func matchDeep(filter []string, topic []string) bool {
+	if len(filter) == 0 {
+		return len(topic) == 0
+	}
+	if filter[0] == "#" {
+		return true
+	}
+	if len(topic) == 0 || (filter[0] != "+" && filter[0] != topic[0]) {
+		return false
+	}
+	return matchDeep(filter[1:], topic[1:])
+}